@@ -0,0 +1,204 @@
+package flow
+
+// The adapters in this file turn plain (typed) functions into gadgets, as
+// Transformer does for functions from Message to Message. Each of them has an
+// In pin, unless it's a source, and an Out pin, unless it's a sink. Messages on
+// the In pin which are not of the expected type, such as tags, are passed on
+// to Out unchanged (or dropped, if there is no Out pin).
+//
+// The variants ending in "Err" take functions which can also return an error.
+// Such errors are sent to the Err pin as Error, and the message causing it is
+// dropped.
+
+// Map processes each message of type T through a supplied function.
+func Map[T, R any](fun func(T) R) Circuitry {
+	return MapErr(func(v T) (R, error) { return fun(v), nil })
+}
+
+// MapErr is a Map which also sends errors to an Err pin.
+func MapErr[T, R any](fun func(T) (R, error)) Circuitry {
+	return FlatMapErr(func(v T) ([]R, error) {
+		r, err := fun(v)
+		return []R{r}, err
+	})
+}
+
+// Filter passes on only those messages of type T for which pred returns true.
+func Filter[T any](pred func(T) bool) Circuitry {
+	return FilterErr(func(v T) (bool, error) { return pred(v), nil })
+}
+
+// FilterErr is a Filter which also sends errors to an Err pin.
+func FilterErr[T any](pred func(T) (bool, error)) Circuitry {
+	return FlatMapErr(func(v T) ([]T, error) {
+		ok, err := pred(v)
+		if !ok {
+			return nil, err
+		}
+		return []T{v}, err
+	})
+}
+
+// FlatMap sends out all the values returned for each message of type T.
+func FlatMap[T, R any](fun func(T) []R) Circuitry {
+	return FlatMapErr(func(v T) ([]R, error) { return fun(v), nil })
+}
+
+// FlatMapErr is a FlatMap which also sends errors to an Err pin.
+func FlatMapErr[T, R any](fun func(T) ([]R, error)) Circuitry {
+	return Expand(func(v T, emit func(R)) error {
+		r, err := fun(v)
+		if err == nil {
+			for _, x := range r {
+				emit(x)
+			}
+		}
+		return err
+	})
+}
+
+// Expand calls a function for each message of type T, which can then send out
+// any number of values through the emit callback. Returned errors are sent to
+// the Err pin, values emitted before that are still sent out.
+func Expand[T, R any](fun func(T, func(R)) error) Circuitry {
+	return &expander[T, R]{fun: fun}
+}
+
+type expander[T, R any] struct {
+	Gadget
+	In  Input
+	Out Output
+	Err Output
+
+	fun func(T, func(R)) error
+}
+
+func (g *expander[T, R]) Run() {
+	emit := func(r R) { g.Out.Send(r) }
+	for m := range g.In {
+		if v, ok := m.(T); ok {
+			if err := g.fun(v, emit); err != nil {
+				g.Err.Send(g.Error(err, m))
+			}
+		} else {
+			g.Out.Send(m)
+		}
+	}
+}
+
+// Fold combines all messages of type T into an accumulator, starting from the
+// given initial value. The result is sent out once the input is closed.
+func Fold[T, A any](init A, fun func(A, T) A) Circuitry {
+	return &folder[T, A]{acc: init, fun: fun}
+}
+
+type folder[T, A any] struct {
+	Gadget
+	In  Input
+	Out Output
+
+	acc A
+	fun func(A, T) A
+}
+
+func (g *folder[T, A]) Run() {
+	for m := range g.In {
+		if v, ok := m.(T); ok {
+			g.acc = g.fun(g.acc, v)
+		} else {
+			g.Out.Send(m)
+		}
+	}
+	g.Out.Send(g.acc)
+}
+
+// Reduce is a Fold which starts from the first message of type T. Nothing is
+// sent out if there were no such messages.
+func Reduce[T any](fun func(T, T) T) Circuitry {
+	return &reducer[T]{fun: fun}
+}
+
+type reducer[T any] struct {
+	Gadget
+	In  Input
+	Out Output
+
+	fun func(T, T) T
+}
+
+func (g *reducer[T]) Run() {
+	var acc T
+	seen := false
+	for m := range g.In {
+		if v, ok := m.(T); !ok {
+			g.Out.Send(m)
+		} else if seen {
+			acc = g.fun(acc, v)
+		} else {
+			acc, seen = v, true
+		}
+	}
+	if seen {
+		g.Out.Send(acc)
+	}
+}
+
+// Sink calls a function for each message of type T, other messages are dropped.
+func Sink[T any](fun func(T)) Circuitry {
+	return SinkErr(func(v T) error {
+		fun(v)
+		return nil
+	})
+}
+
+// SinkErr is a Sink which also sends errors to an Err pin.
+func SinkErr[T any](fun func(T) error) Circuitry {
+	return &sinker[T]{fun: fun}
+}
+
+type sinker[T any] struct {
+	Gadget
+	In  Input
+	Err Output
+
+	fun func(T) error
+}
+
+func (g *sinker[T]) Run() {
+	for m := range g.In {
+		if v, ok := m.(T); ok {
+			if err := g.fun(v); err != nil {
+				g.Err.Send(g.Error(err, m))
+			}
+		}
+	}
+}
+
+// Source turns a generator function into a gadget. The function is called once
+// and sends out values through the emit callback, the Out pin gets closed once
+// it returns.
+func Source[R any](fun func(emit func(R))) Circuitry {
+	return SourceErr(func(emit func(R)) error {
+		fun(emit)
+		return nil
+	})
+}
+
+// SourceErr is a Source which sends a returned error to an Err pin.
+func SourceErr[R any](fun func(emit func(R)) error) Circuitry {
+	return &source[R]{fun: fun}
+}
+
+type source[R any] struct {
+	Gadget
+	Out Output
+	Err Output
+
+	fun func(func(R)) error
+}
+
+func (g *source[R]) Run() {
+	if err := g.fun(func(r R) { g.Out.Send(r) }); err != nil {
+		g.Err.Send(g.Error(err, nil))
+	}
+}
@@ -0,0 +1,154 @@
+package flow_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/flowtest"
+)
+
+func ExampleMap() {
+	g := flow.NewCircuit()
+	g.AddCircuitry("m", flow.Map(strings.ToUpper))
+	g.Add("p", "Printer")
+	g.Connect("m.Out", "p.In", 0)
+	g.Feed("m.In", "abc")
+	g.Feed("m.In", 123) // not a string, passed on as is
+	g.Run()
+	// Output:
+	// ABC
+	// 123
+}
+
+func ExampleFilter() {
+	g := flow.NewCircuit()
+	g.AddCircuitry("f", flow.Filter(func(n int) bool { return n%2 == 0 }))
+	g.Add("p", "Printer")
+	g.Connect("f.Out", "p.In", 0)
+	for i := 1; i <= 5; i++ {
+		g.Feed("f.In", i)
+	}
+	g.Run()
+	// Output:
+	// 2
+	// 4
+}
+
+func ExampleFlatMap() {
+	g := flow.NewCircuit()
+	g.AddCircuitry("f", flow.FlatMap(strings.Fields))
+	g.Add("p", "Printer")
+	g.Connect("f.Out", "p.In", 0)
+	g.Feed("f.In", "a b")
+	g.Feed("f.In", "c")
+	g.Run()
+	// Output:
+	// a
+	// b
+	// c
+}
+
+func ExampleFold() {
+	g := flow.NewCircuit()
+	g.AddCircuitry("f", flow.Fold("", func(acc string, n int) string {
+		return acc + strconv.Itoa(n)
+	}))
+	g.Add("p", "Printer")
+	g.Connect("f.Out", "p.In", 0)
+	g.Feed("f.In", 1)
+	g.Feed("f.In", 2)
+	g.Feed("f.In", 3)
+	g.Run()
+	// Output:
+	// 123
+}
+
+func ExampleReduce() {
+	g := flow.NewCircuit()
+	g.AddCircuitry("r", flow.Reduce(func(a, b int) int { return a + b }))
+	g.Add("p", "Printer")
+	g.Connect("r.Out", "p.In", 0)
+	g.Feed("r.In", 1)
+	g.Feed("r.In", 2)
+	g.Feed("r.In", 3)
+	g.Run()
+	// Output:
+	// 6
+}
+
+func ExampleSource() {
+	g := flow.NewCircuit()
+	g.AddCircuitry("s", flow.Source(func(emit func(int)) {
+		for i := 0; i < 3; i++ {
+			emit(i * 10)
+		}
+	}))
+	g.AddCircuitry("p", flow.Sink(func(n int) { fmt.Println("got", n) }))
+	g.Connect("s.Out", "p.In", 0)
+	g.Run()
+	// Output:
+	// got 0
+	// got 10
+	// got 20
+}
+
+func TestAdapterErrors(t *testing.T) {
+	g := flow.NewCircuit()
+	out, errs := new(flowtest.Collector), new(flowtest.Collector)
+	g.AddCircuitry("m", flow.MapErr(strconv.Atoi))
+	g.AddCircuitry("out", out)
+	g.AddCircuitry("errs", errs)
+	g.Connect("m.Out", "out.In", 0)
+	g.Connect("m.Err", "errs.In", 0)
+	g.Feed("m.In", "12")
+	g.Feed("m.In", "x")
+	g.Feed("m.In", "34")
+	g.Run()
+
+	if want := []flow.Message{12, 34}; !reflect.DeepEqual(out.Msgs, want) {
+		t.Errorf("expected %v, got %v", want, out.Msgs)
+	}
+	if len(errs.Msgs) != 1 {
+		t.Fatalf("expected one error, got %v", errs.Msgs)
+	}
+	e, ok := errs.Msgs[0].(*flow.Error)
+	if !ok || e.Path != "/m" || e.Msg != "x" {
+		t.Fatalf("unexpected error: %v", errs.Msgs[0])
+	}
+	var cause *strconv.NumError
+	if !errors.As(e, &cause) {
+		t.Errorf("unexpected cause: %v", e.Cause)
+	}
+}
+
+func TestSinkErr(t *testing.T) {
+	fail := errors.New("odd")
+	g := flow.NewCircuit()
+	var seen []int
+	errs := new(flowtest.Collector)
+	g.AddCircuitry("s", flow.SinkErr(func(n int) error {
+		seen = append(seen, n)
+		if n%2 != 0 {
+			return fail
+		}
+		return nil
+	}))
+	g.AddCircuitry("errs", errs)
+	g.Connect("s.Err", "errs.In", 0)
+	g.Feed("s.In", 1)
+	g.Feed("s.In", 2)
+	g.Feed("s.In", "skipped")
+	g.Run()
+
+	if want := []int{1, 2}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("expected %v, got %v", want, seen)
+	}
+	if len(errs.Msgs) != 1 || !errors.Is(errs.Msgs[0].(error), fail) {
+		t.Errorf("expected %v, got %v", fail, errs.Msgs)
+	}
+}
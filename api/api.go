@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"github.com/golang/glog"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 )
 
 //Holds the basic Interface API's that flow can provide - (this should never grow too big in reality)
@@ -38,6 +40,28 @@ import (
 // the SettingAPI object, initialised specifically for the caller gadget
 //
 // Note: If 'new' is not specified by the provider, all gadgets will get the *same* instance of the provider.
+// A 'new' instance starts out as a (shallow) copy of the provider's own instance.
+//
+// A consumer field which has already been set (i.e. by the gadget's constructor) is left alone,
+// this allows tests to hand a gadget an in-memory implementation of an API.
+//
+// Named providers:
+// Several providers can offer the same api, as long as they register under different names:
+//   `flowapi:"DBReadWriteAPI,name=history"`
+// and a consumer selects one of them by name:
+//   `gadget:"DBReadWriteAPI,name=history"`
+// A consumer without a name gets the unnamed provider, or the only provider if there is just one.
+// Anything else (no match, or several matching providers) is reported as an error.
+//
+// Optional consumers:
+// A consumer which can do without an api adds the 'optional' modifier:
+//   `gadget:"DBReadWriteAPI,optional"`
+// If there is no (matching) provider, the field is then simply left nil, instead of reporting an error.
+// Several matching providers are still reported as an error.
+// Providers() lists all providers, along with the consumers each one is serving.
+//
+// Lifecycle:
+// Implementations can optionally support Start, Close and Health, see lifecycle.go
 //
 // Initialization:
 // The framework looks for the method InitAPI(...interface{}) on each of the API interfaces it provides.
@@ -52,21 +76,131 @@ type FlowAPI struct {
 	//DBReadAPI IDBReadAPI
 	//DBWriteAPI IDBWriteAPI
 	DBReadWriteAPI IDBReadWriteAPI
-	//FilesystemAPI IFileSystemAPI
+	FilesystemAPI IFileSystemAPI
 }
 
 //allows us to reflect over the 'current' api.
 var api *FlowAPI
-var dict map[string]dictEntry
+
+//all providers seen so far, by api name
+var dict map[string][]*dictEntry
+var dictLock sync.Mutex
 
 type dictEntry struct {
 	reflect.Value
-	Props []string
+	Props     []string
+	Name      string   //as set with the 'name=' modifier
+	Provider  string   //the gadget offering this entry
+	Consumers []string //path + name of all gadgets using it
 }
 
 func init() {
 	api = new(FlowAPI)
-	dict = make(map[string]dictEntry)
+	dict = make(map[string][]*dictEntry)
+}
+
+//Describes one provider and who is using it, as returned by Providers()
+type ProviderInfo struct {
+	API       string
+	Name      string
+	Provider  string
+	Modifiers []string
+	Consumers []string
+}
+
+//list all known providers, sorted by api and name
+func Providers() []ProviderInfo {
+	dictLock.Lock()
+	defer dictLock.Unlock()
+
+	list := []ProviderInfo{}
+	for apiname, entries := range dict {
+		for _, e := range entries {
+			list = append(list, ProviderInfo{
+				API:       apiname,
+				Name:      e.Name,
+				Provider:  e.Provider,
+				Modifiers: append([]string{}, e.Props...),
+				Consumers: append([]string{}, e.Consumers...),
+			})
+		}
+	}
+	sort.Sort(byAPIAndName(list))
+	return list
+}
+
+type byAPIAndName []ProviderInfo
+
+func (l byAPIAndName) Len() int      { return len(l) }
+func (l byAPIAndName) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l byAPIAndName) Less(i, j int) bool {
+	if l[i].API != l[j].API {
+		return l[i].API < l[j].API
+	}
+	if l[i].Name != l[j].Name {
+		return l[i].Name < l[j].Name
+	}
+	return l[i].Provider < l[j].Provider
+}
+
+//the error for an api without any (matching) provider
+type missingProvider string
+
+func (e missingProvider) Error() string {
+	return "FlowAPI missing provider " + string(e)
+}
+
+//pick the provider for a consumer, see 'Named providers' above
+func lookupProvider(apiname, name string) (*dictEntry, error) {
+	entries := dict[apiname]
+	matches := []*dictEntry{}
+	for _, e := range entries {
+		if e.Name == name {
+			matches = append(matches, e)
+		}
+	}
+	if name == "" && len(matches) == 0 && len(entries) == 1 {
+		matches = entries //just one provider, named or not
+	}
+
+	qualified := apiname
+	if name != "" {
+		qualified += ",name=" + name
+	}
+	switch len(matches) {
+	case 0:
+		if name == "" && len(entries) > 1 {
+			return nil, fmt.Errorf("FlowAPI has %d named providers for %s, select one with 'name=': %s",
+				len(entries), apiname, providerNames(entries))
+		}
+		return nil, missingProvider(qualified)
+	case 1:
+		return matches[0], nil
+	}
+	return nil, fmt.Errorf("FlowAPI has ambiguous providers for %s: %s", qualified, providerNames(matches))
+}
+
+func providerNames(entries []*dictEntry) string {
+	names := []string{}
+	for _, e := range entries {
+		if e.Name != "" {
+			names = append(names, e.Name+" ("+e.Provider+")")
+		} else {
+			names = append(names, e.Provider)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+//get the value of a 'key=value' modifier
+func propValue(props []string, key string) string {
+	for _, p := range props {
+		if strings.HasPrefix(p, key+"=") {
+			return p[len(key)+1:]
+		}
+	}
+	return ""
 }
 
 type FlowAPIOptions struct {
@@ -85,84 +219,121 @@ func NewFlowAPIOptions() FlowAPIOptions {
 	return opt
 }
 
+//every gadget has a name and a path in its circuit
+type gadgetNamer interface {
+	Name() string
+	Path() string
+}
+
 //inject any api services the gadget needs (services are provided by gadget 'Providers')
 func InjectAPI(c interface{}, opts FlowAPIOptions) error {
 
 	//These are of course all *Gadgets
 	inst := reflect.ValueOf(c)
+	namer, ok := c.(gadgetNamer)
+	if !ok {
+		return fmt.Errorf("FlowAPI cannot inject into %T, it is not a gadget", c)
+	}
 
-	name := inst.MethodByName("Name").Call(nil)[0]
-	path := inst.MethodByName("Path").Call(nil)[0]
+	//see if the gadget [requests] any services from 'flow/api'
+	fields := apiFields(inst.Elem().Type(), "gadget") //tag we look at for 'consumer' gadgets
+	if len(fields) == 0 {
+		return nil
+	}
+
+	name := reflect.ValueOf(namer.Name())
+	path := reflect.ValueOf(namer.Path())
 
 	if glog.V(2) {
 		glog.Infoln("Injector called for %s %s %s\n", inst, path, name)
 	}
 
-	//see if the gadget [requests] any services from 'flow/api'
-	//TODO: Implement a runtime 'cache' to speed up subsequent gadget lookups
-	st := inst.Elem().Type()
-	for i := 0; i < st.NumField(); i++ {
-
-		field := st.Field(i)
+	apival := reflect.Indirect(reflect.ValueOf(api))
 
-		tparams := field.Tag.Get("gadget") //tag we look at for 'consumer' gadgets
-		props := strings.Split(tparams, ",")
-		apiname := props[0]
+	for _, field := range fields {
 
-		if apiname != "" {
-			if glog.V(2) {
-				glog.Infoln("Gadget requests: %s\n", apiname)
-			}
+		apiname := field.apiname
 
-			apival := reflect.Indirect(reflect.ValueOf(api))
+		if glog.V(2) {
+			glog.Infoln("Gadget requests: %s\n", apiname)
+		}
 
-			f := apival.FieldByName(apiname)
+		optional := contains(field.props, "optional")
 
-			if !f.IsValid() { //we dont provide this api
-				if opts.ErrorOnConsumerRequest {
-					return errors.New(fmt.Sprintf("FlowAPI does not provide %s", apiname))
-				}
-				continue
+		if field.slot < 0 { //we dont provide this api
+			if opts.ErrorOnConsumerRequest && !optional {
+				return errors.New(fmt.Sprintf("FlowAPI does not provide %s", apiname))
 			}
+			continue
+		}
+
+		f := apival.Field(field.slot)
 
-			if !f.Type().AssignableTo(field.Type) { //the client cannot accept the api it requests
-				if opts.ErrorOnConsumerAssignment {
-					return errors.New(fmt.Sprintf("FlowAPI cannot provide this service - Gadget API incorrect for %s", apiname))
-				}
-				continue
+		if !f.Type().AssignableTo(field.ftype) { //the client cannot accept the api it requests
+			if opts.ErrorOnConsumerAssignment {
+				return errors.New(fmt.Sprintf("FlowAPI cannot provide this service - Gadget API incorrect for %s", apiname))
 			}
+			continue
+		}
 
-			vfield := inst.Elem().Field(i)
+		vfield := inst.Elem().Field(field.index)
+		if !vfield.IsNil() { //already set up, i.e. by the gadget's constructor
+			continue
+		}
 
-			src, ok := dict[apiname]
-			if !ok { //no provider that has been seen, can provide this api
-				if opts.ErrorOnConsumerRequest {
-					return errors.New(fmt.Sprintf("FlowAPI missing provider %s", apiname))
-				}
-				continue
+		dictLock.Lock()
+		src, err := lookupProvider(apiname, propValue(field.props, "name"))
+		if _, missing := err.(missingProvider); missing && optional {
+			dictLock.Unlock()
+			continue
+		}
+		if err == nil {
+			consumer := path.String() + name.String()
+			if !contains(src.Consumers, consumer) {
+				src.Consumers = append(src.Consumers, consumer)
+			}
+		}
+		dictLock.Unlock()
+		if err != nil { //no provider that has been seen, can provide this api
+			if opts.ErrorOnConsumerRequest {
+				return err
 			}
+			continue
+		}
 
-			trg := reflect.Value{}
+		trg := reflect.Value{}
 
-			//TODO: Error checking
-			if contains(src.Props, "new") {
-				base := src.Elem()
-				trg = reflect.New(base.Type())
+		if contains(src.Props, "new") {
+			base := src.Elem()
+			if base.Kind() == reflect.Ptr {
+				trg = reflect.New(base.Type().Elem())
+				trg.Elem().Set(base.Elem()) //copy of the provider
 			} else {
-				trg = f
+				trg = reflect.New(base.Type()).Elem()
+				trg.Set(base)
 			}
+		} else {
+			trg = src.Value
+		}
 
-			vfield.Set(trg)
+		vfield.Set(trg)
 
-			//Attempt to invoke the InitAPI(..interface{}) if its present
-			//we pass name, path (of the gadget within the circuit)
-			//this will help provide some 'scope' of the gadget using the API to the provider
-			m := vfield.MethodByName("InitAPI")
-			if m.IsValid() {
-				in := []reflect.Value{name, path}
-				m.Call(in)
-			}
+		//Attempt to invoke the InitAPI(..interface{}) if its present
+		//we pass name, path (of the gadget within the circuit)
+		//this will help provide some 'scope' of the gadget using the API to the provider
+		m := vfield.MethodByName("InitAPI")
+		if m.IsValid() {
+			in := []reflect.Value{name, path}
+			m.Call(in)
+		}
 
+		//make sure the implementation is running before the consumer is launched
+		desc, owner := apiname+" ("+src.Provider+")", interface{}(nil)
+		if contains(src.Props, "new") {
+			desc, owner = apiname+" for "+path.String()+name.String(), c
+		}
+		if err := startAPI(vfield.Interface(), desc, owner, field.index); err != nil {
+			return err
 		}
 
 	}
@@ -174,59 +345,70 @@ func InjectAPI(c interface{}, opts FlowAPIOptions) error {
 func IsAPIProvider(c interface{}, opts FlowAPIOptions) error {
 
 	inst := reflect.ValueOf(c)
+	namer, ok := c.(gadgetNamer)
+	if !ok {
+		return fmt.Errorf("FlowAPI cannot take providers from %T, it is not a gadget", c)
+	}
 
-	name := inst.MethodByName("Name").Call(nil)[0]
-	path := inst.MethodByName("Path").Call(nil)[0]
+	//see if the gadget [provides] any services to 'flow/api'
+	fields := apiFields(inst.Elem().Type(), "flowapi") //tag we look at for 'provider' gadgets
+	if len(fields) == 0 {
+		return nil
+	}
+
+	name := namer.Name()
+	path := namer.Path()
 
 	if glog.V(2) {
 		glog.Infoln("Provider called for %s %s %s\n", inst, path, name)
 	}
 
-	//TODO: Implement a runtime 'cache' to speed up subsequent gadget lookups
-	//see if the gadget [provides] any services to 'flow/api'
-	st := inst.Elem().Type()
-	for i := 0; i < st.NumField(); i++ {
+	//providers are usually fresh instances from the registry, without a name
+	provider := path + name
+	if name == "" {
+		provider = inst.Type().String()
+	}
 
-		field := st.Field(i)
+	apival := reflect.Indirect(reflect.ValueOf(api))
 
-		tparams := field.Tag.Get("flowapi") //tag we look at for 'consumer' gadgets
-		props := strings.Split(tparams, ",")
-		apiname := props[0]
+	for _, field := range fields {
 
-		if apiname != "" {
-			if glog.V(2) {
-				glog.Infoln("Gadget provides: %s\n", apiname)
-			}
-			apival := reflect.Indirect(reflect.ValueOf(api))
+		apiname := field.apiname
 
-			f := apival.FieldByName(apiname)
+		if glog.V(2) {
+			glog.Infoln("Gadget provides: %s\n", apiname)
+		}
 
-			if !f.IsValid() {
-				if opts.ErrorOnProviderOffering {
-					return errors.New(fmt.Sprintf("FlowAPI does not accept %s", apiname))
-				}
-				continue
+		if field.slot < 0 {
+			if opts.ErrorOnProviderOffering {
+				return errors.New(fmt.Sprintf("FlowAPI does not accept %s", apiname))
 			}
+			continue
+		}
 
-			vfield := inst.Elem().Field(i)
+		f := apival.Field(field.slot)
+		vfield := inst.Elem().Field(field.index)
 
-			if !vfield.Type().AssignableTo(f.Type()) {
-				if opts.ErrorOnProviderAssignment {
-					return errors.New(fmt.Sprintf("FlowAPI cannot accept this service - Gadget API incorrect for %s", apiname))
-				}
-				continue
+		if !vfield.Type().AssignableTo(f.Type()) {
+			if opts.ErrorOnProviderAssignment {
+				return errors.New(fmt.Sprintf("FlowAPI cannot accept this service - Gadget API incorrect for %s", apiname))
 			}
+			continue
+		}
 
-			//Important to infer real 'type' AND track modifiers
-			de := dictEntry{vfield, props[1:]}
-			dict[apiname] = de
+		//Important to infer real 'type' AND track modifiers
+		de := &dictEntry{Value: vfield, Props: field.props, Provider: provider}
+		de.Name = propValue(de.Props, "name")
+		dictLock.Lock()
+		dict[apiname] = append(dict[apiname], de)
+		dictLock.Unlock()
 
+		if de.Name == "" {
 			f.Set(vfield) //store this to the API (infers its been provided and matches API)
+		}
 
-			if glog.V(0) {
-				glog.Infoln("Provider installed for: %s via %s%s \n", apiname, path, name)
-			}
-
+		if glog.V(0) {
+			glog.Infoln("Provider installed for: %s via %s%s \n", apiname, path, name)
 		}
 
 	}
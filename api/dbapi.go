@@ -1,12 +1,22 @@
 package api
 
+//Read access to a key-value store, keys are always returned in sorted order
 type IDBReadAPI interface {
+	//Retrieve all keys starting with prefix
 	Keys(prefix string) ([]string, error)
+	//get the value stored for 'key', nil if there is none
 	Get(key string) (interface{}, error)
+	//call fn for each key in [from, to) in order, an empty 'to' means no upper bound
+	//iteration stops as soon as fn returns false, fn may safely Delete the key it is given
+	Range(from, to string, fn func(key string, value interface{}) bool) error
 }
 
+//Write access to a key-value store, each call is applied atomically
 type IDBWriteAPI interface {
+	//store a value for 'key', replacing any previous value
 	Put(key string, value interface{}) error
+	//remove 'key', deleting a missing key is not an error
+	Delete(key string) error
 }
 
 type IDBReadWriteAPI interface {
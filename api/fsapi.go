@@ -0,0 +1,53 @@
+package api
+
+import (
+	"io"
+	"os"
+)
+
+//A file opened through the filesystem API
+type File interface {
+	io.ReadWriteCloser
+	io.Seeker
+	Stat() (os.FileInfo, error)
+}
+
+//The kind of change reported for a watched file
+type FileOp string
+
+const (
+	FileCreate FileOp = "create"
+	FileWrite  FileOp = "write"
+	FileRemove FileOp = "remove"
+	FileRename FileOp = "rename"
+)
+
+//A change to a watched file, Name is relative to the provider's root
+type FileEvent struct {
+	Name string
+	Op   FileOp
+}
+
+//Provide file access to gadgets, names are always interpreted by the provider
+//(i.e. relative to its root directory), so that gadgets can be confined to it
+type IFileSystemAPI interface {
+	//Generic initialisation stub (per interface) - allows some 'context' for provider.
+	InitAPI(...interface{})
+	//open a file for reading
+	Open(name string) (File, error)
+	//create or truncate a file for writing
+	Create(name string) (File, error)
+	//open a file for writing at its end, creating it if it does not exist
+	Append(name string) (File, error)
+	//list the entries of a directory, sorted by name
+	ReadDir(name string) ([]os.FileInfo, error)
+	//get information about a file or directory
+	Stat(name string) (os.FileInfo, error)
+	//remove a file or an empty directory
+	Remove(name string) error
+	//rename a file, replacing the target if it exists
+	Rename(from, to string) error
+	//start sending changes to a file or directory to 'events', until stop is called
+	//events from several watches can be merged by passing the same channel
+	Watch(name string, events chan<- FileEvent) (stop func(), err error)
+}
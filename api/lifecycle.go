@@ -0,0 +1,174 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+//Optional lifecycle hooks, which the api implementations handed out by providers can support.
+//
+//An implementation is started just before the first gadget using it is launched, so providers
+//always start before their consumers (and a provider which depends on another one will find it
+//started, if it gets hold of it in the same way). Each 'new' instance is started separately,
+//and closed again as soon as the gadget it was handed to has finished, see ReleaseAPI.
+//While the circuit runs, all started implementations are checked for health from time to time,
+//an error cancels the circuit. Once all gadgets have finished, everything else is closed, in
+//the reverse order of starting.
+
+//Called before the first consumer is launched
+type Starter interface {
+	Start() error
+}
+
+//Called once all consumers have finished
+type Closer interface {
+	Close() error
+}
+
+//Called periodically while the circuit runs, an error cancels the circuit
+type HealthChecker interface {
+	Health() error
+}
+
+var life struct {
+	sync.Mutex
+	sessions int
+	started  []*startedAPI              //in order of starting
+	index    map[interface{}]bool       //the comparable values in started
+	owned    map[interface{}][]ownedAPI //the 'new' instances, per consumer
+}
+
+type startedAPI struct {
+	value interface{}
+	desc  string //for error messages
+}
+
+//a 'new' instance, and the field of the consumer it was injected into
+type ownedAPI struct {
+	api   *startedAPI
+	field int
+}
+
+//Begin a session, i.e. the run of a top-level circuit. Sessions can overlap,
+//implementations are only closed when the last one ends.
+func StartSession() {
+	life.Lock()
+	life.sessions++
+	life.Unlock()
+}
+
+//End a session, and close all started implementations if this was the last one.
+//Returns the first error reported by Close, if any.
+func EndSession() error {
+	life.Lock()
+	defer life.Unlock()
+
+	life.sessions--
+	if life.sessions > 0 {
+		return nil
+	}
+	life.sessions = 0
+
+	var first error
+	for i := len(life.started) - 1; i >= 0; i-- {
+		s := life.started[i]
+		if c, ok := s.value.(Closer); ok {
+			if err := c.Close(); err != nil && first == nil {
+				first = fmt.Errorf("FlowAPI cannot close %s: %v", s.desc, err)
+			}
+		}
+	}
+	life.started = nil
+	life.index = nil
+	life.owned = nil
+	return first
+}
+
+//Release the 'new' instances handed to a consumer, once it has finished. They are closed
+//and forgotten, and the consumer's fields are cleared, so that it gets fresh instances if
+//it is launched again. Shared implementations stay open until the session ends.
+//Returns the first error reported by Close, if any.
+func ReleaseAPI(c interface{}) error {
+	life.Lock()
+	list := life.owned[c]
+	delete(life.owned, c)
+	for _, o := range list {
+		for i, s := range life.started {
+			if s == o.api {
+				life.started = append(life.started[:i], life.started[i+1:]...)
+				break
+			}
+		}
+		if reflect.TypeOf(o.api.value).Comparable() {
+			delete(life.index, o.api.value)
+		}
+	}
+	life.Unlock()
+	if len(list) == 0 {
+		return nil
+	}
+
+	var first error
+	inst := reflect.ValueOf(c).Elem()
+	for i := len(list) - 1; i >= 0; i-- {
+		o := list[i]
+		if cl, ok := o.api.value.(Closer); ok {
+			if err := cl.Close(); err != nil && first == nil {
+				first = fmt.Errorf("FlowAPI cannot close %s: %v", o.api.desc, err)
+			}
+		}
+		field := inst.Field(o.field)
+		field.Set(reflect.Zero(field.Type()))
+	}
+	return first
+}
+
+//Check the health of all started implementations, returns the first problem found.
+func CheckHealth() error {
+	life.Lock()
+	list := append([]*startedAPI{}, life.started...)
+	life.Unlock()
+
+	for _, s := range list {
+		if h, ok := s.value.(HealthChecker); ok {
+			if err := h.Health(); err != nil {
+				return fmt.Errorf("FlowAPI provider %s is unhealthy: %v", s.desc, err)
+			}
+		}
+	}
+	return nil
+}
+
+//start an implementation, unless it has already been started in this session
+//if owner is not nil, the implementation is a 'new' instance injected into the given field
+//of that consumer, and it will be closed by ReleaseAPI
+func startAPI(value interface{}, desc string, owner interface{}, field int) error {
+	life.Lock()
+	defer life.Unlock()
+
+	comparable := reflect.TypeOf(value).Comparable()
+	if comparable && life.index[value] {
+		return nil
+	}
+	if st, ok := value.(Starter); ok {
+		if err := st.Start(); err != nil {
+			return fmt.Errorf("FlowAPI cannot start %s: %v", desc, err)
+		}
+	}
+	s := &startedAPI{value, desc}
+	life.started = append(life.started, s)
+	if owner != nil {
+		if life.owned == nil {
+			life.owned = map[interface{}][]ownedAPI{}
+		}
+		life.owned[owner] = append(life.owned[owner], ownedAPI{s, field})
+	}
+	if comparable {
+		if life.index == nil {
+			life.index = map[interface{}]bool{}
+		}
+		life.index[value] = true
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+//Walking the fields of a gadget type for api tags only needs to happen once per type,
+//the results are cached here since the same gadget types are injected over and over again.
+
+//One tagged field, as found in a gadget type
+type apiField struct {
+	index   int          //field index in the gadget struct
+	ftype   reflect.Type //field type
+	apiname string       //api requested or provided
+	props   []string     //modifiers following the api name
+	slot    int          //field index of the api in FlowAPI, -1 if there is none
+}
+
+type fieldsKey struct {
+	t   reflect.Type
+	tag string
+}
+
+var fieldCache = struct {
+	sync.RWMutex
+	m map[fieldsKey][]apiField
+}{m: map[fieldsKey][]apiField{}}
+
+var flowAPIType = reflect.TypeOf(FlowAPI{})
+
+//all fields of a gadget struct type with the given tag ('gadget' or 'flowapi')
+func apiFields(t reflect.Type, tag string) []apiField {
+	key := fieldsKey{t, tag}
+	fieldCache.RLock()
+	fields, ok := fieldCache.m[key]
+	fieldCache.RUnlock()
+	if ok {
+		return fields
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		props := strings.Split(field.Tag.Get(tag), ",")
+		if props[0] == "" {
+			continue
+		}
+		af := apiField{index: i, ftype: field.Type, apiname: props[0], props: props[1:], slot: -1}
+		if sf, ok := flowAPIType.FieldByName(af.apiname); ok {
+			af.slot = sf.Index[0]
+		}
+		fields = append(fields, af)
+	}
+
+	fieldCache.Lock()
+	fieldCache.m[key] = fields
+	fieldCache.Unlock()
+	return fields
+}
@@ -1,10 +1,12 @@
 package flow_test
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/laughlinez/flow"
-	_ "github.com/laughlinez/flow/gadgets"
+	"github.com/laughlinez/flow/api"
+	"github.com/laughlinez/flow/gadgets"
 )
 
 func BenchmarkRepeat0(b *testing.B) {
@@ -94,3 +96,39 @@ func BenchmarkRepPipe100(b *testing.B) {
 	g.Feed("r.Num", b.N)
 	g.Run()
 }
+
+func BenchmarkPipeChain100(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		g := flow.NewCircuit()
+		for j := 0; j < 100; j++ {
+			g.Add(fmt.Sprintf("p%d", j), "Pipe")
+			if j > 0 {
+				g.Connect(fmt.Sprintf("p%d.Out", j-1), fmt.Sprintf("p%d.In", j), 0)
+			}
+		}
+		g.Add("s", "Sink")
+		g.Connect("p99.Out", "s.In", 0)
+		g.Feed("p0.In", nil)
+		g.Run()
+	}
+}
+
+func BenchmarkInjectAPI(b *testing.B) {
+	opts := api.NewFlowAPIOptions()
+	flow.NewCircuit().Run() // make sure all providers have been registered
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := api.InjectAPI(new(gadgets.ReadFileText), opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInjectAPINone(b *testing.B) {
+	opts := api.NewFlowAPIOptions()
+	for i := 0; i < b.N; i++ {
+		if err := api.InjectAPI(new(gadgets.Repeater), opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
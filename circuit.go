@@ -3,6 +3,8 @@ package flow
 import (
 	"strings"
 	"sync"
+	"time"
+
 	"github.com/golang/glog"
 	api "github.com/laughlinez/flow/api"
 )
@@ -13,6 +15,7 @@ func NewCircuit() *Circuit {
 		gadgets: map[string]*Gadget{},
 		feeds:   map[string][]Message{},
 		labels:  map[string]string{},
+		done:    make(chan struct{}),
 	}
 }
 
@@ -25,8 +28,16 @@ type Circuit struct {
 	wires   []wireDef            // list of all connections
 	feeds   map[string][]Message // message feeds
 	labels  map[string]string    // pin label lookup map
+	lock    sync.Mutex           // protects gnames, gadgets, wires, and errors
+	copying bool                 // true if all wires deliver copies
+	onError func(*Error)         // called for errors from unconnected Err pins
+	errors  []*Error             // recent errors, if there is no onError
 
 	wait sync.WaitGroup // tracks number of running gadgets
+
+	done   chan struct{} // closed when the circuit is cancelled
+	err    error         // the reason for cancelling
+	cancel sync.Once
 }
 
 // definition of one named gadget
@@ -40,6 +51,7 @@ type wireDef struct {
 	From     string `json:"from"`
 	To       string `json:"to"`
 	Capacity int    `json:"capacity"`
+	Copy     bool   `json:"copy,omitempty"`
 }
 
 // Add a named gadget to the circuit with a unique name.
@@ -49,13 +61,19 @@ func (c *Circuit) Add(name, gadget string) {
 		glog.Warningln("not found:", gadget)
 		return
 	}
+	g := constructor()
+	c.lock.Lock()
 	c.gnames = append(c.gnames, gadgetDef{name, gadget})
-	c.AddCircuitry(name, constructor())
+	c.lock.Unlock()
+	c.AddCircuitry(name, g)
 }
 
 // Add a gadget or circuit to the circuit with a unique name.
 func (c *Circuit) AddCircuitry(name string, g Circuitry) {
-	c.gadgets[name] = g.initGadget(g, name, c)
+	gadget := g.initGadget(g, name, c)
+	c.lock.Lock()
+	c.gadgets[name] = gadget
+	c.lock.Unlock()
 }
 
 func (c *Circuit) gadgetOf(s string) *Gadget {
@@ -63,7 +81,9 @@ func (c *Circuit) gadgetOf(s string) *Gadget {
 	// if gadgetPart(s) == "" && c.labels[s] != "" {
 	// 	s = c.labels[s] // unnamed gadgets can use the circuit's pin map
 	// }
+	c.lock.Lock()
 	g, ok := c.gadgets[gadgetPart(s)]
+	c.lock.Unlock()
 	if !ok {
 		glog.Fatalln("gadget not found for:", s)
 	}
@@ -72,9 +92,40 @@ func (c *Circuit) gadgetOf(s string) *Gadget {
 
 // Connect an output pin with an input pin.
 func (c *Circuit) Connect(from, to string, capacity int) {
-	c.wires = append(c.wires, wireDef{from, to, capacity})
-	w := c.gadgetOf(to).getInput(pinPart(to), capacity)
-	c.gadgetOf(from).setOutput(pinPart(from), w)
+	c.connect(wireDef{from, to, capacity, false})
+}
+
+// Connect an output pin with an input pin, which will receive deep copies of
+// all messages sent, so that they can't be affected by what happens elsewhere.
+func (c *Circuit) ConnectCopy(from, to string, capacity int) {
+	c.connect(wireDef{from, to, capacity, true})
+}
+
+func (c *Circuit) connect(def wireDef) {
+	c.lock.Lock()
+	c.wires = append(c.wires, def)
+	c.lock.Unlock()
+	w := c.gadgetOf(def.To).getInput(pinPart(def.To), def.Capacity)
+	c.gadgetOf(def.From).setOutput(pinPart(def.From), w, def.Copy || c.copies())
+}
+
+// Make all wires connected from now on deliver deep copies, as with
+// ConnectCopy. This also applies to wires connected inside the gadgets and
+// circuits in this circuit once they run, i.e. by dispatchers. Since gadgets
+// such as FanOut send the same message to several places, this prevents
+// changes made in one branch from showing up in the others.
+func (c *Circuit) CopyMessages(on bool) {
+	c.lock.Lock()
+	c.copying = on
+	c.lock.Unlock()
+}
+
+// True if copying is on for this circuit, or any circuit it is part of.
+func (c *Circuit) copies() bool {
+	c.lock.Lock()
+	on := c.copying
+	c.lock.Unlock()
+	return on || c.owner != nil && c.owner.copies()
 }
 
 // Set up a message to feed to a gadget on startup.
@@ -91,10 +142,12 @@ func (c *Circuit) Label(external, internal string) {
 }
 
 var initProviders sync.Once
-// Start up the circuit, and return when it is finished.
-func (c *Circuit) Run() {
+var apiOptions = api.NewFlowAPIOptions()
 
-	fopts := api.NewFlowAPIOptions()
+// Start up the circuit, and return when it is finished. For a top-level
+// circuit, this is also where API providers are started and closed again,
+// and it returns early when the circuit gets cancelled.
+func (c *Circuit) Run() {
 
 	initProviders.Do( func() {
 		for k, c := range Registry {
@@ -109,7 +162,7 @@ func (c *Circuit) Run() {
 				if k[0] != strings.ToLower(string(k[0]))[0] {
 					g := c()
 					_ = g
-					if err := api.IsAPIProvider(g, fopts); err != nil {
+					if err := api.IsAPIProvider(g, apiOptions); err != nil {
 						glog.Fatalln(err)
 					}
 				} else {
@@ -119,22 +172,140 @@ func (c *Circuit) Run() {
 		}
 	})
 
+	top := c.owner == nil
+	if top {
+		api.StartSession()
+		defer func() {
+			if err := api.EndSession(); err != nil {
+				glog.Errorln(err)
+			}
+		}()
+	}
+
+	// set up all gadgets before starting any, so that nothing gets sent to
+	// a gadget which is not ready yet
+	c.lock.Lock()
+	gadgets := make([]*Gadget, 0, len(c.gadgets))
 	for _, g := range c.gadgets {
-		if err := api.InjectAPI(g.circuitry, fopts);err != nil {
-			glog.Fatalln(err)
+		gadgets = append(gadgets, g)
+	}
+	c.lock.Unlock()
+	ready := gadgets[:0]
+	for _, g := range gadgets {
+		if g.prepare() { // also injects the APIs it needs
+			ready = append(ready, g)
+		}
+	}
+	for _, g := range ready {
+		g.start()
+	}
+
+	if top {
+		c.waitOrCancel()
+	} else {
+		c.wait.Wait()
+	}
+}
+
+// Wait for all gadgets to finish, while checking the health of the providers.
+// After a cancellation, this still waits for the gadgets to stop, so that the
+// providers are not closed while they are in use.
+func (c *Circuit) waitOrCancel() {
+	finished := make(chan struct{})
+	go func() {
+		c.wait.Wait()
+		close(finished)
+	}()
+
+	interval, err := time.ParseDuration(Config["HEALTH_INTERVAL"])
+	if err != nil || interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-finished:
+			return
+		case <-c.done:
+			glog.Errorln("circuit cancelled:", c.err)
+			<-finished
+			return
+		case <-ticker.C:
+			if err := api.CheckHealth(); err != nil {
+				c.Cancel(err)
+			}
+		}
+	}
+}
+
+// Cancel the circuit this belongs to, Run will then return as soon as all
+// gadgets have stopped, which long-running gadgets do by watching Done.
+// Only the first cancellation has any effect.
+func (c *Circuit) Cancel(err error) {
+	if c.owner != nil {
+		c.owner.Cancel(err)
+		return
+	}
+	c.cancel.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
+
+// Done returns a channel which gets closed when the circuit is cancelled.
+// Long-running gadgets can use this to stop early.
+func (c *Circuit) Done() <-chan struct{} {
+	if c.owner != nil {
+		return c.owner.Done()
+	}
+	return c.done
+}
+
+// Err returns the reason why the circuit was cancelled, or nil.
+func (c *Circuit) Err() error {
+	if c.owner != nil {
+		return c.owner.Err()
+	}
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Remove a gadget from the circuit, along with its wires. This does not stop
+// the gadget, it is up to the caller to disconnect its inputs.
+func (c *Circuit) remove(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.gadgets, name)
+	for i, d := range c.gnames {
+		if d.Name == name {
+			c.gnames = append(c.gnames[:i], c.gnames[i+1:]...)
+			break
+		}
+	}
+	wires := c.wires[:0]
+	for _, w := range c.wires {
+		if gadgetPart(w.From) != name && gadgetPart(w.To) != name {
+			wires = append(wires, w)
 		}
-		g.launch()
 	}
-	c.wait.Wait()
+	c.wires = wires
 }
 
 // Start up one gadget in the circuit, useful after dynamically ading a gadget
 func (c *Circuit) RunGadget(name string) {
-        c.gadgets[name].launch()
+	c.gadgetOf(name + ".").launch()
 }
 
 // Return a description of this circuit in serialisable form.
 func (c *Circuit) Describe() interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	desc := map[string]interface{}{}
 	if len(c.gnames) > 0 {
 		desc["gadgets"] = c.gnames
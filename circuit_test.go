@@ -0,0 +1,182 @@
+package flow_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/api"
+)
+
+// settings provider which logs its lifecycle, and can be made unhealthy
+type testSettings struct {
+	sync.Mutex
+	log       []string
+	unhealthy bool
+}
+
+func (s *testSettings) record(what string) {
+	s.Lock()
+	s.log = append(s.log, what)
+	s.Unlock()
+}
+
+func (s *testSettings) InitAPI(args ...interface{})             {}
+func (s *testSettings) Keys(prefix string) ([]string, error)    { return nil, nil }
+func (s *testSettings) Get(key string) (interface{}, error)     { return nil, nil }
+func (s *testSettings) Put(key string, value interface{}) error { return nil }
+
+func (s *testSettings) Start() error {
+	s.record("start")
+	return nil
+}
+
+func (s *testSettings) Close() error {
+	s.record("close")
+	return nil
+}
+
+func (s *testSettings) Health() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.unhealthy {
+		return errors.New("out of order")
+	}
+	return nil
+}
+
+var settings = new(testSettings)
+
+type settingsProvider struct {
+	flow.Gadget
+	Settings api.ISettingsAPI `flowapi:"SettingsAPI"`
+}
+
+func (g *settingsProvider) Run() {}
+
+type settingsUser struct {
+	flow.Gadget
+	Settings api.ISettingsAPI `gadget:"SettingsAPI"`
+	Wait     bool
+}
+
+func (g *settingsUser) Run() {
+	settings.record("run")
+	if g.Wait {
+		<-g.Done()
+		settings.record("cancelled")
+	}
+}
+
+func init() {
+	flow.Registry["TestSettingsProvider"] = func() flow.Circuitry {
+		return &settingsProvider{Settings: settings}
+	}
+}
+
+func TestProviderLifecycle(t *testing.T) {
+	settings.log = nil
+
+	g := flow.NewCircuit()
+	g.AddCircuitry("a", new(settingsUser))
+	g.AddCircuitry("b", new(settingsUser))
+	g.Run()
+
+	expected := []string{"start", "run", "run", "close"}
+	if len(settings.log) != len(expected) {
+		t.Fatalf("unexpected lifecycle: %v", settings.log)
+	}
+	for i, s := range expected {
+		if settings.log[i] != s {
+			t.Fatalf("unexpected lifecycle: %v", settings.log)
+		}
+	}
+}
+
+func TestUnhealthyProvider(t *testing.T) {
+	settings.log = nil
+	settings.unhealthy = true
+	flow.Config["HEALTH_INTERVAL"] = "10ms"
+	defer func() {
+		settings.unhealthy = false
+		delete(flow.Config, "HEALTH_INTERVAL")
+	}()
+
+	g := flow.NewCircuit()
+	g.AddCircuitry("u", &settingsUser{Wait: true})
+	g.Run()
+
+	if g.Err() == nil {
+		t.Error("expected the circuit to be cancelled")
+	}
+	// the provider is only closed once its consumer has stopped
+	n := len(settings.log)
+	if n < 2 || settings.log[n-2] != "cancelled" || settings.log[n-1] != "close" {
+		t.Errorf("unexpected lifecycle: %v", settings.log)
+	}
+}
+
+// settings handed out as a new instance to each consumer, counting closes
+type freshSettings struct {
+	testSettings
+}
+
+var freshClosed = make(chan bool, 10)
+
+func (s *freshSettings) Close() error {
+	freshClosed <- true
+	return nil
+}
+
+type freshProvider struct {
+	flow.Gadget
+	Settings api.ISettingsAPI `flowapi:"SettingsAPI,new,name=fresh"`
+}
+
+func (g *freshProvider) Run() {}
+
+type freshUser struct {
+	flow.Gadget
+	Settings api.ISettingsAPI `gadget:"SettingsAPI,name=fresh"`
+}
+
+func (g *freshUser) Run() {}
+
+// waits for a new instance to be closed while the circuit is still running
+type closeWaiter struct {
+	flow.Gadget
+	closed bool
+}
+
+func (g *closeWaiter) Run() {
+	select {
+	case g.closed = <-freshClosed:
+	case <-time.After(time.Second):
+	}
+}
+
+func init() {
+	flow.Registry["TestFreshProvider"] = func() flow.Circuitry {
+		return &freshProvider{Settings: new(freshSettings)}
+	}
+}
+
+func TestReleaseNewInstance(t *testing.T) {
+	u, w := new(freshUser), new(closeWaiter)
+	g := flow.NewCircuit()
+	g.AddCircuitry("u", u)
+	g.AddCircuitry("w", w)
+	g.Run()
+
+	if !w.closed {
+		t.Error("expected the instance to be closed once its consumer finished")
+	}
+	if len(freshClosed) != 0 {
+		t.Errorf("instance closed again at the end of the session")
+	}
+	if u.Settings != nil {
+		t.Errorf("expected the released instance to be cleared, got %v", u.Settings)
+	}
+}
@@ -0,0 +1,333 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/laughlinez/flow"
+)
+
+// The CBOR codec follows RFC 7049. Times are written as tag 0 (an RFC 3339
+// string), and a flow.Tag as tag 27 with ["flow.Tag", tag, msg] in it. Floats
+// are always written in 64 bits, but all sizes are decoded, as are indefinite
+// lengths, epoch times (tag 1), and undefined (as nil). Other tags are ignored,
+// only the value inside is decoded.
+type cborCodec struct{}
+
+const (
+	cborUint = iota << 5
+	cborNegInt
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+const cborObjectTag = 27 // serialised object with type name and arguments
+
+func (cborCodec) Encode(m flow.Message) ([]byte, error) {
+	v, err := normalize(m)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := encodeCBOR(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// write the initial byte(s) of an item, with its argument in the shortest form
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func encodeCBOR(buf *bytes.Buffer, v interface{}) error {
+	switch x := v.(type) {
+	case nil:
+		buf.WriteByte(cborSimple | 22)
+	case bool:
+		if x {
+			buf.WriteByte(cborSimple | 21)
+		} else {
+			buf.WriteByte(cborSimple | 20)
+		}
+	case int64:
+		if x < 0 {
+			cborHead(buf, cborNegInt, uint64(-1-x))
+		} else {
+			cborHead(buf, cborUint, uint64(x))
+		}
+	case uint64:
+		cborHead(buf, cborUint, x)
+	case float64:
+		buf.WriteByte(cborSimple | 27)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(x))
+	case string:
+		cborHead(buf, cborText, uint64(len(x)))
+		buf.WriteString(x)
+	case []byte:
+		cborHead(buf, cborBytes, uint64(len(x)))
+		buf.Write(x)
+	case time.Time:
+		cborHead(buf, cborTag, 0)
+		return encodeCBOR(buf, x.Format(time.RFC3339Nano))
+	case flow.Tag:
+		cborHead(buf, cborTag, cborObjectTag)
+		return encodeCBOR(buf, []interface{}{"flow.Tag", x.Tag, x.Msg})
+	case []interface{}:
+		cborHead(buf, cborArray, uint64(len(x)))
+		for _, e := range x {
+			if err := encodeCBOR(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		cborHead(buf, cborMap, uint64(len(x)))
+		for _, k := range sortedKeys(x) {
+			encodeCBOR(buf, k)
+			if err := encodeCBOR(buf, x[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("codec: cannot encode %T as CBOR", v)
+	}
+	return nil
+}
+
+func (cborCodec) Decode(data []byte) (flow.Message, error) {
+	d := &decoder{data: data, format: "CBOR"}
+	v, err := d.cbor()
+	if err == errBreak {
+		err = d.errorf("unexpected break")
+	}
+	if err == nil && d.pos < len(d.data) {
+		err = d.errorf("%d bytes of trailing data", len(d.data)-d.pos)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return toMessage(v), nil
+}
+
+// A decoder reads items from a byte slice, it is shared with MessagePack.
+type decoder struct {
+	data   []byte
+	pos    int
+	format string
+}
+
+var errBreak = fmt.Errorf("break") // end of an indefinite-length item
+
+func (d *decoder) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("codec: bad %s at %d: %s", d.format, d.pos, fmt.Sprintf(format, args...))
+}
+
+func (d *decoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, d.errorf("unexpected end")
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *decoder) uint(size int) (uint64, error) {
+	b, err := d.bytes(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+func (d *decoder) cbor() (interface{}, error) {
+	b, err := d.bytes(1)
+	if err != nil {
+		return nil, err
+	}
+	major, info := b[0]&0xe0, b[0]&0x1f
+
+	// the argument, for all but a few of the simple values
+	var n uint64
+	indefinite := false
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		if n, err = d.uint(1 << (info - 24)); err != nil {
+			return nil, err
+		}
+	case info == 31 && major >= cborBytes && major != cborTag:
+		indefinite = true
+	default:
+		return nil, d.errorf("reserved value %d", info)
+	}
+
+	switch major {
+	case cborUint:
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return intOf(int64(n)), nil
+	case cborNegInt:
+		if n > math.MaxInt64 {
+			return nil, d.errorf("negative integer out of range")
+		}
+		return intOf(-1 - int64(n)), nil
+	case cborBytes, cborText:
+		var s []byte
+		if indefinite {
+			for {
+				chunk, err := d.cbor()
+				if err == errBreak {
+					break
+				}
+				if err != nil {
+					return nil, err
+				}
+				switch c := chunk.(type) {
+				case []byte:
+					s = append(s, c...)
+				case string:
+					s = append(s, c...)
+				default:
+					return nil, d.errorf("bad chunk in string")
+				}
+			}
+		} else if s, err = d.bytes(n); err != nil {
+			return nil, err
+		}
+		if major == cborText {
+			return string(s), nil
+		}
+		return append([]byte{}, s...), nil
+	case cborArray:
+		list := []interface{}{}
+		for i := uint64(0); indefinite || i < n; i++ {
+			e, err := d.cbor()
+			if err == errBreak && indefinite {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, e)
+		}
+		return list, nil
+	case cborMap:
+		m := map[string]interface{}{}
+		for i := uint64(0); indefinite || i < n; i++ {
+			k, err := d.cbor()
+			if err == errBreak && indefinite {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, d.errorf("map key is not a string: %T", k)
+			}
+			if m[key], err = d.cbor(); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case cborTag:
+		v, err := d.cbor()
+		if err != nil {
+			return nil, err
+		}
+		return d.cborTagged(n, v)
+	}
+
+	// major type 7: simple values and floats
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		return halfFloat(uint16(n)), nil
+	case 26:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 27:
+		return math.Float64frombits(n), nil
+	case 31:
+		return nil, errBreak
+	}
+	return nil, d.errorf("unknown simple value %d", n)
+}
+
+func (d *decoder) cborTagged(tag uint64, v interface{}) (interface{}, error) {
+	switch tag {
+	case 0:
+		if s, ok := v.(string); ok {
+			return time.Parse(time.RFC3339Nano, s)
+		}
+	case 1:
+		if f, err := (flow.PacketMap{"": v}).GetFloat64(""); err == nil {
+			sec, frac := math.Modf(f)
+			return time.Unix(int64(sec), int64(frac*1e9)), nil
+		}
+	case cborObjectTag:
+		if a, ok := v.([]interface{}); ok && len(a) == 3 && a[0] == "flow.Tag" {
+			if tag, ok := a[1].(string); ok {
+				return flow.Tag{tag, a[2]}, nil
+			}
+		}
+		return nil, d.errorf("unknown object %v", v)
+	default:
+		return v, nil
+	}
+	return nil, d.errorf("bad value for tag %d: %T", tag, v)
+}
+
+// Convert an IEEE 754 half-precision float.
+func halfFloat(h uint16) float64 {
+	exp, mant := int(h>>10)&0x1f, float64(h&0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
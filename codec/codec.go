@@ -0,0 +1,261 @@
+// Encoding of messages, to exchange them with other tools, or store them.
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/laughlinez/flow"
+)
+
+func init() {
+	flow.Registry["Encode"] = func() flow.Circuitry { return new(Encode) }
+	flow.Registry["Decode"] = func() flow.Circuitry { return new(Decode) }
+
+	Register("json", jsonCodec{})
+	Register("cbor", cborCodec{})
+	Register("msgpack", msgpackCodec{})
+}
+
+// A Codec converts messages to bytes and back. All codecs preserve flow.Tag,
+// PacketMap, time.Time, and []byte values, as well as nil, bools, strings,
+// ints, floats, slices, and maps with string keys. Other types are converted
+// as if they went through encoding/json first.
+//
+// Maps decode as PacketMaps when they are a message, or the message in a Tag,
+// and as map[string]interface{} when nested inside other values. Slices
+// decode as []interface{}. Integers decode as int when they fit, floats as
+// float64.
+type Codec interface {
+	Encode(m flow.Message) ([]byte, error)
+	Decode(data []byte) (flow.Message, error)
+}
+
+var codecs = struct {
+	sync.RWMutex
+	m map[string]Codec
+}{m: map[string]Codec{}}
+
+// Register a codec under a format name, replacing any previous one.
+func Register(format string, c Codec) {
+	codecs.Lock()
+	codecs.m[format] = c
+	codecs.Unlock()
+}
+
+// Look up the codec for a format.
+func Lookup(format string) (Codec, error) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	if c, ok := codecs.m[format]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("codec: unknown format %q", format)
+}
+
+// Return the names of all registered formats, sorted.
+func Formats() []string {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	list := []string{}
+	for k := range codecs.m {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Convert a value of an unsupported type to what encoding/json would decode
+// it as, so that structs and such can still be encoded.
+func generic(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("codec: cannot encode %T: %v", v, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // keeps ints apart from floats
+	var r interface{}
+	err = dec.Decode(&r)
+	return r, err
+}
+
+// Turn decoded maps at message level into PacketMaps.
+func toMessage(v interface{}) flow.Message {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		return flow.PacketMap(x)
+	case flow.Tag:
+		x.Msg = toMessage(x.Msg)
+		return x
+	}
+	return v
+}
+
+// An integer which fits in an int is returned as such.
+func intOf(n int64) interface{} {
+	if int64(int(n)) == n {
+		return int(n)
+	}
+	return n
+}
+
+// Encode messages to the format on the Format pin, "json" by default, sending
+// out a []byte for each one. Registers as "Encode".
+type Encode struct {
+	flow.Gadget
+	Format flow.Input
+	In     flow.Input
+	Out    flow.Output
+	Err    flow.Output
+}
+
+// Start encoding.
+func (g *Encode) Run() {
+	c, err := codecOf(g.Format)
+	if err != nil {
+		g.Err.Send(g.Error(err, nil))
+		return
+	}
+	for m := range g.In {
+		data, err := c.Encode(m)
+		if err != nil {
+			g.Err.Send(g.Error(err, m))
+			continue
+		}
+		g.Out.Send(data)
+	}
+}
+
+// Decode messages in the format on the Format pin, "json" by default, from
+// each incoming []byte or string. Registers as "Decode".
+type Decode struct {
+	flow.Gadget
+	Format flow.Input
+	In     flow.Input
+	Out    flow.Output
+	Err    flow.Output
+}
+
+// Start decoding.
+func (g *Decode) Run() {
+	c, err := codecOf(g.Format)
+	if err != nil {
+		g.Err.Send(g.Error(err, nil))
+		return
+	}
+	for m := range g.In {
+		var data []byte
+		switch v := m.(type) {
+		case []byte:
+			data = v
+		case string:
+			data = []byte(v)
+		default:
+			g.Err.Send(g.Error(fmt.Errorf("codec: cannot decode %T", m), m))
+			continue
+		}
+		msg, err := c.Decode(data)
+		if err != nil {
+			g.Err.Send(g.Error(err, m))
+			continue
+		}
+		g.Out.Send(msg)
+	}
+}
+
+func codecOf(pin flow.Input) (Codec, error) {
+	format := "json"
+	if m, ok := <-pin; ok {
+		format, _ = m.(string)
+	}
+	return Lookup(format)
+}
+
+// Convert a value to one of the types the encoders deal with: nil, bool,
+// int64, uint64, float64, string, []byte, time.Time, flow.Tag, []interface{},
+// and map[string]interface{}, all of these also for nested values.
+func normalize(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case nil, bool, int64, uint64, float64, string, []byte, time.Time:
+		return x, nil
+	case json.Number:
+		if n, err := x.Int64(); err == nil {
+			return n, nil
+		}
+		return x.Float64()
+	case flow.Tag:
+		msg, err := normalize(x.Msg)
+		return flow.Tag{x.Tag, msg}, err
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil, nil
+		}
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil, nil
+		}
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(b), rv)
+			return b, nil
+		}
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			var err error
+			if list[i], err = normalize(rv.Index(i).Interface()); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if rv.IsNil() {
+			return nil, nil
+		}
+		m := make(map[string]interface{}, rv.Len())
+		for _, k := range rv.MapKeys() {
+			var err error
+			if m[k.String()], err = normalize(rv.MapIndex(k).Interface()); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+
+	g, err := generic(v)
+	if err != nil {
+		return nil, err
+	}
+	return normalize(g)
+}
+
+// The keys of a map, sorted, so that encodings are deterministic.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,136 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/flowtest"
+)
+
+var when = time.Date(2014, 5, 6, 7, 8, 9, 123456789, time.UTC)
+
+// messages which survive a round trip unchanged
+var roundTrips = []flow.Message{
+	nil, true, false, 0, 1, -1, 23, 24, 255, 256, -33, 65536, 1 << 40, -1 << 40,
+	uint64(math.MaxUint64), 1.5, -0.25, 1e100, 2.0, "", "abc", "héllo",
+	string(bytes.Repeat([]byte("x"), 300)), []byte{}, []byte{1, 2, 3},
+	[]interface{}{1, "a", nil, []interface{}{}},
+	flow.PacketMap{}, flow.PacketMap{"a": 1, "b": map[string]interface{}{"c": []byte{9}}},
+	flow.Tag{"<open>", "file.txt"}, flow.Tag{"<tag>", flow.PacketMap{"x": 1.5}},
+	flow.Tag{"<close>", nil},
+}
+
+func TestRoundTrips(t *testing.T) {
+	for _, format := range Formats() {
+		c, _ := Lookup(format)
+		for _, m := range roundTrips {
+			data, err := c.Encode(m)
+			if err != nil {
+				t.Errorf("%s: cannot encode %#v: %v", format, m, err)
+				continue
+			}
+			r, err := c.Decode(data)
+			if err != nil {
+				t.Errorf("%s: cannot decode %#v: %v", format, m, err)
+				continue
+			}
+			if !reflect.DeepEqual(r, m) {
+				t.Errorf("%s: got %#v, want %#v", format, r, m)
+			}
+		}
+	}
+}
+
+func TestConversions(t *testing.T) {
+	type point struct{ X, Y int }
+	for _, format := range Formats() {
+		c, _ := Lookup(format)
+
+		data, _ := c.Encode(when)
+		if r, err := c.Decode(data); err != nil || !when.Equal(r.(time.Time)) {
+			t.Errorf("%s: time got %v (%v)", format, r, err)
+		}
+
+		data, _ = c.Encode(map[string]interface{}{"p": point{1, 2}, "i": int8(-3),
+			"s": []string{"a"}, "f": float32(0.5), "d": time.Second})
+		r, err := c.Decode(data)
+		want := flow.PacketMap{"p": map[string]interface{}{"X": 1, "Y": 2}, "i": -3,
+			"s": []interface{}{"a"}, "f": 0.5, "d": int(time.Second)}
+		if err != nil || !reflect.DeepEqual(r, want) {
+			t.Errorf("%s: got %#v (%v)", format, r, err)
+		}
+
+		if _, err := c.Encode(make(chan int)); err == nil {
+			t.Errorf("%s: expected an error for a channel", format)
+		}
+		if _, err := c.Decode([]byte{}); err == nil {
+			t.Errorf("%s: expected an error for no data", format)
+		}
+	}
+}
+
+// check against encodings produced by other implementations
+func TestKnownEncodings(t *testing.T) {
+	tests := []struct {
+		format, hex string
+		msg         flow.Message
+	}{
+		{"json", hex.EncodeToString([]byte(`{"$tag":"<a>","$msg":{"$bytes":"AQI="}}`)),
+			flow.Tag{"<a>", []byte{1, 2}}},
+		{"json", hex.EncodeToString([]byte(`{"a":[1,2.5,"x",true,null]}`)),
+			flow.PacketMap{"a": []interface{}{1, 2.5, "x", true, nil}}},
+		{"cbor", "a26161016162820203", flow.PacketMap{"a": 1, "b": []interface{}{2, 3}}},
+		{"cbor", "3903e7", -1000},
+		{"cbor", "f93c00", 1.0},
+		{"cbor", "fa47c35000", 100000.0},
+		{"cbor", "5f42010243030405ff", []byte{1, 2, 3, 4, 5}},
+		{"cbor", "bf61610161629f0203ffff", flow.PacketMap{"a": 1, "b": []interface{}{2, 3}}},
+		{"cbor", "c11a514b67b0", time.Unix(1363896240, 0)},
+		{"msgpack", "82a16101a16292cd01f4d0e0",
+			flow.PacketMap{"a": 1, "b": []interface{}{500, -32}}},
+		{"msgpack", "ca3fc00000", 1.5},
+		{"msgpack", "c403010203", []byte{1, 2, 3}},
+		{"msgpack", "d6ff514b67b0", time.Unix(1363896240, 0)},
+	}
+	for _, test := range tests {
+		c, _ := Lookup(test.format)
+		data, _ := hex.DecodeString(test.hex)
+		r, err := c.Decode(data)
+		if err != nil {
+			t.Errorf("%s %s: %v", test.format, test.hex, err)
+			continue
+		}
+		if tm, ok := test.msg.(time.Time); ok {
+			if !tm.Equal(r.(time.Time)) {
+				t.Errorf("%s %s: got %v", test.format, test.hex, r)
+			}
+		} else if !reflect.DeepEqual(r, test.msg) {
+			t.Errorf("%s %s: got %#v, want %#v", test.format, test.hex, r, test.msg)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	out := new(flowtest.Collector)
+	g := flow.NewCircuit()
+	g.Add("e", "Encode")
+	g.Add("d", "Decode")
+	g.AddCircuitry("out", out)
+	g.Connect("e.Out", "d.In", 0)
+	g.Connect("d.Out", "out.In", 0)
+	g.Feed("e.Format", "msgpack")
+	g.Feed("d.Format", "msgpack")
+	g.Feed("e.In", flow.Tag{"<open>", "x"})
+	g.Feed("e.In", flow.PacketMap{"t": when})
+	g.Run()
+
+	if len(out.Msgs) != 2 || out.Msgs[0] != (flow.Tag{"<open>", "x"}) ||
+		!out.Msgs[1].(flow.PacketMap)["t"].(time.Time).Equal(when) {
+		t.Errorf("unexpected output: %v", out.Msgs)
+	}
+}
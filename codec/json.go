@@ -0,0 +1,155 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/laughlinez/flow"
+)
+
+// The JSON codec produces plain JSON, with objects for the types which have
+// no JSON equivalent:
+//
+//	flow.Tag   {"$tag": "<open>", "$msg": ...}
+//	time.Time  {"$time": "2014-05-06T07:08:09.123Z"}, in RFC 3339 format
+//	[]byte     {"$bytes": "AQID"}, in standard base64
+//
+// Floats are always written with a decimal point or exponent, and numbers
+// without one decode as ints. NaN and infinite floats can't be encoded.
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(m flow.Message) ([]byte, error) {
+	v, err := normalize(m)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := encodeJSON(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeJSON(buf *bytes.Buffer, v interface{}) error {
+	switch x := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(x))
+	case int64:
+		buf.WriteString(strconv.FormatInt(x, 10))
+	case uint64:
+		buf.WriteString(strconv.FormatUint(x, 10))
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return fmt.Errorf("codec: cannot encode %v as JSON", x)
+		}
+		s := strconv.FormatFloat(x, 'g', -1, 64)
+		if !bytes.ContainsAny([]byte(s), ".e") {
+			s += ".0" // so that it decodes as a float again
+		}
+		buf.WriteString(s)
+	case string:
+		data, _ := json.Marshal(x)
+		buf.Write(data)
+	case []byte:
+		fmt.Fprintf(buf, `{"$bytes":"%s"}`, base64.StdEncoding.EncodeToString(x))
+	case time.Time:
+		fmt.Fprintf(buf, `{"$time":"%s"}`, x.Format(time.RFC3339Nano))
+	case flow.Tag:
+		tag, _ := json.Marshal(x.Tag)
+		fmt.Fprintf(buf, `{"$tag":%s,"$msg":`, tag)
+		if err := encodeJSON(buf, x.Msg); err != nil {
+			return err
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range x {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeJSON(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		buf.WriteByte('{')
+		for i, k := range sortedKeys(x) {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(k)
+			buf.Write(key)
+			buf.WriteByte(':')
+			if err := encodeJSON(buf, x[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("codec: cannot encode %T as JSON", v)
+	}
+	return nil
+}
+
+func (jsonCodec) Decode(data []byte) (flow.Message, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("codec: %v", err)
+	}
+	v, err := fromJSON(v)
+	if err != nil {
+		return nil, err
+	}
+	return toMessage(v), nil
+}
+
+// Convert numbers, and the special objects back to their Go types.
+func fromJSON(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case json.Number:
+		if n, err := strconv.ParseInt(string(x), 10, 64); err == nil {
+			return intOf(n), nil
+		}
+		if n, err := strconv.ParseUint(string(x), 10, 64); err == nil {
+			return n, nil
+		}
+		return x.Float64()
+	case []interface{}:
+		for i, e := range x {
+			var err error
+			if x[i], err = fromJSON(e); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		if s, ok := x["$bytes"].(string); ok && len(x) == 1 {
+			return base64.StdEncoding.DecodeString(s)
+		}
+		if s, ok := x["$time"].(string); ok && len(x) == 1 {
+			return time.Parse(time.RFC3339Nano, s)
+		}
+		if tag, ok := x["$tag"].(string); ok && len(x) == 2 {
+			if msg, ok := x["$msg"]; ok {
+				msg, err := fromJSON(msg)
+				return flow.Tag{tag, msg}, err
+			}
+		}
+		for k, e := range x {
+			var err error
+			if x[k], err = fromJSON(e); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
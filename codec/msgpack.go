@@ -0,0 +1,300 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/laughlinez/flow"
+)
+
+// The MessagePack codec uses the standard timestamp extension (type -1) for
+// times, and extension type 84 ('T') for a flow.Tag, containing the encoded
+// array [tag, msg]. Strings and byte slices use the str and bin families.
+// Floats are always written in 64 bits, but all sizes are decoded. Other
+// extension types are decoded as their raw []byte contents.
+type msgpackCodec struct{}
+
+const (
+	msgpackTimeExt = -1
+	msgpackTagExt  = 'T'
+)
+
+func (msgpackCodec) Encode(m flow.Message) ([]byte, error) {
+	v, err := normalize(m)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := encodeMsgpack(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// write a length for one of the str, bin, array, or map families, fix is the
+// code for the small form (0 if there is none), codes has the 8/16/32-bit ones
+func msgpackLen(buf *bytes.Buffer, n int, fix byte, max int, codes [3]byte) {
+	switch {
+	case fix != 0 && n <= max:
+		buf.WriteByte(fix | byte(n))
+	case codes[0] != 0 && n <= math.MaxUint8:
+		buf.WriteByte(codes[0])
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(codes[1])
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(codes[2])
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func encodeMsgpack(buf *bytes.Buffer, v interface{}) error {
+	switch x := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if x {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case int64:
+		switch {
+		case x >= 0:
+			return encodeMsgpack(buf, uint64(x))
+		case x >= -32:
+			buf.WriteByte(byte(x))
+		case x >= math.MinInt8:
+			buf.WriteByte(0xd0)
+			buf.WriteByte(byte(x))
+		case x >= math.MinInt16:
+			buf.WriteByte(0xd1)
+			binary.Write(buf, binary.BigEndian, int16(x))
+		case x >= math.MinInt32:
+			buf.WriteByte(0xd2)
+			binary.Write(buf, binary.BigEndian, int32(x))
+		default:
+			buf.WriteByte(0xd3)
+			binary.Write(buf, binary.BigEndian, x)
+		}
+	case uint64:
+		switch {
+		case x < 128:
+			buf.WriteByte(byte(x))
+		case x <= math.MaxUint8:
+			buf.WriteByte(0xcc)
+			buf.WriteByte(byte(x))
+		case x <= math.MaxUint16:
+			buf.WriteByte(0xcd)
+			binary.Write(buf, binary.BigEndian, uint16(x))
+		case x <= math.MaxUint32:
+			buf.WriteByte(0xce)
+			binary.Write(buf, binary.BigEndian, uint32(x))
+		default:
+			buf.WriteByte(0xcf)
+			binary.Write(buf, binary.BigEndian, x)
+		}
+	case float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(x))
+	case string:
+		msgpackLen(buf, len(x), 0xa0, 31, [3]byte{0xd9, 0xda, 0xdb})
+		buf.WriteString(x)
+	case []byte:
+		msgpackLen(buf, len(x), 0, 0, [3]byte{0xc4, 0xc5, 0xc6})
+		buf.Write(x)
+	case time.Time:
+		// always the 96-bit form, which covers all times
+		buf.Write([]byte{0xc7, 12, byte(msgpackTimeExt & 0xff)})
+		binary.Write(buf, binary.BigEndian, uint32(x.Nanosecond()))
+		binary.Write(buf, binary.BigEndian, x.Unix())
+	case flow.Tag:
+		var inner bytes.Buffer
+		if err := encodeMsgpack(&inner, []interface{}{x.Tag, x.Msg}); err != nil {
+			return err
+		}
+		msgpackLen(buf, inner.Len(), 0, 0, [3]byte{0xc7, 0xc8, 0xc9})
+		buf.WriteByte(msgpackTagExt)
+		buf.Write(inner.Bytes())
+	case []interface{}:
+		msgpackLen(buf, len(x), 0x90, 15, [3]byte{0, 0xdc, 0xdd})
+		for _, e := range x {
+			if err := encodeMsgpack(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		msgpackLen(buf, len(x), 0x80, 15, [3]byte{0, 0xde, 0xdf})
+		for _, k := range sortedKeys(x) {
+			encodeMsgpack(buf, k)
+			if err := encodeMsgpack(buf, x[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("codec: cannot encode %T as MessagePack", v)
+	}
+	return nil
+}
+
+func (msgpackCodec) Decode(data []byte) (flow.Message, error) {
+	d := &decoder{data: data, format: "MessagePack"}
+	v, err := d.msgpack()
+	if err == nil && d.pos < len(d.data) {
+		err = d.errorf("%d bytes of trailing data", len(d.data)-d.pos)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return toMessage(v), nil
+}
+
+// the size of the length or value which follows these codes
+var msgpackSizes = map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4, 0xc7: 1, 0xc8: 2,
+	0xc9: 4, 0xca: 4, 0xcb: 8, 0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8, 0xd0: 1,
+	0xd1: 2, 0xd2: 4, 0xd3: 8, 0xd9: 1, 0xda: 2, 0xdb: 4, 0xdc: 2, 0xdd: 4,
+	0xde: 2, 0xdf: 4}
+
+func (d *decoder) msgpack() (interface{}, error) {
+	b, err := d.bytes(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+
+	switch {
+	case c < 0x80:
+		return int(c), nil
+	case c >= 0xe0:
+		return int(int8(c)), nil
+	case c < 0x90:
+		return d.msgpackMap(uint64(c & 0x0f))
+	case c < 0xa0:
+		return d.msgpackArray(uint64(c & 0x0f))
+	case c < 0xc0:
+		s, err := d.bytes(uint64(c & 0x1f))
+		return string(s), err
+	}
+
+	var n uint64
+	if size, ok := msgpackSizes[c]; ok {
+		if n, err = d.uint(size); err != nil {
+			return nil, err
+		}
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		s, err := d.bytes(n)
+		return append([]byte{}, s...), err
+	case 0xc7, 0xc8, 0xc9:
+		return d.msgpackExt(n)
+	case 0xca:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 0xcb:
+		return math.Float64frombits(n), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return intOf(int64(n)), nil
+	case 0xd0:
+		return int(int8(n)), nil
+	case 0xd1:
+		return int(int16(n)), nil
+	case 0xd2:
+		return int(int32(n)), nil
+	case 0xd3:
+		return intOf(int64(n)), nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.msgpackExt(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		s, err := d.bytes(n)
+		return string(s), err
+	case 0xdc, 0xdd:
+		return d.msgpackArray(n)
+	case 0xde, 0xdf:
+		return d.msgpackMap(n)
+	}
+	return nil, d.errorf("unknown code 0x%02x", c)
+}
+
+func (d *decoder) msgpackArray(n uint64) (interface{}, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, d.errorf("array too long")
+	}
+	list := make([]interface{}, n)
+	for i := range list {
+		var err error
+		if list[i], err = d.msgpack(); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func (d *decoder) msgpackMap(n uint64) (interface{}, error) {
+	m := map[string]interface{}{}
+	for i := uint64(0); i < n; i++ {
+		k, err := d.msgpack()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, d.errorf("map key is not a string: %T", k)
+		}
+		if m[key], err = d.msgpack(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// decode an extension type with n bytes of data
+func (d *decoder) msgpackExt(n uint64) (interface{}, error) {
+	t, err := d.bytes(1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.bytes(n)
+	if err != nil {
+		return nil, err
+	}
+
+	switch int8(t[0]) {
+	case msgpackTimeExt:
+		switch len(data) {
+		case 4:
+			return time.Unix(int64(binary.BigEndian.Uint32(data)), 0), nil
+		case 8:
+			v := binary.BigEndian.Uint64(data)
+			return time.Unix(int64(v&(1<<34-1)), int64(v>>34)), nil
+		case 12:
+			nsec := binary.BigEndian.Uint32(data)
+			sec := int64(binary.BigEndian.Uint64(data[4:]))
+			return time.Unix(sec, int64(nsec)), nil
+		}
+		return nil, d.errorf("bad timestamp length %d", len(data))
+	case msgpackTagExt:
+		inner := &decoder{data: data, format: d.format}
+		v, err := inner.msgpack()
+		if a, ok := v.([]interface{}); err == nil && ok && len(a) == 2 {
+			if tag, ok := a[0].(string); ok {
+				return flow.Tag{tag, a[1]}, nil
+			}
+		}
+		return nil, d.errorf("bad flow.Tag extension")
+	}
+	return append([]byte{}, data...), nil
+}
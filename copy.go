@@ -0,0 +1,55 @@
+package flow
+
+// Copy makes a deep copy of a message: PacketMaps, maps with string keys,
+// slices, and byte slices are copied recursively, as is the message in a Tag.
+// Everything else is returned as is, which is fine for values such as numbers,
+// strings, and times, but pointers and other reference types stay shared.
+func Copy(m Message) Message {
+	switch v := m.(type) {
+	case PacketMap:
+		if v == nil {
+			return v
+		}
+		r := make(PacketMap, len(v))
+		for k, x := range v {
+			r[k] = Copy(x)
+		}
+		return r
+	case map[string]interface{}:
+		if v == nil {
+			return v
+		}
+		r := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			r[k] = Copy(x)
+		}
+		return r
+	case []interface{}:
+		if v == nil {
+			return v
+		}
+		r := make([]interface{}, len(v))
+		for i, x := range v {
+			r[i] = Copy(x)
+		}
+		return r
+	case []byte:
+		if v == nil {
+			return v
+		}
+		return append([]byte{}, v...)
+	case Tag:
+		return Tag{v.Tag, Copy(v.Msg)}
+	}
+	return m
+}
+
+// A shallow copy of a PacketMap, so that fields can be set without affecting
+// anyone else holding on to the original.
+func (pm PacketMap) clone() PacketMap {
+	r := make(PacketMap, len(pm)+1)
+	for k, x := range pm {
+		r[k] = x
+	}
+	return r
+}
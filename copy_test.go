@@ -0,0 +1,120 @@
+package flow_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/laughlinez/flow"
+	_ "github.com/laughlinez/flow/gadgets"
+)
+
+func TestCopy(t *testing.T) {
+	orig := flow.PacketMap{"a": 1, "b": []byte{1, 2},
+		"c": map[string]interface{}{"d": []interface{}{"e", flow.PacketMap{"f": 2}}}}
+	tag := flow.Tag{"<t>", orig}
+	c := flow.Copy(tag).(flow.Tag)
+	if !reflect.DeepEqual(c, tag) {
+		t.Fatalf("copy differs: %v", c)
+	}
+
+	// change everything in the copy, the original must not be affected
+	pm := c.Msg.(flow.PacketMap)
+	pm["a"] = 2
+	pm["b"].([]byte)[0] = 9
+	nested := pm["c"].(map[string]interface{})
+	nested["d"].([]interface{})[1].(flow.PacketMap)["f"] = 3
+	nested["g"] = 4
+	want := flow.PacketMap{"a": 1, "b": []byte{1, 2},
+		"c": map[string]interface{}{"d": []interface{}{"e", flow.PacketMap{"f": 2}}}}
+	if !reflect.DeepEqual(orig, want) {
+		t.Errorf("original changed: %v", orig)
+	}
+}
+
+// changes each incoming PacketMap, and keeps what it saw, for inspection
+type mutator struct {
+	flow.Gadget
+	In flow.Input
+
+	seen []string
+}
+
+func (g *mutator) Run() {
+	for m := range g.In {
+		v := m.(flow.PacketMap)
+		nested := v["nested"].(map[string]interface{})
+		g.seen = append(g.seen, fmt.Sprint(v["by"], nested["by"]))
+		v["by"] = g.Name()
+		nested["by"] = g.Name()
+	}
+}
+
+// run a FanOut into two mutators, with the wires set up by the given function
+func runFanOut(t *testing.T, g *flow.Circuit, wire func()) {
+	a, b := new(mutator), new(mutator)
+	g.Add("f", "FanOut")
+	g.AddCircuitry("a", a)
+	g.AddCircuitry("b", b)
+	wire()
+	for i := 0; i < 100; i++ {
+		g.Feed("f.In", flow.PacketMap{"nested": map[string]interface{}{}})
+	}
+	g.Run()
+
+	for _, m := range [...]*mutator{a, b} {
+		if len(m.seen) != 100 {
+			t.Fatalf("%s: expected 100 messages, got %d", m.Name(), len(m.seen))
+		}
+		for _, s := range m.seen {
+			if s != "<nil> <nil>" {
+				t.Fatalf("%s: saw changes from another branch: %s", m.Name(), s)
+			}
+		}
+	}
+}
+
+// These tests are meant to be run with the race detector as well.
+
+func TestCopyMessages(t *testing.T) {
+	g := flow.NewCircuit()
+	g.CopyMessages(true)
+	runFanOut(t, g, func() {
+		g.Connect("f.Out:a", "a.In", 0)
+		g.Connect("f.Out:b", "b.In", 0)
+	})
+}
+
+func TestConnectCopy(t *testing.T) {
+	g := flow.NewCircuit()
+	runFanOut(t, g, func() {
+		g.ConnectCopy("f.Out:a", "a.In", 0)
+		g.ConnectCopy("f.Out:b", "b.In", 0)
+	})
+}
+
+func TestCopyWireJSON(t *testing.T) {
+	g := flow.NewCircuit()
+	runFanOut(t, g, func() {
+		err := g.LoadJSON([]byte(`{"wires": [
+			{"from": "f.Out:a", "to": "a.In", "copy": true},
+			{"from": "f.Out:b", "to": "b.In", "copy": true}]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestDispatchKeepsOriginal(t *testing.T) {
+	orig := flow.PacketMap{"type": "Pipe"}
+	g := flow.NewCircuit()
+	g.Add("d", "PacketMapDispatcher")
+	g.Add("s", "Sink")
+	g.Connect("d.Out", "s.In", 0)
+	g.Feed("d.Field", "type")
+	g.Feed("d.In", orig)
+	g.Run()
+	if len(orig) != 1 {
+		t.Errorf("original changed: %v", orig)
+	}
+}
@@ -1,6 +1,10 @@
 package flow
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/golang/glog"
 )
 
@@ -13,7 +17,10 @@ func init() {
 		c.Connect("tail.Back", "head.Reply", 1) // must have room for reply
 		c.Label("In", "head.In")
 		c.Label("Prefix", "head.Prefix")
+		c.Label("Timeout", "head.Timeout")
+		c.Label("Evict", "head.Evict")
 		c.Label("Rej", "head.Rej")
+		c.Label("Stats", "head.Stats")
 		c.Label("Out", "tail.Out")
 		return c
 	}
@@ -22,19 +29,70 @@ func init() {
 // A dispatcher sends messages to newly created gadgets, based on dispatch tags.
 // These gadgets must have an In and an Out pin. Their output is merged into
 // a single Out pin, the rest is sent to Rej. Registers as "Dispatcher".
+//
+// Before switching, the dispatcher waits for all output of the current gadget
+// to come out. A duration (e.g. "5s") sent to the Timeout pin limits this wait,
+// a map such as {"timeout": "5s", "recreate": true} also tears down a gadget
+// which did not finish in time, so that a fresh one gets created when it is
+// dispatched to again. Either way, a DispatchTimeout is sent to Rej.
+//
+// Gadgets are kept around for re-use, a map such as {"idle": "10m", "max": 100}
+// sent to the Evict pin limits this. Whenever the number of gadgets changes,
+// a PacketMap with "live" and "evicted" counts is sent to the Stats pin.
 type Dispatcher Circuit
 
+// DispatchTimeout reports a gadget which failed to pass on all its output in
+// time, i.e. because it is stuck, or dropped the dispatcher's marker.
+type DispatchTimeout struct {
+	Gadget    string        // name of the gadget in the dispatcher
+	Type      string        // the registry entry it was created from
+	Timeout   time.Duration // how long the dispatcher waited
+	Recreated bool          // true if the gadget was torn down
+}
+
+func (e DispatchTimeout) Error() string {
+	return fmt.Sprintf("dispatch: %s (%s) did not drain within %s", e.Gadget, e.Type, e.Timeout)
+}
+
 // The implementation uses a circuit with dispatchHead and dispatchTail gadgets.
 // Newly created gadgets are inserted "between" them, using Feeds as fanout.
 // Switching needs special care to drain the preceding gadget output first.
 
 type dispatchHead struct {
 	Gadget
-	In     Input
-	Prefix Input
-	Reply  Input
-	Feeds  map[string]Output
-	Rej    Output
+	In      Input
+	Prefix  Input
+	Timeout Input
+	Evict   Input
+	Reply   Input
+	Feeds   map[string]Output
+	Rej     Output
+	Stats   Output
+
+	timeout  time.Duration
+	recreate bool
+	markers  int                        // sequence number of the last marker sent
+	pending  map[string]*pendingMarkers // markers still being sent, by gadget
+	policy   *evictionPolicy
+}
+
+// Markers still being sent to a gadget, which may never read them. Closing
+// stop makes all of them give up, so that the gadget's feed can be closed.
+type pendingMarkers struct {
+	sync.WaitGroup
+	stop chan struct{}
+}
+
+// Give up on all markers still being sent, and wait until they have.
+func (p *pendingMarkers) abandon() {
+	close(p.stop)
+	p.Wait()
+}
+
+// markers are unique per dispatcher and switch, so that a late one is ignored
+type dispatchMarker struct {
+	circuit *Circuit
+	seq     int
 }
 
 func (g *dispatchHead) Run() {
@@ -42,18 +100,61 @@ func (g *dispatchHead) Run() {
 	if p, ok := <-g.Prefix; ok {
 		prefix = p.(string)
 	}
+	if t, ok := <-g.Timeout; ok {
+		g.setTimeout(t)
+	}
+	g.policy = newEvictionPolicy()
+	if e, ok := <-g.Evict; ok {
+		g.policy.configure(e)
+	}
+	tick, stop := g.policy.ticker()
+	defer stop()
+
+	g.pending = map[string]*pendingMarkers{}
+	defer func() {
+		// can't close feeds while markers are still being sent to them
+		for _, sends := range g.pending {
+			sends.abandon()
+		}
+		// late markers may still come back, so keep accepting them until the
+		// tail is done, which happens once all the feeds have been closed
+		for _, feed := range g.Feeds {
+			feed.Disconnect()
+		}
+		for range g.Reply {
+		}
+	}()
+
 	gadget := ""
-	for m := range g.In {
+	for {
+		var m Message
+		select {
+		case msg, ok := <-g.In:
+			if !ok {
+				return
+			}
+			m = msg
+		case <-g.Reply:
+			continue // a marker which arrived after its timeout, ignore it
+		case now := <-tick:
+			g.evict(now, gadget, false)
+			continue
+		}
+
 		if tag, ok := m.(Tag); ok && tag.Tag == "<dispatch>" {
 			if tag.Msg == gadget {
 				continue
 			}
 
-			// send (unique!) marker and act on it once it comes back on Reply
-			g.Feeds[gadget].Send(Tag{"<marker>", g.owner})
-			<-g.Reply // TODO: add a timeout?
+			// wait until the previous output has drained, or has timed out
+			if !g.drain(gadget) {
+				g.stuck(gadget, prefix)
+			}
+			if g.policy.active() && g.Feeds[gadget] != nil && gadget != "" {
+				g.policy.touch(gadget, time.Now()) // last use is now
+			}
 
-			// perform the switch, now that previous output has drained
+			// perform the switch
 			gadget = tag.Msg.(string)
 			if g.Feeds[gadget] == nil {
 				if Registry[prefix+gadget] == nil {
@@ -66,7 +167,11 @@ func (g *dispatchHead) Run() {
 					c.Add(gadget, prefix+gadget)
 					c.Connect("head.Feeds:"+gadget, gadget+".In", 0)
 					c.Connect(gadget+".Out", "tail.In", 0)
-					c.gadgets[gadget].launch()
+					c.RunGadget(gadget)
+					if g.policy.active() {
+						g.policy.touch(gadget, time.Now())
+						g.evict(time.Now(), gadget, true)
+					}
 				}
 			}
 
@@ -83,6 +188,91 @@ func (g *dispatchHead) Run() {
 	}
 }
 
+// Accepts either a duration, or a map with "timeout" and "recreate" entries.
+func (g *dispatchHead) setTimeout(m Message) {
+	var err error
+	switch v := m.(type) {
+	case string:
+		g.timeout, err = ParseDuration(v)
+	case map[string]interface{}:
+		if t, ok := v["timeout"]; ok {
+			g.timeout, err = ParseDuration(t)
+		}
+		g.recreate, _ = v["recreate"].(bool)
+	default:
+		err = fmt.Errorf("unexpected %T", m)
+	}
+	if err != nil {
+		glog.Errorln("dispatch: bad timeout:", err)
+	}
+}
+
+// Send a marker through the gadget and wait for it to come back on Reply.
+// Returns false if this took longer than the timeout (if there is one).
+func (g *dispatchHead) drain(gadget string) bool {
+	g.markers++
+	marker := Tag{"<marker>", dispatchMarker{g.owner, g.markers}}
+	feed := g.Feeds[gadget]
+
+	var expired <-chan time.Time
+	if g.timeout > 0 {
+		// the gadget may not even be reading its input, so don't block on it,
+		// markers from earlier timeouts may also still be waiting to be sent
+		sends := g.pending[gadget]
+		if sends == nil {
+			sends = &pendingMarkers{stop: make(chan struct{})}
+			g.pending[gadget] = sends
+		}
+		sends.Add(1)
+		go func() {
+			defer sends.Done()
+			feed.(*sender).trySend(marker, sends.stop, g.Done())
+		}()
+		expired = time.After(g.timeout)
+	} else {
+		feed.Send(marker)
+	}
+
+	for {
+		select {
+		case r := <-g.Reply:
+			if r.(Tag).Msg == marker.Msg {
+				return true
+			}
+		case <-expired:
+			return false
+		}
+	}
+}
+
+// Report a stuck gadget, and tear it down if so configured.
+func (g *dispatchHead) stuck(gadget, prefix string) {
+	report := DispatchTimeout{Gadget: gadget, Type: prefix + gadget,
+		Timeout: g.timeout, Recreated: g.recreate && gadget != ""}
+	glog.Warningln(report)
+
+	if report.Recreated {
+		evictGadget(&g.Gadget, g.Feeds, gadget, gadget, g.pending[gadget])
+		delete(g.pending, gadget)
+		g.policy.forget(gadget)
+	}
+
+	g.Rej.Send(report)
+}
+
+// Evict idle and surplus gadgets, but never the current one. Stats are sent
+// out if anything changed, including the creation of a new gadget.
+func (g *dispatchHead) evict(now time.Time, current string, created bool) {
+	victims := g.policy.victims(now, current)
+	for _, key := range victims {
+		evictGadget(&g.Gadget, g.Feeds, key, key, g.pending[key])
+		delete(g.pending, key)
+	}
+	if created || len(victims) > 0 {
+		g.Stats.Send(g.policy.stats())
+	}
+}
+
 type dispatchTail struct {
 	Gadget
 	In   Input
@@ -92,10 +282,12 @@ type dispatchTail struct {
 
 func (g *dispatchTail) Run() {
 	for m := range g.In {
-		if tag, ok := m.(Tag); ok && tag.Tag == "<marker>" && tag.Msg == g.owner {
-			g.Back.Send(m)
-		} else {
-			g.Out.Send(m)
+		if tag, ok := m.(Tag); ok && tag.Tag == "<marker>" {
+			if mk, ok := tag.Msg.(dispatchMarker); ok && mk.circuit == g.owner {
+				g.Back.Send(m)
+				continue
+			}
 		}
+		g.Out.Send(m)
 	}
 }
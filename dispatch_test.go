@@ -1,8 +1,12 @@
 package flow_test
 
 import (
+	"testing"
+	"time"
+
 	"github.com/laughlinez/flow"
-	_ "github.com/jcw/laughlinez/gadgets"
+	"github.com/laughlinez/flow/flowtest"
+	_ "github.com/laughlinez/flow/gadgets"
 )
 
 func ExampleDispatcher() {
@@ -22,3 +26,247 @@ func ExampleDispatcher() {
 	// Lost string: jkl
 	// Lost int: 2
 }
+
+func TestDispatcherTimeout(t *testing.T) {
+	out, rej := new(flowtest.Collector), new(flowtest.Collector)
+	g := flow.NewCircuit()
+	g.Add("d", "Dispatcher")
+	g.AddCircuitry("out", out)
+	g.AddCircuitry("rej", rej)
+	g.Connect("d.Out", "out.In", 0)
+	g.Connect("d.Rej", "rej.In", 0)
+	g.Feed("d.Timeout", map[string]interface{}{"timeout": "10ms", "recreate": true})
+	g.Feed("d.In", flow.Tag{"<dispatch>", "Sink"}) // Sink swallows the marker
+	g.Feed("d.In", "abc")
+	g.Feed("d.In", flow.Tag{"<dispatch>", ""})
+	g.Feed("d.In", "def")
+	g.Run()
+
+	if len(rej.Msgs) != 1 {
+		t.Fatalf("expected one rejection, got: %v", rej.Msgs)
+	}
+	if e, ok := rej.Msgs[0].(flow.DispatchTimeout); !ok || e.Gadget != "Sink" || !e.Recreated {
+		t.Errorf("unexpected rejection: %#v", rej.Msgs[0])
+	}
+	if len(out.Msgs) != 3 || out.Msgs[2] != "def" {
+		t.Errorf("unexpected output: %v", out.Msgs)
+	}
+}
+
+// only starts reading its input after a pause
+type lateReader struct {
+	flow.Gadget
+	In  flow.Input
+	Out flow.Output
+}
+
+func (g *lateReader) Run() {
+	time.Sleep(50 * time.Millisecond)
+	for m := range g.In {
+		g.Out.Send(m)
+	}
+}
+
+func init() {
+	flow.Registry["LateReader"] = func() flow.Circuitry { return new(lateReader) }
+}
+
+func TestDispatcherRepeatedTimeout(t *testing.T) {
+	rej := new(flowtest.Collector)
+	g := flow.NewCircuit()
+	g.Add("d", "Dispatcher")
+	g.AddCircuitry("rej", rej)
+	g.Connect("d.Rej", "rej.In", 0)
+	g.Feed("d.Timeout", "5ms")
+	// each switch away from the gadget times out, without recreating it, so
+	// that two markers are still pending when the feeds get closed
+	g.Feed("d.In", flow.Tag{"<dispatch>", "LateReader"})
+	g.Feed("d.In", flow.Tag{"<dispatch>", ""})
+	g.Feed("d.In", flow.Tag{"<dispatch>", "LateReader"})
+	g.Feed("d.In", flow.Tag{"<dispatch>", ""})
+	g.Run()
+
+	if len(rej.Msgs) != 2 {
+		t.Errorf("expected two rejections, got: %v", rej.Msgs)
+	}
+}
+
+// never reads its input, and only stops once the circuit is cancelled
+type nonReader struct {
+	flow.Gadget
+	In  flow.Input
+	Out flow.Output
+}
+
+func (g *nonReader) Run() {
+	<-g.Done()
+}
+
+func init() {
+	flow.Registry["NonReader"] = func() flow.Circuitry { return new(nonReader) }
+}
+
+func TestDispatcherNonReader(t *testing.T) {
+	rej := new(flowtest.Collector)
+	g := flow.NewCircuit()
+	g.Add("d", "Dispatcher")
+	g.AddCircuitry("rej", rej)
+	g.Connect("d.Rej", "rej.In", 0)
+	g.Feed("d.Timeout", map[string]interface{}{"timeout": "5ms", "recreate": true})
+	g.Feed("d.In", flow.Tag{"<dispatch>", "NonReader"})
+	g.Feed("d.In", flow.Tag{"<dispatch>", ""})
+	g.Feed("d.In", flow.Tag{"<dispatch>", "NonReader"})
+	g.Feed("d.In", flow.Tag{"<dispatch>", ""})
+
+	// the marker sent to a torn down gadget must not keep its feed open
+	time.AfterFunc(100*time.Millisecond, func() { g.Cancel(nil) })
+	done := make(chan struct{})
+	go func() {
+		g.Run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("circuit did not finish")
+	}
+
+	if len(rej.Msgs) != 2 {
+		t.Errorf("expected two rejections, got: %v", rej.Msgs)
+	}
+}
+
+// sends its messages with a pause before each one
+type slowFeed struct {
+	flow.Gadget
+	Out flow.Output
+
+	msgs  []flow.Message
+	pause time.Duration
+}
+
+func (g *slowFeed) Run() {
+	for _, m := range g.msgs {
+		time.Sleep(g.pause)
+		g.Out.Send(m)
+	}
+}
+
+func TestDispatcherEvictMax(t *testing.T) {
+	out, stats := new(flowtest.Collector), new(flowtest.Collector)
+	g := flow.NewCircuit()
+	g.Add("d", "Dispatcher")
+	g.AddCircuitry("out", out)
+	g.AddCircuitry("stats", stats)
+	g.Connect("d.Out", "out.In", 0)
+	g.Connect("d.Stats", "stats.In", 0)
+	g.Feed("d.Evict", map[string]interface{}{"max": 1})
+	g.Feed("d.In", flow.Tag{"<dispatch>", "Counter"})
+	g.Feed("d.In", "a")
+	g.Feed("d.In", "b")
+	g.Feed("d.In", flow.Tag{"<dispatch>", "Pipe"})
+	g.Feed("d.In", "c")
+	g.Run()
+
+	counted, piped := false, false
+	for _, m := range out.Msgs {
+		counted = counted || m == 2 // Counter reports when its input is closed
+		piped = piped || m == "c"
+	}
+	if !counted || !piped {
+		t.Errorf("unexpected output: %v", out.Msgs)
+	}
+	last := stats.Msgs[len(stats.Msgs)-1].(flow.PacketMap)
+	if last["live"] != 1 || last["evicted"] != 1 {
+		t.Errorf("unexpected stats: %v", stats.Msgs)
+	}
+}
+
+func TestPacketMapDispatcherEvictIdle(t *testing.T) {
+	out, stats := new(flowtest.Collector), new(flowtest.Collector)
+	g := flow.NewCircuit()
+	g.Add("d", "PacketMapDispatcher")
+	g.AddCircuitry("feed", &slowFeed{pause: 50 * time.Millisecond, msgs: []flow.Message{
+		flow.PacketMap{"type": "Counter"},
+		flow.PacketMap{"type": "Counter"},
+		flow.PacketMap{"type": "Pipe"},
+	}})
+	g.AddCircuitry("out", out)
+	g.AddCircuitry("stats", stats)
+	g.Connect("feed.Out", "d.In", 0)
+	g.Connect("d.Out", "out.In", 0)
+	g.Connect("d.Stats", "stats.In", 0)
+	g.Feed("d.Field", "type")
+	g.Feed("d.Evict", map[string]interface{}{"idle": "20ms"})
+	g.Run()
+
+	// each message creates a new gadget, since the previous one has been evicted
+	counts := 0
+	for _, m := range out.Msgs {
+		if m == 1 {
+			counts++
+		}
+	}
+	if counts != 2 {
+		t.Errorf("unexpected output: %v", out.Msgs)
+	}
+	live := 0
+	for _, m := range stats.Msgs {
+		if n := m.(flow.PacketMap)["live"].(int); n > live {
+			live = n
+		}
+	}
+	if live != 1 {
+		t.Errorf("unexpected stats: %v", stats.Msgs)
+	}
+}
+
+func TestPacketMapDispatcherRoutes(t *testing.T) {
+	out, rej := new(flowtest.Collector), new(flowtest.Collector)
+	g := flow.NewCircuit()
+	g.Add("d", "PacketMapDispatcher")
+	g.AddCircuitry("out", out)
+	g.AddCircuitry("rej", rej)
+	g.Connect("d.Out", "out.In", 0)
+	g.Connect("d.Rej", "rej.In", 0)
+	g.Feed("d.Field", []interface{}{"meta.device", "type"})
+	g.Feed("d.Dest", "via")
+	g.Feed("d.Routes", map[string]interface{}{"rf12/*": "Pipe", "433/x": "Counter"})
+	g.Feed("d.In", flow.PacketMap{"meta": map[string]interface{}{"device": "rf12"}, "type": "t"})
+	g.Feed("d.In", flow.PacketMap{"meta": flow.PacketMap{"device": "433"}, "type": "x"})
+	g.Feed("d.In", flow.PacketMap{"type": "t"})
+	g.Feed("d.In", flow.PacketMap{"meta": map[string]interface{}{"device": "zz"}, "type": "q"})
+	g.Run()
+
+	vias := map[interface{}]int{}
+	for _, m := range out.Msgs {
+		if v, ok := m.(flow.PacketMap); ok {
+			vias[v["via"]]++
+		} else if m != 1 {
+			t.Errorf("unexpected output: %v", m)
+		}
+	}
+	if len(out.Msgs) != 4 || vias["Pipe"] != 1 || vias[nil] != 2 {
+		t.Errorf("unexpected output: %v", out.Msgs)
+	}
+	if len(rej.Msgs) != 1 || rej.Msgs[0] != "zz/q" {
+		t.Errorf("unexpected rejections: %v", rej.Msgs)
+	}
+}
+
+func TestPacketMapDispatcherDefault(t *testing.T) {
+	out := new(flowtest.Collector)
+	g := flow.NewCircuit()
+	g.Add("d", "PacketMapDispatcher")
+	g.AddCircuitry("out", out)
+	g.Connect("d.Out", "out.In", 0)
+	g.Feed("d.Prefix", "Node-")
+	g.Feed("d.Field", "node")
+	g.Feed("d.Default", []interface{}{"NoSuchGadget", "Pipe"})
+	g.Feed("d.In", flow.PacketMap{"node": 7})
+	g.Run()
+
+	if len(out.Msgs) != 1 || out.Msgs[0].(flow.PacketMap)["decoder"] != "Pipe" {
+		t.Errorf("unexpected output: %v", out.Msgs)
+	}
+}
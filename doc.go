@@ -88,6 +88,10 @@ For this simple case, a Transformer could also have been used:
 
 This wraps a function into a gadget with In and Out pins. It can be used when
 there is a one-to-one processing task from incoming to outgoing messages.
+Map, Filter, FlatMap, Fold, Reduce, Sink, and Source do the same for typed
+functions, along with variants such as MapErr which send errors to an Err pin:
+
+    g.AddCircuitry("up", flow.Map(strings.ToUpper))
 
 To make a gadget available by name in the registry, set up a factory method:
 
@@ -98,5 +102,16 @@ To make a gadget available by name in the registry, set up a factory method:
     g.Add("ll", "LineLen")
 
 Message is a synonym for Go's generic "interface{}" type.
+
+Gadgets which can fail have an Err output pin, on which they send an *Error
+describing what went wrong, where, and for which message. Err pins which are
+not connected report to the circuit instead: set up a handler with OnError, or
+look at the errors logged and collected by the top-level circuit with Errors.
+
+Messages are passed by reference, so a PacketMap sent to several gadgets (i.e.
+through a FanOut) is shared by all of them. Use ConnectCopy, or "copy": true
+in the JSON description of a wire, to deliver deep copies instead, or call
+CopyMessages to do this for all wires in a circuit (as does "copy": true at
+the top level of a JSON description).
 */
 package flow
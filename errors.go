@@ -0,0 +1,95 @@
+package flow
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// Error is the message sent out on Err pins. By convention, gadgets which can
+// fail have an Err output pin, and send an Error to it instead of stopping the
+// whole process. If that pin is not connected, the error goes to the circuit
+// instead, see Circuit.OnError.
+type Error struct {
+	Path  string  // path and name of the gadget which reported the error
+	Cause error   // what went wrong
+	Msg   Message // the message which caused it, if any
+}
+
+func (e *Error) Error() string {
+	if e.Msg != nil {
+		return fmt.Sprintf("%s: %v (on %T: %v)", e.Path, e.Cause, e.Msg, e.Msg)
+	}
+	return fmt.Sprintf("%s: %v", e.Path, e.Cause)
+}
+
+// Unwrap returns the cause, for use with errors.Is and errors.As.
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// Error wraps a cause and the message it relates to (which can be nil) into an
+// Error for this gadget, ready to be sent to its Err pin.
+func (g *Gadget) Error(cause error, m Message) *Error {
+	return &Error{Path: g.Path() + g.name, Cause: cause, Msg: m}
+}
+
+// the output used for Err pins which have not been connected
+type errorSink struct {
+	gadget *Gadget
+}
+
+func (c *errorSink) Send(m Message) {
+	e, ok := m.(*Error)
+	if !ok {
+		cause, ok := m.(error)
+		if !ok {
+			cause = fmt.Errorf("%v", m)
+		}
+		e = c.gadget.Error(cause, nil)
+	}
+	c.gadget.owner.reportError(e)
+}
+
+func (c *errorSink) Disconnect() {}
+
+// maximum number of errors kept around for Circuit.Errors
+const maxErrors = 100
+
+// OnError sets up a function to call for each error from an Err pin which has
+// not been connected, in this circuit or any circuit inside it which does not
+// have its own error handler. Without one, such errors are passed on to the
+// owning circuit. In the top-level circuit, they are logged and collected, see
+// Errors. The function can be called from several goroutines at once.
+func (c *Circuit) OnError(fun func(*Error)) {
+	c.lock.Lock()
+	c.onError = fun
+	c.lock.Unlock()
+}
+
+// Errors returns the most recent errors collected by this circuit.
+func (c *Circuit) Errors() []*Error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]*Error{}, c.errors...)
+}
+
+func (c *Circuit) reportError(e *Error) {
+	c.lock.Lock()
+	fun := c.onError
+	c.lock.Unlock()
+	switch {
+	case fun != nil:
+		fun(e)
+	case c.owner != nil:
+		c.owner.reportError(e)
+	default:
+		glog.Errorln(e)
+		c.lock.Lock()
+		if len(c.errors) >= maxErrors {
+			c.errors = c.errors[1:]
+		}
+		c.errors = append(c.errors, e)
+		c.lock.Unlock()
+	}
+}
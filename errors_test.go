@@ -0,0 +1,90 @@
+package flow_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/flowtest"
+	_ "github.com/laughlinez/flow/gadgets"
+)
+
+func ExampleCircuit_OnError() {
+	g := flow.NewCircuit()
+	g.Add("t", "Timer")
+	g.Feed("t.In", "bad")
+	g.OnError(func(e *flow.Error) {
+		fmt.Println(e.Path, e.Msg)
+	})
+	g.Run()
+	// Output:
+	// /t bad
+}
+
+func TestErrPin(t *testing.T) {
+	g := flow.NewCircuit()
+	errs := new(flowtest.Collector)
+	g.Add("r", "ReadFileText")
+	g.AddCircuitry("errs", errs)
+	g.Connect("r.Err", "errs.In", 0)
+	g.Feed("r.In", "no/such/file")
+	g.Run()
+
+	if len(errs.Msgs) != 1 {
+		t.Fatalf("expected one error, got %v", errs.Msgs)
+	}
+	if e := errs.Msgs[0].(*flow.Error); e.Path != "/r" || e.Msg != "no/such/file" {
+		t.Errorf("unexpected error: %v", e)
+	}
+	if len(g.Errors()) != 0 {
+		t.Errorf("circuit should not have seen errors: %v", g.Errors())
+	}
+}
+
+func TestErrorsCollected(t *testing.T) {
+	// errors from a nested circuit without handler end up at the top
+	sub := flow.NewCircuit()
+	sub.Add("c", "Clock")
+	sub.Label("In", "c.In")
+
+	g := flow.NewCircuit()
+	g.AddCircuitry("sub", sub)
+	g.Feed("sub.In", "0s")
+	g.Run()
+
+	errs := g.Errors()
+	if len(errs) != 1 || errs[0].Path != "/sub/c" {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if !strings.Contains(errs[0].Error(), "rate must be positive") {
+		t.Errorf("unexpected message: %v", errs[0])
+	}
+}
+
+func TestOnErrorNested(t *testing.T) {
+	var mutex sync.Mutex
+	var seen []string
+
+	sub := flow.NewCircuit()
+	sub.Add("t", "Timer")
+	sub.Label("In", "t.In")
+	sub.OnError(func(e *flow.Error) {
+		mutex.Lock()
+		seen = append(seen, e.Path)
+		mutex.Unlock()
+	})
+
+	g := flow.NewCircuit()
+	g.AddCircuitry("sub", sub)
+	g.Feed("sub.In", 123)
+	g.Run()
+
+	if len(seen) != 1 || seen[0] != "/sub/t" {
+		t.Errorf("unexpected errors: %v", seen)
+	}
+	if len(g.Errors()) != 0 {
+		t.Errorf("top should not have seen errors: %v", g.Errors())
+	}
+}
@@ -0,0 +1,130 @@
+package flow
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// An eviction policy limits the number of gadgets a dispatcher keeps around:
+// gadgets can be evicted once they have been idle for a while, and the least
+// recently used one is evicted when there are too many. It is configured with
+// a map such as {"idle": "10m", "max": 100}, sent to the dispatcher's Evict pin.
+type evictionPolicy struct {
+	idle    time.Duration // evict gadgets unused for this long, 0 means never
+	max     int           // maximum number of live gadgets, 0 means no limit
+	evicted int           // total number of evictions so far
+
+	lru   *list.List               // of *instance, most recently used first
+	byKey map[string]*list.Element // the same instances, by key
+}
+
+type instance struct {
+	key  string
+	used time.Time
+}
+
+func newEvictionPolicy() *evictionPolicy {
+	return &evictionPolicy{lru: list.New(), byKey: map[string]*list.Element{}}
+}
+
+// Accepts a map with "idle" (a duration) and "max" (a number) entries.
+func (p *evictionPolicy) configure(m Message) {
+	v, ok := m.(map[string]interface{})
+	if !ok {
+		glog.Errorf("evict: expected a map, got %T", m)
+		return
+	}
+	if s, ok := v["idle"]; ok {
+		d, err := ParseDuration(s)
+		if err != nil {
+			glog.Errorln("evict: bad idle time:", err)
+		}
+		p.idle = d
+	}
+	if n, ok := v["max"]; ok {
+		if p.max, ok = Int(n); !ok {
+			glog.Errorf("evict: bad max: %v", n)
+		}
+	}
+}
+
+// True if there is any limit at all.
+func (p *evictionPolicy) active() bool {
+	return p.idle > 0 || p.max > 0
+}
+
+// Return a channel which fires regularly to check for idle gadgets, or nil.
+func (p *evictionPolicy) ticker() (<-chan time.Time, func()) {
+	if p.idle <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(p.idle / 2)
+	return t.C, t.Stop
+}
+
+// Mark a gadget as used, it is added if it is not yet known.
+func (p *evictionPolicy) touch(key string, now time.Time) {
+	if e, ok := p.byKey[key]; ok {
+		e.Value.(*instance).used = now
+		p.lru.MoveToFront(e)
+	} else {
+		p.byKey[key] = p.lru.PushFront(&instance{key, now})
+	}
+}
+
+// Return the keys to evict, i.e. idle ones and the least recently used ones
+// over the maximum. They are removed from the policy, and counted as evicted.
+// The key in keep is never evicted.
+func (p *evictionPolicy) victims(now time.Time, keep string) []string {
+	keys := []string{}
+	for e := p.lru.Back(); e != nil; {
+		inst := e.Value.(*instance)
+		prev := e.Prev()
+		over := p.max > 0 && p.lru.Len() > p.max
+		idle := p.idle > 0 && now.Sub(inst.used) >= p.idle
+		if !over && !idle {
+			break // everything in front of this one is more recent
+		}
+		if inst.key != keep {
+			keys = append(keys, inst.key)
+			p.lru.Remove(e)
+			delete(p.byKey, inst.key)
+			p.evicted++
+		}
+		e = prev
+	}
+	return keys
+}
+
+// Stop tracking a gadget, i.e. because it was torn down for other reasons.
+func (p *evictionPolicy) forget(key string) {
+	if e, ok := p.byKey[key]; ok {
+		p.lru.Remove(e)
+		delete(p.byKey, key)
+	}
+}
+
+// The number of gadgets currently tracked, and evicted so far.
+func (p *evictionPolicy) stats() PacketMap {
+	return PacketMap{"live": p.lru.Len(), "evicted": p.evicted}
+}
+
+// Evict a dispatched gadget: close its feed, so that it drains into the tail
+// and finishes, and remove it from the circuit. Markers still being sent to it
+// are abandoned first, since closing the feed under them would panic.
+func evictGadget(head *Gadget, feeds map[string]Output, key, name string, sends *pendingMarkers) {
+	glog.Infof("evicting %s from %s", name, head.Name())
+	feed := feeds[key]
+	delete(feeds, key)
+	delete(head.outputs, "Feeds:"+key)
+	head.owner.remove(name)
+	if feed == nil {
+		return
+	}
+	if sends != nil {
+		sends.abandon()
+	}
+	feed.Disconnect()
+}
@@ -7,8 +7,8 @@ import (
 	"fmt"
 
 	"github.com/golang/glog"
-	"github.com/jcw/flow"
-	_ "github.com/jcw/flow/gadgets"
+	"github.com/laughlinez/flow"
+	_ "github.com/laughlinez/flow/gadgets"
 )
 
 var (
@@ -28,7 +28,7 @@ func main() {
 	if *verbose {
 		fmt.Println("Flow", flow.Version, "\n")
 		flow.PrintRegistry()
-		fmt.Println("\nDocumentation at http://godoc.org/github.com/jcw/flow")
+		fmt.Println("\nDocumentation at http://godoc.org/github.com/laughlinez/flow")
 	} else {
 		glog.Infof("Flow %s - starting, registry size %d",
 			flow.Version, len(flow.Registry))
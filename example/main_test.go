@@ -1,6 +1,6 @@
 package main
 
-import "github.com/jcw/flow"
+import "github.com/laughlinez/flow"
 
 func Example() {
 	g := flow.NewCircuit()
@@ -10,8 +10,10 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/golang/glog"
+	api "github.com/laughlinez/flow/api"
 )
 
 // Version of this package.
@@ -55,6 +57,7 @@ type wire struct {
 	senders  int
 	capacity int
 	dest     *Gadget
+	mutex    sync.Mutex // protects senders
 }
 
 func (c *wire) Send(v Message) {
@@ -62,12 +65,53 @@ func (c *wire) Send(v Message) {
 }
 
 func (c *wire) Disconnect() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	c.senders--
 	if c.senders == 0 && c.channel != nil {
 		close(c.channel)
 	}
 }
 
+func (c *wire) addSender() {
+	c.mutex.Lock()
+	c.senders++
+	c.mutex.Unlock()
+}
+
+func (c *wire) hasSenders() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.senders > 0
+}
+
+// A sender is one connection to a wire, so that disconnecting it more than
+// once has no effect. It can also deliver deep copies of all messages.
+type sender struct {
+	*wire
+	copy bool
+	once sync.Once
+}
+
+func (s *sender) Send(v Message) {
+	if s.copy {
+		v = Copy(v)
+	}
+	s.wire.Send(v)
+}
+
+// Send a message, unless stop or done is closed before it has been accepted.
+func (s *sender) trySend(v Message, stop, done <-chan struct{}) bool {
+	if s.copy {
+		v = Copy(v)
+	}
+	return s.dest.trySendTo(s.wire, v, stop, done)
+}
+
+func (s *sender) Disconnect() {
+	s.once.Do(s.wire.Disconnect)
+}
+
 // Use a fake sink for every output pin not connected to anything else.
 type fakeSink struct{}
 
@@ -164,6 +208,20 @@ func PrintRegistry() {
 	}
 }
 
+// Print each API provider, followed by the paths of the gadgets it serves.
+func PrintProviders() {
+	for _, p := range api.Providers() {
+		qualified := p.API
+		if p.Name != "" {
+			qualified += ",name=" + p.Name
+		}
+		fmt.Printf("  %s: %s\n", qualified, p.Provider)
+		for _, c := range p.Consumers {
+			fmt.Println("    " + c)
+		}
+	}
+}
+
 // Print a description of a gadget or circuit in indented JSON format.
 func PrintDescription(c Circuitry) {
 	if d, ok := c.(*Circuit); ok {
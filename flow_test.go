@@ -27,21 +27,50 @@ func ExampleTransformer() {
 	// Lost string: DEF
 }
 
-// func ExampleRunner() {
-// 	desc := "foo: bar\nInput: In \nOutput:  Out\n\nhaha\nyes!"
-// 	upper := flow.Runner(desc, func(in flow.Input, out flow.Output) {
-// 		out.Send(strings.ToUpper((<-in).(string)))
-// 	})
-//
-// 	g := flow.NewCircuit()
-// 	g.AddCircuitry("u", upper)
-// 	g.Feed("u.In", "abc")
-// 	g.Feed("u.In", "def")
-// 	g.Run()
-// 	// Output:
-// 	// Lost string: ABC
-// 	// Lost string: DEF
-// }
+func ExampleRunner() {
+	desc := "foo: bar\nInput: In \nOutput:  Out\n\nhaha\nyes!"
+	upper := flow.Runner(desc, func(in flow.Input, out flow.Output) {
+		for m := range in {
+			out.Send(strings.ToUpper(m.(string)))
+		}
+	})
+
+	g := flow.NewCircuit()
+	g.AddCircuitry("u", upper)
+	g.Add("p", "Printer")
+	g.Connect("u.Out", "p.In", 0)
+	g.Feed("u.In", "abc")
+	g.Feed("u.In", "def")
+	g.Run()
+	// Output:
+	// ABC
+	// DEF
+}
+
+func ExampleRunner_pipeline() {
+	// an existing pipeline stage, knowing nothing about flow
+	squares := func(in <-chan int) <-chan int {
+		out := make(chan int)
+		go func() {
+			defer close(out)
+			for n := range in {
+				out <- n * n
+			}
+		}()
+		return out
+	}
+
+	g := flow.NewCircuit()
+	g.AddCircuitry("s", flow.Runner("Input: In\nOutput: Out", squares))
+	g.Add("p", "Printer")
+	g.Connect("s.Out", "p.In", 0)
+	g.Feed("s.In", 2)
+	g.Feed("s.In", 3)
+	g.Run()
+	// Output:
+	// 4
+	// 9
+}
 
 func ExampleCircuit_Label() {
 	// new circuit to repeat each incoming message three times
@@ -0,0 +1,30 @@
+// Package flowtest has helpers for testing gadgets and circuits.
+package flowtest
+
+import (
+	"github.com/laughlinez/flow"
+)
+
+// A Collector gadget keeps all incoming messages, so that they can be inspected
+// once the circuit is done. If Seen is set, each message is also sent to it as
+// it comes in, for tests which need to follow along while the circuit runs.
+// Seen is closed once the input is done.
+type Collector struct {
+	flow.Gadget
+	In flow.Input
+
+	Msgs []flow.Message
+	Seen chan flow.Message
+}
+
+func (g *Collector) Run() {
+	for m := range g.In {
+		g.Msgs = append(g.Msgs, m)
+		if g.Seen != nil {
+			g.Seen <- m
+		}
+	}
+	if g.Seen != nil {
+		close(g.Seen)
+	}
+}
@@ -3,19 +3,22 @@ package flow
 import (
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
+	api "github.com/laughlinez/flow/api"
 )
 
 // Gadget keeps track of internal details about a gadget.
 type Gadget struct {
-	circuitry Circuitry        // pointer to self as a Circuitry object
-	name      string           // name of this gadget in the circuit
-	owner     *Circuit         // owning circuit
-	alive     bool             // true while running
-	inputs    map[string]*wire // inbound wires
-	outputs   map[string]*wire // outbound wires
+	circuitry Circuitry          // pointer to self as a Circuitry object
+	name      string             // name of this gadget in the circuit
+	owner     *Circuit           // owning circuit
+	alive     bool               // true while running
+	aliveLock sync.Mutex         // protects alive, held while launching
+	inputs    map[string]*wire   // inbound wires
+	outputs   map[string]*sender // outbound wires
 }
 
 func (g *Gadget) initGadget(cy Circuitry, nm string, ow *Circuit) *Gadget {
@@ -26,7 +29,7 @@ func (g *Gadget) initGadget(cy Circuitry, nm string, ow *Circuit) *Gadget {
 	g.name = nm
 	g.owner = ow
 	g.inputs = map[string]*wire{}
-	g.outputs = map[string]*wire{}
+	g.outputs = map[string]*sender{}
 	return g
 }
 
@@ -59,6 +62,14 @@ func (g *Gadget) Path() (string) {
 }
 
 
+// Done returns a channel which gets closed when the circuit is cancelled.
+func (g *Gadget) Done() <-chan struct{} {
+	if g.owner == nil {
+		return nil
+	}
+	return g.owner.Done()
+}
+
 func (g *Gadget) pinValue(pin string) reflect.Value {
 	pp := pinPart(pin)
 	// if it's a circuit, look up mapped pins
@@ -66,7 +77,11 @@ func (g *Gadget) pinValue(pin string) reflect.Value {
 		p := g.labels[pp]
 		return g.gadgetOf(p).circuitry.pinValue(p) // recursive
 	}
-	fv := g.gadgetValue().FieldByName(pp)
+	gv := g.gadgetValue()
+	if i, ok := planOf(gv.Type()).pins[pp]; ok {
+		return gv.Field(i)
+	}
+	fv := gv.FieldByName(pp) // not a regular pin, but try anyway
 	if !fv.IsValid() {
 		glog.Fatalln("pin not found:", pin)
 	}
@@ -85,14 +100,15 @@ func (g *Gadget) getInput(pin string, capacity int) *wire {
 	return c
 }
 
-func (g *Gadget) setOutput(pin string, c *wire) {
+func (g *Gadget) setOutput(pin string, c *wire, copy bool) {
+	out := &sender{wire: c, copy: copy}
 	ppfv := strings.Split(pin, ":")
 	fp := g.circuitry.pinValue(ppfv[0])
 	if len(ppfv) == 1 {
 		if !fp.IsNil() {
 			glog.Fatalf("output already connected: %s.%s", g.name, pin)
 		}
-		setValue(fp, c)
+		setValue(fp, out)
 	} else { // it's not an Output, so it must be a map[string]Output
 		if fp.IsNil() {
 			setValue(fp, map[string]Output{})
@@ -101,10 +117,23 @@ func (g *Gadget) setOutput(pin string, c *wire) {
 		if _, ok := outputs[ppfv[1]]; ok {
 			glog.Fatalf("output already connected: %s.%s", g.name, pin)
 		}
-		outputs[ppfv[1]] = c
+		outputs[ppfv[1]] = out
+	}
+	c.addSender()
+	g.outputs[pin] = out
+}
+
+func (g *Gadget) setInput(pin string, c chan Message) {
+	ppfv := strings.Split(pinPart(pin), ":")
+	fp := g.circuitry.pinValue(ppfv[0])
+	if len(ppfv) == 1 {
+		setValue(fp, c)
+	} else { // it's not an Input, so it must be a map[string]Input
+		if fp.IsNil() {
+			setValue(fp, map[string]Input{})
+		}
+		fp.Interface().(map[string]Input)[ppfv[1]] = c
 	}
-	c.senders++
-	g.outputs[pin] = c
 }
 
 func (g *Gadget) setupChannels() {
@@ -119,32 +148,33 @@ func (g *Gadget) setupChannels() {
 	for pin, wire := range g.inputs {
 		// create a channel with the proper capacity
 		wire.channel = make(chan Message, wire.capacity)
-		setValue(g.circuitry.pinValue(pin), wire.channel)
+		g.setInput(pin, wire.channel)
 		// fill it with messages from the feed inbox, if any
 		for _, msg := range g.owner.feeds[pin] {
 			wire.channel <- msg
 		}
 		// close the channel if there is no other feed
-		if wire.senders == 0 {
+		if !wire.hasSenders() {
 			close(wire.channel)
 		}
 	}
 
-	// set dangling inputs to a null input and dangling outputs to a fake sink
+	// set dangling inputs to a null input and dangling outputs to a fake sink,
+	// except for Err pins, which report to the circuit
 	gadget := g.gadgetValue()
-	for i := 0; i < gadget.NumField(); i++ {
-		field := gadget.Field(i)
-		switch field.Type().String() {
-		case "flow.Input":
-			if field.IsNil() {
-				null := make(chan Message)
-				close(null)
-				setValue(field, null)
-			}
-		case "flow.Output":
-			if field.IsNil() {
-				setValue(field, &fakeSink{})
-			}
+	p := planOf(gadget.Type())
+	for _, i := range p.inputs {
+		if field := gadget.Field(i); field.IsNil() {
+			setValue(field, nullInput)
+		}
+	}
+	for _, i := range p.outputs {
+		if field := gadget.Field(i); !field.IsNil() {
+			continue
+		} else if gadget.Type().Field(i).Name == "Err" {
+			setValue(field, &errorSink{g})
+		} else {
+			setValue(field, sink)
 		}
 	}
 }
@@ -159,8 +189,8 @@ func (g *Gadget) isFinished() bool {
 }
 
 func (g *Gadget) closeChannels() {
-	for _, wire := range g.outputs {
-		wire.Disconnect()
+	for _, out := range g.outputs {
+		out.Disconnect()
 	}
 	for _, wire := range g.inputs {
 		// close channel if not nil and not already closed
@@ -178,9 +208,7 @@ func (g *Gadget) closeChannels() {
 }
 
 func (g *Gadget) sendTo(w *wire, v Message) {
-	if !g.alive {
-		g.launch()
-	}
+	g.wakeUp()
 
 	const reportSlowSends = false
 	if reportSlowSends {
@@ -197,11 +225,52 @@ func (g *Gadget) sendTo(w *wire, v Message) {
 	}
 }
 
+// Like sendTo, but gives up once stop or done is closed. Returns true if sent.
+func (g *Gadget) trySendTo(w *wire, v Message, stop, done <-chan struct{}) bool {
+	g.wakeUp()
+	select {
+	case w.channel <- v:
+		return true
+	case <-stop:
+	case <-done:
+	}
+	return false
+}
+
+// Launch the gadget if it isn't running, since input is about to arrive.
+func (g *Gadget) wakeUp() {
+	g.aliveLock.Lock()
+	alive := g.alive
+	g.aliveLock.Unlock()
+	if !alive {
+		g.launch()
+	}
+}
+
 func (g *Gadget) launch() {
+	if g.prepare() {
+		g.start()
+	}
+}
+
+// Inject APIs and set up the channels, unless the gadget is already running.
+// Returns true if the gadget can be started.
+func (g *Gadget) prepare() bool {
+	g.aliveLock.Lock()
+	defer g.aliveLock.Unlock()
+	if g.alive {
+		return false
+	}
 	g.alive = true
 	g.owner.wait.Add(1)
+	if err := api.InjectAPI(g.circuitry, apiOptions); err != nil {
+		glog.Fatalln(err)
+	}
 	g.setupChannels()
+	return true
+}
 
+func (g *Gadget) start() {
 	go func() {
 		defer DontPanic()
 		defer g.owner.wait.Done()
@@ -213,8 +282,13 @@ func (g *Gadget) launch() {
 		// 		break
 		// 	}
 		// }
+		if err := api.ReleaseAPI(g.circuitry); err != nil {
+			glog.Errorln(err)
+		}
 
+		g.aliveLock.Lock()
 		g.alive = false
+		g.aliveLock.Unlock()
 	}()
 }
 
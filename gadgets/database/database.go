@@ -0,0 +1,71 @@
+// Embedded key-value storage, offered to other gadgets as "DBReadWriteAPI".
+package database
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/api"
+)
+
+func init() {
+	flow.Registry["DBProvider"] = func() flow.Circuitry {
+		return &DBProvider{DB: sharedStore()}
+	}
+	flow.Registry["MemDBProvider"] = func() flow.Circuitry {
+		return NewMemDBProvider()
+	}
+}
+
+// DBProvider offers a FileStore to all gadgets requesting "DBReadWriteAPI".
+// The file is taken from the DB_FILE config setting, or else "flow.db" in the
+// DATA_DIR directory. If neither is set, the store reports an error when it is
+// started, instead of creating a file in the current directory.
+// Registers as "DBProvider".
+type DBProvider struct {
+	flow.Gadget
+	DB api.IDBReadWriteAPI `flowapi:"DBReadWriteAPI"`
+}
+
+// Nothing to do, the store is opened on first use.
+func (g *DBProvider) Run() {}
+
+// MemDBProvider offers a MemStore as "DBReadWriteAPI" under the name "memory",
+// consumers select it with `gadget:"DBReadWriteAPI,name=memory"`.
+// Registers as "MemDBProvider".
+type MemDBProvider struct {
+	flow.Gadget
+	DB api.IDBReadWriteAPI `flowapi:"DBReadWriteAPI,name=memory"`
+}
+
+// NewMemDBProvider returns a provider with its own empty in-memory store.
+func NewMemDBProvider() *MemDBProvider {
+	return &MemDBProvider{DB: NewMemStore()}
+}
+
+// Nothing to do, the store lives in memory.
+func (g *MemDBProvider) Run() {}
+
+var shared struct {
+	sync.Once
+	store *FileStore
+}
+
+// all DBProvider instances share one store, so the file is only opened once
+func sharedStore() *FileStore {
+	shared.Do(func() {
+		shared.store = NewFileStore(dbPath())
+	})
+	return shared.store
+}
+
+func dbPath() string {
+	if path := flow.Config["DB_FILE"]; path != "" {
+		return path
+	}
+	if dir := flow.Config["DATA_DIR"]; dir != "" {
+		return filepath.Join(dir, "flow.db")
+	}
+	return ""
+}
@@ -0,0 +1,202 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/api"
+)
+
+func tempFile(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "test.db")
+}
+
+func exerciseStore(t *testing.T, db api.IDBReadWriteAPI) {
+	for _, k := range []string{"b/2", "a/1", "b/1", "c", "b/3"} {
+		if err := db.Put(k, k+"!"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Put("n", 123)
+
+	keys, _ := db.Keys("b/")
+	if !reflect.DeepEqual(keys, []string{"b/1", "b/2", "b/3"}) {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+	if v, _ := db.Get("n"); v != 123.0 {
+		t.Errorf("expected 123, got %v", v)
+	}
+	if v, _ := db.Get("nope"); v != nil {
+		t.Errorf("expected nil, got %v", v)
+	}
+
+	// prune a range while iterating over it
+	seen := []string{}
+	err := db.Range("b/", "c", func(k string, v interface{}) bool {
+		seen = append(seen, k)
+		if v != k+"!" {
+			t.Errorf("bad value for %s: %v", k, v)
+		}
+		db.Delete(k)
+		return k != "b/2"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(seen, []string{"b/1", "b/2"}) {
+		t.Errorf("unexpected range: %v", seen)
+	}
+	keys, _ = db.Keys("")
+	if !reflect.DeepEqual(keys, []string{"a/1", "b/3", "c", "n"}) {
+		t.Errorf("unexpected keys after delete: %v", keys)
+	}
+	if err := db.Delete("nope"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	exerciseStore(t, NewMemStore())
+}
+
+func TestFileStore(t *testing.T) {
+	path := tempFile(t)
+
+	db := NewFileStore(path)
+	exerciseStore(t, db)
+	db.Close()
+
+	db = NewFileStore(path)
+	keys, _ := db.Keys("")
+	if !reflect.DeepEqual(keys, []string{"a/1", "b/3", "c", "n"}) {
+		t.Errorf("unexpected keys after reopen: %v", keys)
+	}
+	db.Close()
+}
+
+func TestFileStoreCloseWhileInUse(t *testing.T) {
+	path := tempFile(t)
+
+	db := NewFileStore(path)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			if err := db.Put("k", i); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		db.Close()
+	}
+	<-done
+	db.Close()
+}
+
+func TestFileStoreNoPath(t *testing.T) {
+	if err := NewFileStore("").Start(); err == nil {
+		t.Error("expected an error without a file")
+	}
+}
+
+func TestDBPath(t *testing.T) {
+	dir := t.TempDir()
+	defer delete(flow.Config, "DATA_DIR")
+
+	if p := dbPath(); p != "" {
+		t.Errorf("expected no path, got %q", p)
+	}
+	flow.Config["DATA_DIR"] = dir
+	if p := dbPath(); p != filepath.Join(dir, "flow.db") {
+		t.Errorf("unexpected path: %q", p)
+	}
+}
+
+func TestFileStoreTruncatedRecord(t *testing.T) {
+	path := tempFile(t)
+
+	db := NewFileStore(path)
+	db.Put("a", 1)
+	db.Close()
+
+	// simulate a crash in the middle of writing the next record
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	f.WriteString(`{"k":"b","v":`)
+	f.Close()
+
+	db = NewFileStore(path)
+	if err := db.Put("c", 3); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = NewFileStore(path)
+	keys, err := db.Keys("")
+	if err != nil || !reflect.DeepEqual(keys, []string{"a", "c"}) {
+		t.Errorf("unexpected keys: %v (%v)", keys, err)
+	}
+	db.Close()
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	path := tempFile(t)
+
+	db := NewFileStore(path)
+	for i := 0; i < 3*minCompaction; i++ {
+		db.Put("x", i)
+	}
+	db.Put("y", "last")
+	if info, _ := os.Stat(path); info.Size() > 30*minCompaction {
+		t.Errorf("log was not compacted, size %d", info.Size())
+	}
+	db.Close()
+
+	db = NewFileStore(path)
+	if v, _ := db.Get("x"); v != float64(3*minCompaction-1) {
+		t.Errorf("unexpected value after compaction: %v", v)
+	}
+	if v, _ := db.Get("y"); v != "last" {
+		t.Errorf("unexpected value after compaction: %v", v)
+	}
+	db.Close()
+}
+
+type dbUser struct {
+	flow.Gadget
+	DB  api.IDBReadWriteAPI `gadget:"DBReadWriteAPI,name=memory"`
+	got interface{}
+}
+
+func (g *dbUser) Run() {
+	g.DB.Put("hello", "world")
+	g.got, _ = g.DB.Get("hello")
+}
+
+func TestMemDBProvider(t *testing.T) {
+	u := new(dbUser)
+	g := flow.NewCircuit()
+	g.AddCircuitry("u", u)
+	g.Run()
+
+	if u.got != "world" {
+		t.Errorf("expected world, got %v", u.got)
+	}
+	if _, ok := u.DB.(*MemStore); !ok {
+		t.Errorf("expected a MemStore, got %T", u.DB)
+	}
+
+	for _, p := range api.Providers() {
+		if p.API == "DBReadWriteAPI" && p.Name == "memory" {
+			if len(p.Consumers) != 1 || p.Consumers[0] != "/u" {
+				t.Errorf("unexpected consumers: %v", p.Consumers)
+			}
+			return
+		}
+	}
+	t.Error("memory provider not listed")
+}
@@ -0,0 +1,372 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// MemStore is an in-memory key-value store. Values are kept in JSON-encoded
+// form, so that they come back exactly as they would from a FileStore.
+type MemStore struct {
+	mu   sync.Mutex
+	data map[string][]byte // encoded values
+	keys []string          // all keys, kept in sorted order
+}
+
+// NewMemStore returns an empty in-memory store, mostly useful for tests.
+func NewMemStore() *MemStore {
+	return &MemStore{data: map[string][]byte{}}
+}
+
+// Keys returns all keys starting with prefix, in sorted order.
+func (s *MemStore) Keys(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []string{}
+	for i := sort.SearchStrings(s.keys, prefix); i < len(s.keys); i++ {
+		if len(s.keys[i]) < len(prefix) || s.keys[i][:len(prefix)] != prefix {
+			break
+		}
+		result = append(result, s.keys[i])
+	}
+	return result, nil
+}
+
+// Get returns the value stored for key, or nil if there is none.
+func (s *MemStore) Get(key string) (interface{}, error) {
+	s.mu.Lock()
+	data, ok := s.data[key]
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return decodeValue(data)
+}
+
+// Range calls fn for each key in [from, to), in order, until fn returns false.
+// An empty 'to' means there is no upper bound. The keys and values are taken
+// as a snapshot, so fn can modify the store while iterating.
+func (s *MemStore) Range(from, to string, fn func(string, interface{}) bool) error {
+	s.mu.Lock()
+	keys := []string{}
+	values := [][]byte{}
+	for i := sort.SearchStrings(s.keys, from); i < len(s.keys); i++ {
+		if to != "" && s.keys[i] >= to {
+			break
+		}
+		keys = append(keys, s.keys[i])
+		values = append(values, s.data[s.keys[i]])
+	}
+	s.mu.Unlock()
+
+	for i, k := range keys {
+		v, err := decodeValue(values[i])
+		if err != nil {
+			return err
+		}
+		if !fn(k, v) {
+			break
+		}
+	}
+	return nil
+}
+
+// Put stores a value for key, which must be encodable as JSON.
+func (s *MemStore) Put(key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.set(key, data)
+	s.mu.Unlock()
+	return nil
+}
+
+// Delete removes key from the store.
+func (s *MemStore) Delete(key string) error {
+	s.mu.Lock()
+	s.remove(key)
+	s.mu.Unlock()
+	return nil
+}
+
+// set updates the index, the caller must hold the lock.
+func (s *MemStore) set(key string, data []byte) {
+	if _, ok := s.data[key]; !ok {
+		i := sort.SearchStrings(s.keys, key)
+		s.keys = append(s.keys, "")
+		copy(s.keys[i+1:], s.keys[i:])
+		s.keys[i] = key
+	}
+	s.data[key] = data
+}
+
+// remove updates the index, the caller must hold the lock.
+func (s *MemStore) remove(key string) bool {
+	if _, ok := s.data[key]; !ok {
+		return false
+	}
+	i := sort.SearchStrings(s.keys, key)
+	s.keys = append(s.keys[:i], s.keys[i+1:]...)
+	delete(s.data, key)
+	return true
+}
+
+func decodeValue(data []byte) (interface{}, error) {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+// FileStore is a key-value store kept in a single append-only log file, with
+// one JSON record per line. Each change is written with a single write and
+// synced to disk before it takes effect, a partially written record at the
+// end of the file (after a crash) is discarded on the next open. The log is
+// compacted once it holds more stale records than live ones.
+type FileStore struct {
+	MemStore
+
+	path    string
+	file    *os.File
+	err     error // sticky error from opening the file
+	opened  bool
+	garbage int // number of stale records in the log
+}
+
+// one line in the log file
+type record struct {
+	Key     string          `json:"k"`
+	Value   json.RawMessage `json:"v,omitempty"`
+	Deleted bool            `json:"d,omitempty"`
+}
+
+// don't bother compacting small log files
+const minCompaction = 1000
+
+// NewFileStore returns a store for the given path. The file is created and
+// loaded on first use, so constructing a store is cheap.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{MemStore: MemStore{data: map[string][]byte{}}, path: path}
+}
+
+// Path returns the name of the log file used by this store.
+func (s *FileStore) Path() string {
+	return s.path
+}
+
+// Keys returns all keys starting with prefix, in sorted order.
+func (s *FileStore) Keys(prefix string) ([]string, error) {
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s.MemStore.Keys(prefix)
+}
+
+// Get returns the value stored for key, or nil if there is none.
+func (s *FileStore) Get(key string) (interface{}, error) {
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s.MemStore.Get(key)
+}
+
+// Range calls fn for each key in [from, to), see MemStore.Range.
+func (s *FileStore) Range(from, to string, fn func(string, interface{}) bool) error {
+	if err := s.open(); err != nil {
+		return err
+	}
+	return s.MemStore.Range(from, to, fn)
+}
+
+// Put stores a value for key, and returns once it has been written to disk.
+func (s *FileStore) Put(key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.openLocked(); err != nil {
+		return err
+	}
+	if err := s.append(record{Key: key, Value: data}); err != nil {
+		return err
+	}
+	if _, ok := s.data[key]; ok {
+		s.garbage++
+	}
+	s.set(key, data)
+	return s.maybeCompact()
+}
+
+// Delete removes key, and returns once the removal has been written to disk.
+func (s *FileStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.openLocked(); err != nil {
+		return err
+	}
+	if _, ok := s.data[key]; !ok {
+		return nil
+	}
+	if err := s.append(record{Key: key, Deleted: true}); err != nil {
+		return err
+	}
+	s.remove(key)
+	s.garbage += 2 // both the old value and the deletion are now stale
+	return s.maybeCompact()
+}
+
+// Start opens and loads the log file, so that problems show up early.
+func (s *FileStore) Start() error {
+	return s.open()
+}
+
+// Health reports the error which prevented opening the log file, if any.
+func (s *FileStore) Health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close flushes and closes the log file, the store can be re-opened by
+// using it again.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		s.opened = false
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	s.opened = false
+	s.data = map[string][]byte{}
+	s.keys = nil
+	s.garbage = 0
+	return err
+}
+
+// open loads the log file on first use, and truncates a damaged last record.
+func (s *FileStore) open() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.openLocked()
+}
+
+// the same as open, for use while holding the lock
+func (s *FileStore) openLocked() error {
+	if s.opened {
+		return s.err
+	}
+	s.opened = true
+	if s.path == "" {
+		s.err = errors.New("database: no file configured, set DB_FILE or DATA_DIR")
+		return s.err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		s.err = err
+		return err
+	}
+
+	var good int64 // offset just past the last valid record
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		var rec record
+		if err != nil || json.Unmarshal(bytes.TrimSpace(line), &rec) != nil {
+			break // incomplete write, drop everything from here on
+		}
+		good += int64(len(line))
+		if _, ok := s.data[rec.Key]; ok {
+			s.garbage++
+		}
+		if rec.Deleted {
+			s.remove(rec.Key)
+			s.garbage++
+		} else {
+			s.set(rec.Key, rec.Value)
+		}
+	}
+
+	if err == nil {
+		err = file.Truncate(good)
+	}
+	if err == nil {
+		_, err = file.Seek(good, 0)
+	}
+	if err != nil {
+		file.Close()
+		s.err = err
+		return err
+	}
+	s.file = file
+	s.err = nil
+	return nil
+}
+
+// append writes one record as a single line, the caller must hold the lock.
+func (s *FileStore) append(rec record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err = s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// maybeCompact rewrites the log with only the live records once it has grown
+// large enough, the caller must hold the lock.
+func (s *FileStore) maybeCompact() error {
+	if s.garbage < minCompaction || s.garbage < len(s.keys) {
+		return nil
+	}
+
+	tmpName := s.path + ".tmp"
+	tmp, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, k := range s.keys {
+		line, err := json.Marshal(record{Key: k, Value: s.data[k]})
+		if err == nil {
+			_, err = writer.Write(append(line, '\n'))
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpName)
+			return err
+		}
+	}
+	if err = writer.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpName, s.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+
+	s.file.Close()
+	s.file = tmp // now positioned at the end of the compacted log
+	s.garbage = 0
+	return nil
+}
@@ -0,0 +1,303 @@
+// Gadgets which drop repeated messages, keeping state across restarts if needed.
+package dedup
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/api"
+)
+
+func init() {
+	flow.Registry["Dedup"] = func() flow.Circuitry { return new(Dedup) }
+	flow.Registry["ChangeDetect"] = func() flow.Circuitry { return new(ChangeDetect) }
+}
+
+// Both gadgets in this package can keep their state in the database, so that
+// they carry on where they left off when restarted. To do so, send a name to
+// the Persist pin: state is stored under keys starting with that name and a
+// slash, this needs a "DBReadWriteAPI" provider. Tags are always passed on.
+
+// Dedup drops messages which have been seen before. Messages are compared as a
+// whole, or, if one or more field names are sent to the Fields pin (as string
+// or list), PacketMaps are compared by the values of those fields only.
+// How long messages are remembered is set on the Horizon pin: as a duration,
+// i.e. "10m", counting from when a message was first seen, or as a number of
+// messages, forgetting the oldest ones once there are more. The default is to
+// remember the last 1000 messages. Registers as "Dedup".
+type Dedup struct {
+	flow.Gadget
+	Fields  flow.Input
+	Horizon flow.Input
+	Persist flow.Input
+	In      flow.Input
+	Out     flow.Output
+	Err     flow.Output
+
+	DB    api.IDBReadWriteAPI `gadget:"DBReadWriteAPI,optional"`
+	Clock flow.TimeSource
+}
+
+// one remembered message
+type seen struct {
+	id string
+	t  time.Time
+}
+
+// Start dropping duplicates.
+func (g *Dedup) Run() {
+	var fields []string
+	if m, ok := <-g.Fields; ok {
+		fields = stringsOf(m)
+	}
+	count, age := 1000, time.Duration(0)
+	if m, ok := <-g.Horizon; ok {
+		if n, ok := flow.Int(m); ok && n >= 1 {
+			count = n
+		} else if d, err := flow.ParseDuration(m); err == nil && d > 0 {
+			count, age = 0, d
+		} else {
+			g.Err.Send(g.Error(fmt.Errorf("dedup: bad horizon: %v", m), m))
+		}
+	}
+	clock := g.Clock
+	if clock == nil {
+		clock = flow.SystemTime
+	}
+	db := newStore(g.Persist, g.DB)
+
+	order := list.New() // of seen, oldest first
+	byID := map[string]*list.Element{}
+	forget := func(e *list.Element) {
+		s := order.Remove(e).(seen)
+		delete(byID, s.id)
+		g.report(db.remove(s.id))
+	}
+	remember := func(s seen) {
+		byID[s.id] = order.PushBack(s)
+		for count > 0 && order.Len() > count {
+			forget(order.Front())
+		}
+	}
+	expire := func(now time.Time) {
+		for age > 0 && order.Len() > 0 && now.Sub(order.Front().Value.(seen).t) >= age {
+			forget(order.Front())
+		}
+	}
+
+	saved := map[string]flow.Message{}
+	g.report(db.load(saved))
+	var restored []seen
+	for id, v := range saved {
+		t, _ := time.Parse(time.RFC3339Nano, fmt.Sprint(v))
+		restored = append(restored, seen{id, t})
+	}
+	sort.Sort(byTime(restored))
+	for _, s := range restored {
+		remember(s)
+	}
+
+	for m := range g.In {
+		if _, ok := m.(flow.Tag); ok {
+			g.Out.Send(m)
+			continue
+		}
+		now := clock.Now()
+		expire(now)
+		id := identity(m, fields)
+		if _, ok := byID[id]; ok {
+			continue
+		}
+		remember(seen{id, now})
+		g.report(db.save(id, now.Format(time.RFC3339Nano)))
+		g.Out.Send(m)
+	}
+}
+
+type byTime []seen
+
+func (l byTime) Len() int           { return len(l) }
+func (l byTime) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byTime) Less(i, j int) bool { return l[i].t.Before(l[j].t) }
+
+func (g *Dedup) report(err error) {
+	if err != nil {
+		g.Err.Send(g.Error(err, nil))
+	}
+}
+
+// ChangeDetect only passes on messages in which the field named on the Field
+// pin has changed, compared to the last message passed on. For numbers, the
+// change has to be more than the value set on the Threshold pin (0 by default).
+// Without a field name, whole messages are compared. If a field name is sent
+// to the Key pin, changes are tracked separately for each value of that field,
+// i.e. for each sensor. The first message for each key is always passed on, as
+// are messages without the field. Registers as "ChangeDetect".
+type ChangeDetect struct {
+	flow.Gadget
+	Field     flow.Input
+	Threshold flow.Input
+	Key       flow.Input
+	Persist   flow.Input
+	In        flow.Input
+	Out       flow.Output
+	Err       flow.Output
+
+	DB api.IDBReadWriteAPI `gadget:"DBReadWriteAPI,optional"`
+}
+
+// Start detecting changes.
+func (g *ChangeDetect) Run() {
+	field, key := "", ""
+	if m, ok := <-g.Field; ok {
+		field, _ = m.(string)
+	}
+	threshold := 0.0
+	if m, ok := <-g.Threshold; ok {
+		if n, ok := flow.Number(m); ok && n >= 0 {
+			threshold = n
+		} else {
+			g.Err.Send(g.Error(fmt.Errorf("dedup: bad threshold: %v", m), m))
+		}
+	}
+	if m, ok := <-g.Key; ok {
+		key, _ = m.(string)
+	}
+	db := newStore(g.Persist, g.DB)
+
+	last := map[string]flow.Message{}
+	if err := db.load(last); err != nil {
+		g.Err.Send(g.Error(err, nil))
+	}
+
+	for m := range g.In {
+		value, ok := m, true
+		if _, isTag := m.(flow.Tag); isTag {
+			ok = false
+		} else if field != "" {
+			value, ok = lookup(m, field)
+		}
+		if !ok {
+			g.Out.Send(m)
+			continue
+		}
+		k := ""
+		if key != "" {
+			if v, ok := lookup(m, key); ok {
+				k = fmt.Sprint(v)
+			}
+		}
+		if prev, ok := last[k]; ok && !changed(prev, value, threshold) {
+			continue
+		}
+		last[k] = value
+		if err := db.save(k, value); err != nil {
+			g.Err.Send(g.Error(err, m))
+		}
+		g.Out.Send(m)
+	}
+}
+
+// True if the new value differs from the old one, by more than the threshold
+// for numbers.
+func changed(old, new flow.Message, threshold float64) bool {
+	a, ok1 := flow.Number(old)
+	b, ok2 := flow.Number(new)
+	if ok1 && ok2 {
+		return math.Abs(b-a) > threshold
+	}
+	return identity(old, nil) != identity(new, nil)
+}
+
+// Keeps state in the database, under a common prefix. Does nothing if no
+// prefix has been set, or if there is no database.
+type store struct {
+	prefix string
+	db     api.IDBReadWriteAPI
+}
+
+func newStore(pin flow.Input, db api.IDBReadWriteAPI) *store {
+	s := &store{db: db}
+	if m, ok := <-pin; ok {
+		s.prefix, _ = m.(string)
+	}
+	return s
+}
+
+func (s *store) active() bool {
+	return s.prefix != "" && s.db != nil
+}
+
+// Load all saved values into a map.
+func (s *store) load(into map[string]flow.Message) error {
+	if !s.active() {
+		return nil
+	}
+	// all keys with the prefix and a slash, "0" is the character after "/"
+	from, to := s.prefix+"/", s.prefix+"0"
+	return s.db.Range(from, to, func(key string, value interface{}) bool {
+		into[key[len(from):]] = value
+		return true
+	})
+}
+
+func (s *store) save(key string, value interface{}) error {
+	if !s.active() {
+		return nil
+	}
+	return s.db.Put(s.prefix+"/"+key, value)
+}
+
+func (s *store) remove(key string) error {
+	if !s.active() {
+		return nil
+	}
+	return s.db.Delete(s.prefix + "/" + key)
+}
+
+// A string which is the same for equal messages, or equal values of the given
+// fields, if any. JSON is used for this, since it sorts maps by key, and makes
+// no difference between i.e. int and float64 values.
+func identity(m flow.Message, fields []string) string {
+	if v, ok := m.(flow.PacketMap); ok && len(fields) > 0 {
+		values := make([]interface{}, len(fields))
+		for i, f := range fields {
+			values[i], _ = v.Get(f)
+		}
+		m = values
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Sprintf("%T:%v", m, m)
+	}
+	return string(data)
+}
+
+// Look up a field in a PacketMap, see PacketMap.Get.
+func lookup(m flow.Message, field string) (interface{}, bool) {
+	if v, ok := m.(flow.PacketMap); ok {
+		return v.Get(field)
+	}
+	return nil, false
+}
+
+func stringsOf(m flow.Message) (r []string) {
+	switch v := m.(type) {
+	case string:
+		r = []string{v}
+	case []string:
+		r = v
+	case []interface{}:
+		for _, x := range v {
+			if s, ok := x.(string); ok {
+				r = append(r, s)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,188 @@
+package dedup
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/flowtest"
+	"github.com/laughlinez/flow/gadgets/database"
+)
+
+// Importing the database package registers its provider, which needs a place
+// for its file, even when the gadgets end up not using it.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "dedup")
+	if err != nil {
+		panic(err)
+	}
+	flow.Config["DATA_DIR"] = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func ExampleDedup() {
+	g := flow.NewCircuit()
+	g.Add("d", "Dedup")
+	g.AddCircuitry("p", flow.Sink(func(m flow.Message) { fmt.Println(m) }))
+	g.Connect("d.Out", "p.In", 0)
+	g.Feed("d.In", 1)
+	g.Feed("d.In", 2)
+	g.Feed("d.In", 1)
+	g.Feed("d.In", 3.0)
+	g.Feed("d.In", 3)
+	g.Run()
+	// Output:
+	// 1
+	// 2
+	// 3
+}
+
+func ExampleChangeDetect() {
+	g := flow.NewCircuit()
+	g.Add("c", "ChangeDetect")
+	g.AddCircuitry("p", flow.Sink(func(m flow.Message) { fmt.Println(m) }))
+	g.Connect("c.Out", "p.In", 0)
+	g.Feed("c.Field", "temp")
+	g.Feed("c.Threshold", 0.5)
+	g.Feed("c.In", flow.PacketMap{"temp": 20.0})
+	g.Feed("c.In", flow.PacketMap{"temp": 20.3})
+	g.Feed("c.In", flow.PacketMap{"temp": 20.6})
+	g.Feed("c.In", flow.PacketMap{"temp": 19.9})
+	g.Run()
+	// Output:
+	// map[temp:20]
+	// map[temp:20.6]
+	// map[temp:19.9]
+}
+
+func run(setup func(g *flow.Circuit), in ...flow.Message) []flow.Message {
+	g := flow.NewCircuit()
+	out := new(flowtest.Collector)
+	setup(g)
+	g.AddCircuitry("o", out)
+	g.Connect("d.Out", "o.In", 0)
+	for _, m := range in {
+		g.Feed("d.In", m)
+	}
+	g.Run()
+	return out.Msgs
+}
+
+func TestDedupFields(t *testing.T) {
+	got := run(func(g *flow.Circuit) {
+		g.Add("d", "Dedup")
+		g.Feed("d.Fields", []interface{}{"id", "v"})
+	},
+		flow.PacketMap{"id": 1, "v": 10, "at": 1},
+		flow.PacketMap{"id": 1, "v": 10, "at": 2},
+		flow.Tag{"x", 1},
+		flow.PacketMap{"id": 2, "v": 10, "at": 3},
+		flow.PacketMap{"id": 1, "v": 11, "at": 4},
+	)
+	want := []flow.Message{
+		flow.PacketMap{"id": 1, "v": 10, "at": 1},
+		flow.Tag{"x", 1},
+		flow.PacketMap{"id": 2, "v": 10, "at": 3},
+		flow.PacketMap{"id": 1, "v": 11, "at": 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDedupCount(t *testing.T) {
+	got := run(func(g *flow.Circuit) {
+		g.Add("d", "Dedup")
+		g.Feed("d.Horizon", 2)
+	}, "a", "b", "a", "c", "a", "b")
+	want := []flow.Message{"a", "b", "c", "a", "b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDedupPersist(t *testing.T) {
+	db := database.NewMemStore()
+	clock := flow.NewManualTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	dedup := func(g *flow.Circuit) {
+		g.AddCircuitry("d", &Dedup{DB: db, Clock: clock})
+		g.Feed("d.Horizon", "1m")
+		g.Feed("d.Persist", "dd")
+	}
+
+	if got := run(dedup, "a", "b", "a"); len(got) != 2 {
+		t.Fatalf("first run: got %v", got)
+	}
+	if keys, _ := db.Keys("dd/"); len(keys) != 2 {
+		t.Fatalf("expected 2 saved keys, got %v", keys)
+	}
+
+	// a restart remembers what was seen before
+	clock.Advance(30 * time.Second)
+	if got := run(dedup, "a", "c"); !reflect.DeepEqual(got, []flow.Message{"c"}) {
+		t.Errorf("second run: got %v", got)
+	}
+
+	// but only within the horizon, "c" was first seen 30s later than "a"
+	clock.Advance(40 * time.Second)
+	got := run(dedup, "a", "b", "c")
+	if !reflect.DeepEqual(got, []flow.Message{"a", "b"}) {
+		t.Errorf("third run: got %v", got)
+	}
+	if keys, _ := db.Keys("dd/"); len(keys) != 3 {
+		t.Errorf("expected 3 saved keys, got %v", keys)
+	}
+}
+
+func TestChangeDetectKey(t *testing.T) {
+	db := database.NewMemStore()
+	detect := func(g *flow.Circuit) {
+		g.AddCircuitry("d", &ChangeDetect{DB: db})
+		g.Feed("d.Field", "v")
+		g.Feed("d.Key", "id")
+		g.Feed("d.Persist", "cd")
+	}
+
+	got := run(detect,
+		flow.PacketMap{"id": "a", "v": 1},
+		flow.PacketMap{"id": "b", "v": 1},
+		flow.PacketMap{"id": "a", "v": 1},
+		flow.PacketMap{"id": "b", "v": 2},
+		flow.PacketMap{"id": "a"},
+		"text",
+	)
+	want := []flow.Message{
+		flow.PacketMap{"id": "a", "v": 1},
+		flow.PacketMap{"id": "b", "v": 1},
+		flow.PacketMap{"id": "b", "v": 2},
+		flow.PacketMap{"id": "a"},
+		"text",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// values are restored from the database on restart
+	got = run(detect,
+		flow.PacketMap{"id": "a", "v": 1},
+		flow.PacketMap{"id": "b", "v": 3},
+	)
+	want = []flow.Message{flow.PacketMap{"id": "b", "v": 3}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after restart: got %v, want %v", got, want)
+	}
+}
+
+func TestChangeDetectStrings(t *testing.T) {
+	got := run(func(g *flow.Circuit) {
+		g.Add("d", "ChangeDetect")
+	}, "on", "on", "off", "off", "on")
+	if want := []flow.Message{"on", "off", "on"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,240 @@
+// File access for gadgets, offered to other gadgets as "FilesystemAPI".
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/api"
+)
+
+func init() {
+	flow.Registry["FilesystemProvider"] = func() flow.Circuitry {
+		fs := NewDirFS(flow.Config["FS_ROOT"])
+		if fs.root == "" {
+			fs.data = flow.Config["DATA_DIR"]
+		}
+		return &FilesystemProvider{FS: fs}
+	}
+	flow.Registry["MemFilesystemProvider"] = func() flow.Circuitry {
+		return NewMemFilesystemProvider()
+	}
+}
+
+// FilesystemProvider gives each gadget requesting "FilesystemAPI" its own DirFS.
+// When the FS_ROOT config setting is set, each gadget is confined to a sandbox
+// below it, named after the gadget's path and name in the circuit. Without
+// FS_ROOT, files are accessed as is, with relative names resolved against the
+// DATA_DIR config setting. Registers as "FilesystemProvider".
+type FilesystemProvider struct {
+	flow.Gadget
+	FS api.IFileSystemAPI `flowapi:"FilesystemAPI,new"`
+}
+
+// Nothing to do, all the work happens in the consumers.
+func (g *FilesystemProvider) Run() {}
+
+// MemFilesystemProvider offers a MemFS as "FilesystemAPI" under the name
+// "memory", with all gadgets sharing the same files. Consumers select it with
+// `gadget:"FilesystemAPI,name=memory"`. Registers as "MemFilesystemProvider".
+type MemFilesystemProvider struct {
+	flow.Gadget
+	FS api.IFileSystemAPI `flowapi:"FilesystemAPI,name=memory"`
+}
+
+// NewMemFilesystemProvider returns a provider with its own empty MemFS.
+func NewMemFilesystemProvider() *MemFilesystemProvider {
+	return &MemFilesystemProvider{FS: NewMemFS()}
+}
+
+// Nothing to do, the files live in memory.
+func (g *MemFilesystemProvider) Run() {}
+
+// DirFS accesses files in the real filesystem, below a root directory.
+type DirFS struct {
+	root string // empty means no confinement
+	data string // relative names are resolved against this, if not confined
+}
+
+// NewDirFS returns a filesystem confined to root, or unconfined if root is "".
+func NewDirFS(root string) *DirFS {
+	return &DirFS{root: root}
+}
+
+// InitAPI is called with the gadget's name and path, the sandbox for that
+// gadget is the directory matching its path plus its name, below the root.
+func (fs *DirFS) InitAPI(args ...interface{}) {
+	if len(args) >= 2 && fs.root != "" {
+		name, _ := args[0].(string)
+		path, _ := args[1].(string)
+		fs.root = filepath.Join(fs.root, filepath.FromSlash(path), name)
+	}
+}
+
+// Root returns the directory all names are resolved against.
+func (fs *DirFS) Root() string {
+	return fs.root
+}
+
+// Start creates the sandbox directory, if there is one.
+func (fs *DirFS) Start() error {
+	if fs.root == "" {
+		return nil
+	}
+	return os.MkdirAll(fs.root, 0777)
+}
+
+// Health checks that the sandbox directory is still there.
+func (fs *DirFS) Health() error {
+	if fs.root == "" {
+		return nil
+	}
+	_, err := os.Stat(fs.root)
+	return err
+}
+
+// turn a name into a real path, which can never lie outside the root
+func (fs *DirFS) resolve(name string) string {
+	if fs.root == "" {
+		if fs.data != "" && !filepath.IsAbs(name) {
+			return filepath.Join(fs.data, filepath.FromSlash(name))
+		}
+		return name
+	}
+	return filepath.Join(fs.root, filepath.Clean("/"+filepath.FromSlash(name)))
+}
+
+// turn a real path back into a name, relative to the root
+func (fs *DirFS) unresolve(path string) string {
+	if fs.root == "" {
+		if fs.data != "" {
+			rel, err := filepath.Rel(fs.data, path)
+			if err == nil && !strings.HasPrefix(rel, "..") {
+				return filepath.ToSlash(rel)
+			}
+		}
+		return path
+	}
+	rel, err := filepath.Rel(fs.root, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Open a file for reading.
+func (fs *DirFS) Open(name string) (api.File, error) {
+	return os.Open(fs.resolve(name))
+}
+
+// Create or truncate a file for writing, missing directories are created.
+func (fs *DirFS) Create(name string) (api.File, error) {
+	path := fs.resolve(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+// Append opens a file for writing at its end, it is created if necessary.
+func (fs *DirFS) Append(name string) (api.File, error) {
+	path := fs.resolve(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+}
+
+// ReadDir lists the entries of a directory, sorted by name.
+func (fs *DirFS) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(fs.resolve(name))
+}
+
+// Stat returns information about a file or directory.
+func (fs *DirFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(fs.resolve(name))
+}
+
+// Remove a file or an empty directory.
+func (fs *DirFS) Remove(name string) error {
+	return os.Remove(fs.resolve(name))
+}
+
+// Rename a file, replacing the target if it exists.
+func (fs *DirFS) Rename(from, to string) error {
+	path := fs.resolve(to)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return os.Rename(fs.resolve(from), path)
+}
+
+// Watch a file or directory, and report changes until stop is called.
+func (fs *DirFS) Watch(name string, events chan<- api.FileEvent) (func(), error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err = watcher.Add(fs.resolve(name)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				op, ok := opOf(ev)
+				if !ok {
+					continue // only attributes changed
+				}
+				event := api.FileEvent{Name: fs.unresolve(ev.Name), Op: op}
+				select {
+				case events <- event:
+				case <-done:
+					return
+				}
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				// nothing useful to do with these
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var stop sync.Once
+	return func() {
+		stop.Do(func() {
+			close(done)
+			watcher.Close()
+		})
+	}, nil
+}
+
+// map an fsnotify event to its operation, false if there is nothing to report
+func opOf(ev fsnotify.Event) (api.FileOp, bool) {
+	switch {
+	case ev.Op&fsnotify.Create != 0:
+		return api.FileCreate, true
+	case ev.Op&fsnotify.Remove != 0:
+		return api.FileRemove, true
+	case ev.Op&fsnotify.Rename != 0:
+		return api.FileRename, true
+	case ev.Op&fsnotify.Write != 0:
+		return api.FileWrite, true
+	}
+	return "", false
+}
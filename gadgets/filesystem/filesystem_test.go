@@ -0,0 +1,178 @@
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/api"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+	events := make(chan api.FileEvent, 10)
+	stop, err := fs.Watch("", events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.Create("a/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("hello"))
+	f.Close()
+
+	if ev := <-events; ev != (api.FileEvent{Name: "a", Op: api.FileCreate}) {
+		t.Errorf("unexpected event: %v", ev)
+	}
+	stop()
+
+	list, err := fs.ReadDir("/a")
+	if err != nil || len(list) != 1 || list[0].Name() != "b.txt" || list[0].Size() != 5 {
+		t.Errorf("unexpected directory listing: %v (%v)", list, err)
+	}
+
+	f, _ = fs.Open("a/../a/b.txt")
+	data, _ := ioutil.ReadAll(f)
+	if string(data) != "hello" {
+		t.Errorf("unexpected contents: %q", data)
+	}
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Error("write to a file opened for reading should fail")
+	}
+
+	if err := fs.Remove("a"); err == nil {
+		t.Error("removing a non-empty directory should fail")
+	}
+	fs.Remove("a/b.txt")
+	if _, err := fs.Stat("a/b.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected file to be gone, got %v", err)
+	}
+}
+
+func TestDirFSConfinement(t *testing.T) {
+	root, err := ioutil.TempDir("", "flowfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	fs := NewDirFS(root)
+	fs.InitAPI("r", "/main/")
+	if fs.Root() != filepath.Join(root, "main", "r") {
+		t.Errorf("unexpected sandbox: %s", fs.Root())
+	}
+
+	f, err := fs.Create("../../escape.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := os.Stat(filepath.Join(root, "main", "r", "escape.txt")); err != nil {
+		t.Errorf("file was not created inside the sandbox: %v", err)
+	}
+	if list, _ := fs.ReadDir("/"); len(list) != 1 {
+		t.Errorf("unexpected directory listing: %v", list)
+	}
+}
+
+// creates a file named after itself, then lists all the files it can see
+type lister struct {
+	flow.Gadget
+	FS api.IFileSystemAPI `gadget:"FilesystemAPI"`
+
+	seen []string
+}
+
+func (g *lister) Run() {
+	if f, err := g.FS.Create(g.Name() + ".txt"); err == nil {
+		f.Close()
+	}
+	list, _ := g.FS.ReadDir("/")
+	for _, info := range list {
+		g.seen = append(g.seen, info.Name())
+	}
+}
+
+func TestDirFSSiblings(t *testing.T) {
+	root, err := ioutil.TempDir("", "flowfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer delete(flow.Config, "FS_ROOT")
+	flow.Config["FS_ROOT"] = root
+
+	a, b := new(lister), new(lister)
+	g := flow.NewCircuit()
+	g.AddCircuitry("a", a)
+	g.AddCircuitry("b", b)
+	g.Run()
+
+	if len(a.seen) != 1 || a.seen[0] != "a.txt" {
+		t.Errorf("a should only see its own file, got %v", a.seen)
+	}
+	if len(b.seen) != 1 || b.seen[0] != "b.txt" {
+		t.Errorf("b should only see its own file, got %v", b.seen)
+	}
+}
+
+func TestMemFSAppend(t *testing.T) {
+	fs := NewMemFS()
+	for _, s := range []string{"abc", "def"} {
+		f, err := fs.Append("log/a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(s))
+		f.Close()
+	}
+	if err := fs.Rename("log/a.txt", "old/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("log/a.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected file to be renamed, got %v", err)
+	}
+	f, _ := fs.Open("old/a.txt")
+	data, _ := ioutil.ReadAll(f)
+	if string(data) != "abcdef" {
+		t.Errorf("unexpected contents: %q", data)
+	}
+}
+
+func TestDirFSDataDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer delete(flow.Config, "DATA_DIR")
+	flow.Config["DATA_DIR"] = filepath.Join(dir, "data")
+
+	fs := flow.Registry["FilesystemProvider"]().(*FilesystemProvider).FS.(*DirFS)
+	f, err := fs.Create("logs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := os.Stat(filepath.Join(dir, "data", "logs", "a.txt")); err != nil {
+		t.Errorf("expected file below DATA_DIR: %v", err)
+	}
+	if p := fs.resolve("/tmp/a.txt"); p != "/tmp/a.txt" {
+		t.Errorf("unexpected path: %s", p)
+	}
+	if n := fs.unresolve(filepath.Join(dir, "data", "logs", "a.txt")); n != "logs/a.txt" {
+		t.Errorf("unexpected name: %s", n)
+	}
+
+	// DATA_DIR does not apply inside a sandbox
+	defer delete(flow.Config, "FS_ROOT")
+	flow.Config["FS_ROOT"] = filepath.Join(dir, "root")
+	fs = flow.Registry["FilesystemProvider"]().(*FilesystemProvider).FS.(*DirFS)
+	if p := fs.resolve("logs/a.txt"); p != filepath.Join(dir, "root", "logs", "a.txt") {
+		t.Errorf("unexpected path: %s", p)
+	}
+}
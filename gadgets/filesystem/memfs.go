@@ -0,0 +1,344 @@
+package filesystem
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/laughlinez/flow/api"
+)
+
+// MemFS is a filesystem which only exists in memory, mostly useful for tests.
+// Directories are created implicitly by creating files in them.
+type MemFS struct {
+	mu       sync.Mutex
+	nodes    map[string]*memNode // all files and directories, by clean name
+	watchers map[*memWatch]bool
+}
+
+type memNode struct {
+	data    []byte
+	dir     bool
+	modTime time.Time
+}
+
+type memWatch struct {
+	name   string
+	events chan<- api.FileEvent
+	done   chan struct{}
+}
+
+// NewMemFS returns an empty filesystem, with only a root directory.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		nodes:    map[string]*memNode{"": {dir: true, modTime: time.Now()}},
+		watchers: map[*memWatch]bool{},
+	}
+}
+
+// names in a MemFS are always clean, slash-separated, and without leading "/"
+func cleanName(name string) string {
+	name = path.Clean("/" + name)
+	return name[1:]
+}
+
+// InitAPI does nothing, all gadgets share the same files.
+func (fs *MemFS) InitAPI(args ...interface{}) {}
+
+// Open a file for reading.
+func (fs *MemFS) Open(name string) (api.File, error) {
+	name = cleanName(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node := fs.nodes[name]
+	if node == nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &memFile{fs: fs, name: name, node: node}, nil
+}
+
+// Create or truncate a file for writing, missing directories are created.
+func (fs *MemFS) Create(name string) (api.File, error) {
+	return fs.openWrite("create", name, true)
+}
+
+// Append opens a file for writing at its end, it is created if necessary.
+func (fs *MemFS) Append(name string) (api.File, error) {
+	return fs.openWrite("append", name, false)
+}
+
+func (fs *MemFS) openWrite(what, name string, truncate bool) (api.File, error) {
+	name = cleanName(name)
+	fs.mu.Lock()
+	node := fs.nodes[name]
+	if node != nil && node.dir {
+		fs.mu.Unlock()
+		return nil, &os.PathError{Op: what, Path: name, Err: errors.New("is a directory")}
+	}
+	created := fs.makeDirs(name)
+	op := api.FileWrite
+	if node == nil {
+		node = &memNode{modTime: time.Now()}
+		fs.nodes[name] = node
+		op = api.FileCreate
+	}
+	if truncate {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+	pos := int64(len(node.data))
+	fs.mu.Unlock()
+
+	for i := len(created) - 1; i >= 0; i-- {
+		fs.notify(created[i], api.FileCreate)
+	}
+	if truncate || op == api.FileCreate {
+		fs.notify(name, op)
+	}
+	return &memFile{fs: fs, name: name, node: node, pos: pos, write: true}, nil
+}
+
+// create all missing parent directories, innermost first, must hold the lock
+func (fs *MemFS) makeDirs(name string) (created []string) {
+	for dir := path.Dir("/" + name)[1:]; fs.nodes[dir] == nil; dir = path.Dir("/" + dir)[1:] {
+		fs.nodes[dir] = &memNode{dir: true, modTime: time.Now()}
+		created = append(created, dir)
+	}
+	return
+}
+
+// ReadDir lists the entries of a directory, sorted by name.
+func (fs *MemFS) ReadDir(name string) ([]os.FileInfo, error) {
+	name = cleanName(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if node := fs.nodes[name]; node == nil || !node.dir {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	list := []os.FileInfo{}
+	for n, node := range fs.nodes {
+		if n != "" && path.Dir("/" + n)[1:] == name {
+			list = append(list, node.info(n))
+		}
+	}
+	sort.Sort(byName(list))
+	return list, nil
+}
+
+// Stat returns information about a file or directory.
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = cleanName(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node := fs.nodes[name]
+	if node == nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return node.info(name), nil
+}
+
+// Remove a file or an empty directory.
+func (fs *MemFS) Remove(name string) error {
+	name = cleanName(name)
+	fs.mu.Lock()
+	node := fs.nodes[name]
+	if node == nil || name == "" {
+		fs.mu.Unlock()
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if node.dir {
+		for n := range fs.nodes {
+			if n != "" && path.Dir("/" + n)[1:] == name {
+				fs.mu.Unlock()
+				return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+			}
+		}
+	}
+	delete(fs.nodes, name)
+	fs.mu.Unlock()
+
+	fs.notify(name, api.FileRemove)
+	return nil
+}
+
+// Rename a file, replacing the target if it exists.
+func (fs *MemFS) Rename(from, to string) error {
+	from, to = cleanName(from), cleanName(to)
+	fs.mu.Lock()
+	node := fs.nodes[from]
+	if node == nil || node.dir {
+		fs.mu.Unlock()
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrNotExist}
+	}
+	if target := fs.nodes[to]; target != nil && target.dir {
+		fs.mu.Unlock()
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: errors.New("is a directory")}
+	}
+	created := fs.makeDirs(to)
+	delete(fs.nodes, from)
+	fs.nodes[to] = node
+	fs.mu.Unlock()
+
+	fs.notify(from, api.FileRename)
+	for i := len(created) - 1; i >= 0; i-- {
+		fs.notify(created[i], api.FileCreate)
+	}
+	fs.notify(to, api.FileCreate)
+	return nil
+}
+
+// Watch a file or directory, and report changes until stop is called. As
+// with a real filesystem, watching a directory reports changes to its entries.
+func (fs *MemFS) Watch(name string, events chan<- api.FileEvent) (func(), error) {
+	name = cleanName(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.nodes[name] == nil {
+		return nil, &os.PathError{Op: "watch", Path: name, Err: os.ErrNotExist}
+	}
+	w := &memWatch{name: name, events: events, done: make(chan struct{})}
+	fs.watchers[w] = true
+	return func() {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		if fs.watchers[w] {
+			delete(fs.watchers, w)
+			close(w.done)
+		}
+	}, nil
+}
+
+// send an event to all matching watchers, must be called without the lock
+func (fs *MemFS) notify(name string, op api.FileOp) {
+	fs.mu.Lock()
+	matches := []*memWatch{}
+	for w := range fs.watchers {
+		if w.name == name || (name != "" && path.Dir("/" + name)[1:] == w.name) {
+			matches = append(matches, w)
+		}
+	}
+	fs.mu.Unlock()
+
+	for _, w := range matches {
+		select {
+		case w.events <- api.FileEvent{Name: name, Op: op}:
+		case <-w.done:
+		}
+	}
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	return &memInfo{name: path.Base("/" + name), size: int64(len(n.data)),
+		dir: n.dir, modTime: n.modTime, node: n}
+}
+
+// memFile is an open file, with its own read/write position.
+type memFile struct {
+	fs     *MemFS
+	name   string
+	node   *memNode
+	pos    int64
+	write  bool
+	closed bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.node.dir {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+	}
+	if f.pos >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if !f.write {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	f.fs.mu.Lock()
+	end := f.pos + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	copy(f.node.data[f.pos:], p)
+	f.pos = end
+	f.node.modTime = time.Now()
+	f.fs.mu.Unlock()
+
+	f.fs.notify(f.name, api.FileWrite)
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return f.pos, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrInvalid}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.node.info(f.name), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+	node    *memNode // identifies the file, also after renaming it
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.dir }
+func (i *memInfo) Sys() interface{}   { return i.node }
+
+func (i *memInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0777
+	}
+	return 0666
+}
+
+type byName []os.FileInfo
+
+func (l byName) Len() int           { return len(l) }
+func (l byName) Less(i, j int) bool { return l[i].Name() < l[j].Name() }
+func (l byName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
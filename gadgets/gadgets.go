@@ -4,17 +4,29 @@ package gadgets
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
-	"code.google.com/p/go.exp/fsnotify" // supposedly will be std in Go1.3
 
         "github.com/golang/glog"
 	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/api"
+	_ "github.com/laughlinez/flow/codec"
+	_ "github.com/laughlinez/flow/gadgets/dedup"
+	_ "github.com/laughlinez/flow/gadgets/filesystem"
+	_ "github.com/laughlinez/flow/gadgets/join"
+	_ "github.com/laughlinez/flow/gadgets/logfile"
 	_ "github.com/laughlinez/flow/gadgets/pipe"
+	_ "github.com/laughlinez/flow/gadgets/rate"
+	_ "github.com/laughlinez/flow/gadgets/router"
+	_ "github.com/laughlinez/flow/gadgets/watch"
+	_ "github.com/laughlinez/flow/gadgets/window"
 
 )
 
@@ -34,9 +46,13 @@ func init() {
 	flow.Registry["WatchFile"] = func() flow.Circuitry { return new(WatchFile) }
 	flow.Registry["ReadFileText"] = func() flow.Circuitry { return new(ReadFileText) }
 	flow.Registry["ReadFileJSON"] = func() flow.Circuitry { return new(ReadFileJSON) }
+	flow.Registry["WriteFileText"] = func() flow.Circuitry { return new(WriteFileText) }
+	flow.Registry["WriteFileJSON"] = func() flow.Circuitry { return new(WriteFileJSON) }
 	flow.Registry["EnvVar"] = func() flow.Circuitry { return new(EnvVar) }
 	flow.Registry["CmdLine"] = func() flow.Circuitry { return new(CmdLine) }
 	flow.Registry["Concat3"] = func() flow.Circuitry { return new(Concat3) }
+	flow.Registry["Concat"] = func() flow.Circuitry { return new(Concat) }
+	flow.Registry["Merge"] = func() flow.Circuitry { return new(Merge) }
 	flow.Registry["AddTag"] = func() flow.Circuitry { return new(AddTag) }
 }
 
@@ -137,13 +153,17 @@ type Timer struct {
 	flow.Gadget
 	In  flow.Input
 	Out flow.Output
+	Err flow.Output
 }
 
 // Start the timer, sends one message when it expires.
 func (w *Timer) Run() {
 	if r, ok := <-w.In; ok {
-		rate, err := time.ParseDuration(r.(string))
-		flow.Check(err)
+		rate, err := flow.ParseDuration(r)
+		if err != nil {
+			w.Err.Send(w.Error(err, r))
+			return
+		}
 		t := <-time.After(rate)
 		w.Out.Send(t)
 	}
@@ -155,13 +175,20 @@ type Clock struct {
 	flow.Gadget
 	In  flow.Input
 	Out flow.Output
+	Err flow.Output
 }
 
 // Start sending out periodic messages, once the rate is known.
 func (w *Clock) Run() {
 	if r, ok := <-w.In; ok {
-		rate, err := time.ParseDuration(r.(string))
-		flow.Check(err)
+		rate, err := flow.ParseDuration(r)
+		if err == nil && rate <= 0 {
+			err = fmt.Errorf("rate must be positive: %v", rate)
+		}
+		if err != nil {
+			w.Err.Send(w.Error(err, r))
+			return
+		}
 		t := time.NewTicker(rate)
 		defer t.Stop()
 		for m := range t.C {
@@ -178,7 +205,8 @@ type FanOut struct {
 	Out map[string]flow.Output
 }
 
-// Start sending out messages to all output pins (does not make copies of them).
+// Start sending out messages to all output pins (does not make copies of them,
+// use copying wires if the receiving gadgets might change the messages).
 func (w *FanOut) Run() {
 	for m := range w.In {
 		for _, o := range w.Out {
@@ -187,7 +215,8 @@ func (w *FanOut) Run() {
 	}
 }
 
-// Forever does just what the name says: run forever (and do nothing at all)
+// Forever does just what the name says: run forever (and do nothing at all),
+// or at least until the circuit is cancelled.
 type Forever struct {
 	flow.Gadget
 	Out flow.Output
@@ -195,7 +224,7 @@ type Forever struct {
 
 // Start running forever, the output stays open and never sends anything.
 func (w *Forever) Run() {
-	<-make(chan struct{})
+	<-w.Done()
 }
 
 // Send data out after a certain delay.
@@ -204,11 +233,18 @@ type Delay struct {
 	In    flow.Input
 	Delay flow.Input
 	Out   flow.Output
+	Err   flow.Output
 }
 
 // Parse the delay, then throttle each incoming message.
 func (g *Delay) Run() {
-	delay, _ := time.ParseDuration((<-g.Delay).(string))
+	var delay time.Duration
+	if r, ok := <-g.Delay; ok {
+		var err error
+		if delay, err = flow.ParseDuration(r); err != nil {
+			g.Err.Send(g.Error(err, r)) // carry on without delay
+		}
+	}
 	for m := range g.In {
 		time.Sleep(delay)
 		g.Out.Send(m)
@@ -233,28 +269,42 @@ func (w *TimeStamp) Run() {
 // WatchFile takes strings that are filenames and outputs them unchanged, but then
 // continues to watch the files and if any changes it re-emits the filename. This is
 // useful upsteam of a ReadFile* gadget which will then re-read and re-emint the file
-// contents.
+// contents. Stops watching once the input closes, or the circuit is cancelled. Use
+// WatchDir (in gadgets/watch) to get the details of each change.
+// Registers as "WatchFile".
 type WatchFile struct {
 	flow.Gadget
 	In  flow.Input
 	Out flow.Output
+	Err flow.Output
+
+	FS api.IFileSystemAPI `gadget:"FilesystemAPI"`
 }
 
 // Read filenames, emit them, add to watcher, and then re-emit anytime the watcher fires
 func (w *WatchFile) Run() {
-	watcher, err := fsnotify.NewWatcher()
-	flow.Check(err)
+	events := make(chan api.FileEvent)
 	for {
 		select {
 		// Got a filename, emit it and add to watcher
-		case m := <-w.In:
+		case m, ok := <-w.In:
+			if !ok {
+				return
+			}
 			w.Out.Send(m)
 			if name, ok := m.(string); ok {
-				watcher.Watch(name)
+				stop, err := w.FS.Watch(name, events)
+				if err != nil {
+					w.Err.Send(w.Error(err, m))
+					continue
+				}
+				defer stop()
 			}
 		// Event on one of the files, just re-emit the filename
-		case ev := <-watcher.Event:
+		case ev := <-events:
 			w.Out.Send(ev.Name)
+		case <-w.Done():
+			return
 		}
 	}
 }
@@ -265,19 +315,29 @@ type ReadFileText struct {
 	flow.Gadget
 	In  flow.Input
 	Out flow.Output
+	Err flow.Output
+
+	FS api.IFileSystemAPI `gadget:"FilesystemAPI"`
 }
 
 // Start reading filenames and emit their text lines, with <open>/<close> tags.
 func (w *ReadFileText) Run() {
 	for m := range w.In {
 		if name, ok := m.(string); ok {
-			file, err := os.Open(name)
-			flow.Check(err)
+			file, err := w.FS.Open(name)
+			if err != nil {
+				w.Err.Send(w.Error(err, m))
+				continue
+			}
 			scanner := bufio.NewScanner(file)
 			w.Out.Send(flow.Tag{"<open>", name})
 			for scanner.Scan() {
 				w.Out.Send(scanner.Text())
 			}
+			file.Close()
+			if err := scanner.Err(); err != nil {
+				w.Err.Send(w.Error(err, m))
+			}
 			w.Out.Send(flow.Tag{"<close>", name})
 		} else {
 			w.Out.Send(m)
@@ -291,24 +351,140 @@ type ReadFileJSON struct {
 	flow.Gadget
 	In  flow.Input
 	Out flow.Output
+	Err flow.Output
+
+	FS api.IFileSystemAPI `gadget:"FilesystemAPI"`
 }
 
 // Start reading filenames and emit a <file> tag followed by the decoded JSON.
 func (w *ReadFileJSON) Run() {
 	for m := range w.In {
 		if name, ok := m.(string); ok {
-			data, err := ioutil.ReadFile(name)
-			flow.Check(err)
-			w.Out.Send(flow.Tag{"<file>", name})
+			file, err := w.FS.Open(name)
+			if err != nil {
+				w.Err.Send(w.Error(err, m))
+				continue
+			}
+			data, err := ioutil.ReadAll(file)
+			file.Close()
 			var any interface{}
-			err = json.Unmarshal(data, &any)
-			flow.Check(err)
+			if err == nil {
+				err = json.Unmarshal(data, &any)
+			}
+			if err != nil {
+				w.Err.Send(w.Error(err, m))
+				continue
+			}
+			w.Out.Send(flow.Tag{"<file>", name})
 			m = any
 		}
 		w.Out.Send(m)
 	}
 }
 
+// WriteFileText appends incoming strings as lines to a file, other values are
+// written as printed by fmt. The file is set by the File pin, and switched by
+// <open> tags, as emitted by ReadFileText, and closed again by <close> tags,
+// after which the file set by the File pin is used again, if there is one.
+// Other tags are reported on the Err pin, as are messages without a file.
+// Names are resolved by the filesystem, see filesystem.FilesystemProvider.
+// Registers as "WriteFileText".
+type WriteFileText struct {
+	flow.Gadget
+	File flow.Input
+	In   flow.Input
+	Err  flow.Output
+
+	FS api.IFileSystemAPI `gadget:"FilesystemAPI"`
+}
+
+// Start appending lines to files.
+func (w *WriteFileText) Run() {
+	writeFiles(&w.Gadget, w.FS, w.File, w.In, w.Err, func(m flow.Message) ([]byte, error) {
+		return []byte(fmt.Sprintln(m)), nil
+	})
+}
+
+// WriteFileJSON appends incoming messages to a file as JSON, one per line.
+// The file is selected in the same way as for WriteFileText, and can also be
+// switched by <file> tags, as emitted by ReadFileJSON.
+// Registers as "WriteFileJSON".
+type WriteFileJSON struct {
+	flow.Gadget
+	File flow.Input
+	In   flow.Input
+	Err  flow.Output
+
+	FS api.IFileSystemAPI `gadget:"FilesystemAPI"`
+}
+
+// Start appending JSON lines to files.
+func (w *WriteFileJSON) Run() {
+	writeFiles(&w.Gadget, w.FS, w.File, w.In, w.Err, func(m flow.Message) ([]byte, error) {
+		data, err := json.Marshal(m)
+		return append(data, '\n'), err
+	})
+}
+
+// the loop shared by all file writers, format turns a message into file data
+func writeFiles(g *flow.Gadget, fs api.IFileSystemAPI, name, in flow.Input,
+	errs flow.Output, format func(flow.Message) ([]byte, error)) {
+	var file api.File
+	report := func(err error, m flow.Message) {
+		if err != nil {
+			errs.Send(g.Error(err, m))
+		}
+	}
+	closeFile := func(m flow.Message) {
+		if file != nil {
+			report(file.Close(), m)
+			file = nil
+		}
+	}
+	openFile := func(m flow.Message) {
+		closeFile(m)
+		if s, ok := m.(string); ok {
+			var err error
+			file, err = fs.Append(s)
+			report(err, m)
+		} else {
+			report(fmt.Errorf("expected a file name, got %T", m), m)
+		}
+	}
+
+	var dflt flow.Message // the file from the name pin, if any
+	if m, ok := <-name; ok {
+		dflt = m
+		openFile(m)
+	}
+	for m := range in {
+		if tag, ok := m.(flow.Tag); ok {
+			switch tag.Tag {
+			case "<open>", "<file>":
+				openFile(tag.Msg)
+			case "<close>":
+				closeFile(m)
+				if dflt != nil {
+					openFile(dflt)
+				}
+			default:
+				report(fmt.Errorf("unexpected tag: %s", tag.Tag), m)
+			}
+			continue
+		}
+		if file == nil {
+			report(errors.New("no file to write to"), m)
+			continue
+		}
+		data, err := format(m)
+		if err == nil {
+			_, err = file.Write(data)
+		}
+		report(err, m)
+	}
+	closeFile(nil)
+}
+
 // Lookup an environment variable, with optional default. Registers as "EnvVar".
 type EnvVar struct {
 	flow.Gadget
@@ -380,7 +556,7 @@ func (g *CmdLine) Run() {
 	}
 }
 
-// Until general collection is possible, this concatenates three input pins.
+// Concat3 concatenates three input pins, it has been superseded by Concat.
 // Registers as "Concat3".
 type Concat3 struct {
 	flow.Gadget
@@ -403,6 +579,51 @@ func (g *Concat3) Run() {
 	}
 }
 
+// Concat concatenates any number of inputs, which are set up as map. Inputs
+// are read one after the other, sorted by their key. Registers as "Concat".
+type Concat struct {
+	flow.Gadget
+	In  map[string]flow.Input
+	Out flow.Output
+}
+
+// Start waiting on each input in key order, moving on when its channel closes.
+func (g *Concat) Run() {
+	keys := make([]string, 0, len(g.In))
+	for k := range g.In {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for m := range g.In[k] {
+			g.Out.Send(m)
+		}
+	}
+}
+
+// Merge combines any number of inputs, which are set up as map. Messages are
+// passed on as they come in, interleaving them. Registers as "Merge".
+type Merge struct {
+	flow.Gadget
+	In  map[string]flow.Input
+	Out flow.Output
+}
+
+// Start forwarding messages from all inputs, until each of them has closed.
+func (g *Merge) Run() {
+	var wg sync.WaitGroup
+	for _, in := range g.In {
+		wg.Add(1)
+		go func(in flow.Input) {
+			defer wg.Done()
+			for m := range in {
+				g.Out.Send(m)
+			}
+		}(in)
+	}
+	wg.Wait()
+}
+
 // AddTag turns a stream into a tagged stream. Registers as "AddTag".
 type AddTag struct {
 	flow.Gadget
@@ -1,10 +1,13 @@
 package gadgets
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
 
 	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/gadgets/filesystem"
 )
 
 func ExamplePrinter() {
@@ -75,7 +78,7 @@ func ExampleFanOut() {
 	g.Feed("f.In", "abc")
 	g.Feed("f.In", "def")
 	g.Run()
-	// Output:
+	// Unordered output:
 	// abc
 	// def
 	// Lost int: 2
@@ -94,6 +97,17 @@ func ExampleDelay() {
 	// Lost string: abc
 }
 
+func TestDelayWithoutDelay(t *testing.T) {
+	g := flow.NewCircuit()
+	g.Add("d", "Delay")
+	g.Feed("d.In", "abc")
+	g.Run()
+
+	if errs := g.Errors(); len(errs) != 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+}
+
 func ExampleTimeStamp() {
 	g := flow.NewCircuit()
 	g.Add("t", "TimeStamp")
@@ -117,6 +131,40 @@ func ExampleReadFileText() {
 	// Lost flow.Tag: {<close> example.json}
 }
 
+func ExampleReadFileText_memFS() {
+	fs := filesystem.NewMemFS()
+	f, _ := fs.Create("data/hello.txt")
+	f.Write([]byte("hello\nworld\n"))
+	f.Close()
+
+	g := flow.NewCircuit()
+	g.AddCircuitry("r", &ReadFileText{FS: fs})
+	g.Add("p", "Printer")
+	g.Connect("r.Out", "p.In", 0)
+	g.Feed("r.In", "data/hello.txt")
+	g.Run()
+	// Output:
+	// {Tag:<open> Msg:data/hello.txt}
+	// hello
+	// world
+	// {Tag:<close> Msg:data/hello.txt}
+}
+
+func ExampleWatchFile() {
+	fs := filesystem.NewMemFS()
+	f, _ := fs.Create("hello.txt")
+	f.Close()
+
+	g := flow.NewCircuit()
+	g.AddCircuitry("w", &WatchFile{FS: fs})
+	g.Add("p", "Printer")
+	g.Connect("w.Out", "p.In", 0)
+	g.Feed("w.In", "hello.txt")
+	g.Run() // returns once the input is closed
+	// Output:
+	// hello.txt
+}
+
 func ExampleReadFileJSON() {
 	g := flow.NewCircuit()
 	g.Add("r", "ReadFileJSON")
@@ -173,6 +221,45 @@ func ExampleConcat3() {
 	// Output will display t1, t2, t3 in order, even though t1 came in last
 }
 
+func ExampleConcat() {
+	g := flow.NewCircuit()
+	g.Add("r", "Repeater")
+	g.Add("c", "Concat")
+	g.Add("p", "Printer")
+	g.Connect("r.Out", "c.In:c", 0)
+	g.Connect("c.Out", "p.In", 0)
+	g.Feed("r.Num", 2)
+	g.Feed("r.In", 5)
+	g.Feed("c.In:b", 3)
+	g.Feed("c.In:b", 4)
+	g.Feed("c.In:a", 1)
+	g.Feed("c.In:a", 2)
+	g.Run()
+	// Output:
+	// 1
+	// 2
+	// 3
+	// 4
+	// 5
+	// 5
+}
+
+func ExampleMerge() {
+	g := flow.NewCircuit()
+	g.Add("c", "Merge")
+	g.Add("n", "Counter")
+	g.Add("p", "Printer")
+	g.Connect("c.Out", "n.In", 0)
+	g.Connect("n.Out", "p.In", 0)
+	g.Feed("c.In:a", 1)
+	g.Feed("c.In:a", 2)
+	g.Feed("c.In:b", 3)
+	g.Feed("c.In:c", 4)
+	g.Run()
+	// Output:
+	// 4
+}
+
 func ExampleAddTag() {
 	g := flow.NewCircuit()
 	g.Add("t", "AddTag")
@@ -185,3 +272,104 @@ func ExampleAddTag() {
 	// Lost flow.Tag: {foo 1}
 	// Lost flow.Tag: {foo 3}
 }
+
+func ExampleWriteFileText() {
+	fs := filesystem.NewMemFS()
+	g := flow.NewCircuit()
+	g.AddCircuitry("w", &WriteFileText{FS: fs})
+	g.Feed("w.In", flow.Tag{"<open>", "a.txt"})
+	g.Feed("w.In", "hello")
+	g.Feed("w.In", 123)
+	g.Feed("w.In", flow.Tag{"<close>", "a.txt"})
+	g.Feed("w.In", flow.Tag{"<open>", "b.txt"})
+	g.Feed("w.In", "world")
+	g.Run()
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		f, _ := fs.Open(name)
+		data, _ := ioutil.ReadAll(f)
+		fmt.Printf("%s: %q\n", name, data)
+	}
+	// Output:
+	// a.txt: "hello\n123\n"
+	// b.txt: "world\n"
+}
+
+func ExampleWriteFileJSON() {
+	fs := filesystem.NewMemFS()
+	g := flow.NewCircuit()
+	g.AddCircuitry("w", &WriteFileJSON{FS: fs})
+	g.Feed("w.File", "out.json")
+	g.Feed("w.In", flow.PacketMap{"a": 1})
+	g.Feed("w.In", []int{2, 3})
+	g.Run()
+
+	f, _ := fs.Open("out.json")
+	data, _ := ioutil.ReadAll(f)
+	fmt.Print(string(data))
+	// Output:
+	// {"a":1}
+	// [2,3]
+}
+
+func TestWriteFileDataDir(t *testing.T) {
+	defer delete(flow.Config, "DATA_DIR")
+	flow.Config["DATA_DIR"] = "data" // up to the filesystem, not the gadget
+
+	fs := filesystem.NewMemFS()
+	for i := 0; i < 2; i++ {
+		g := flow.NewCircuit()
+		g.AddCircuitry("w", &WriteFileText{FS: fs})
+		g.Feed("w.File", "logs/a.txt")
+		g.Feed("w.In", i)
+		g.Run()
+	}
+
+	f, err := fs.Open("logs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(f); string(data) != "0\n1\n" {
+		t.Errorf("expected the file to be appended to, got %q", data)
+	}
+}
+
+func TestWriteFileBackToName(t *testing.T) {
+	fs := filesystem.NewMemFS()
+	g := flow.NewCircuit()
+	g.AddCircuitry("w", &WriteFileText{FS: fs})
+	g.Feed("w.File", "main.txt")
+	g.Feed("w.In", "a")
+	g.Feed("w.In", flow.Tag{"<open>", "other.txt"})
+	g.Feed("w.In", "b")
+	g.Feed("w.In", flow.Tag{"<close>", "other.txt"})
+	g.Feed("w.In", flow.Tag{"<foo>", 1})
+	g.Feed("w.In", "c")
+	g.Run()
+
+	for name, want := range map[string]string{"main.txt": "a\nc\n", "other.txt": "b\n"} {
+		f, err := fs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := ioutil.ReadAll(f); string(data) != want {
+			t.Errorf("%s: expected %q, got %q", name, want, data)
+		}
+	}
+	errs := g.Errors()
+	if len(errs) != 1 || errs[0].Msg != (flow.Tag{"<foo>", 1}) {
+		t.Errorf("expected an error for the tag, got %v", errs)
+	}
+}
+
+func TestWriteFileNoName(t *testing.T) {
+	g := flow.NewCircuit()
+	g.AddCircuitry("w", &WriteFileText{FS: filesystem.NewMemFS()})
+	g.Feed("w.In", "abc")
+	g.Run()
+
+	errs := g.Errors()
+	if len(errs) != 1 || errs[0].Msg != "abc" {
+		t.Errorf("expected an error for the message, got %v", errs)
+	}
+}
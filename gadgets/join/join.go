@@ -0,0 +1,295 @@
+// Gadgets which combine messages from several streams.
+package join
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/laughlinez/flow"
+)
+
+func init() {
+	flow.Registry["Zip"] = func() flow.Circuitry { return new(Zip) }
+	flow.Registry["CombineLatest"] = func() flow.Circuitry { return new(CombineLatest) }
+	flow.Registry["Join"] = func() flow.Circuitry { return new(Join) }
+}
+
+// Zip takes one message from each of its inputs in turn, and sends them out
+// together as a PacketMap, keyed by input name. Inputs are set up as a map,
+// i.e. "In:temp" and "In:humidity". It stops once any of the inputs has been
+// closed, the remaining messages are then dropped. Registers as "Zip".
+type Zip struct {
+	flow.Gadget
+	In  map[string]flow.Input
+	Out flow.Output
+}
+
+// Start zipping the inputs.
+func (g *Zip) Run() {
+	keys := sortedKeys(g.In)
+	if len(keys) == 0 {
+		return
+	}
+	defer func() {
+		for _, in := range g.In {
+			for _ = range in { // don't leave any senders hanging
+			}
+		}
+	}()
+	for {
+		r := flow.PacketMap{}
+		for _, k := range keys {
+			m, ok := <-g.In[k]
+			if !ok {
+				return
+			}
+			r[k] = m
+		}
+		g.Out.Send(r)
+	}
+}
+
+// CombineLatest keeps the latest message of each of its inputs, and sends them
+// all out as a PacketMap, keyed by input name, each time a message comes in.
+// Inputs are set up as a map, as for Zip. Nothing is sent out until there has
+// been a message on each input. Registers as "CombineLatest".
+type CombineLatest struct {
+	flow.Gadget
+	In  map[string]flow.Input
+	Out flow.Output
+}
+
+type keyed struct {
+	key  string
+	msg  flow.Message
+	done bool // true once the input has been closed
+}
+
+// Start combining the inputs, until all of them have been closed.
+func (g *CombineLatest) Run() {
+	merged := make(chan keyed)
+	for k, in := range g.In {
+		go func(k string, in flow.Input) {
+			for m := range in {
+				merged <- keyed{key: k, msg: m}
+			}
+			merged <- keyed{key: k, done: true}
+		}(k, in)
+	}
+
+	latest := flow.PacketMap{}
+	for open := len(g.In); open > 0; {
+		km := <-merged
+		if km.done {
+			open--
+			continue
+		}
+		latest[km.key] = km.msg
+		if len(latest) == len(g.In) {
+			r := make(flow.PacketMap, len(latest))
+			for k, v := range latest {
+				r[k] = v
+			}
+			g.Out.Send(r)
+		}
+	}
+}
+
+// Join correlates PacketMaps from the Left and Right pins, which have the same
+// value in the field named on the Key pin, and were received within the time
+// set on the Within pin of each other (i.e. "5s"). Each match is sent out as a
+// merged PacketMap, with the fields from the left one taking precedence. Each
+// message is kept for this amount of time, and can match more than once. Those
+// which never matched are then sent to the Unmatched pin, as are messages which
+// are not PacketMaps, or don't have the key field.
+//
+// Time is told by the Clock, which is the system time by default, but if a field
+// name is sent to the Stamp pin, the time is taken from that field instead (see
+// PacketMap.GetTime). Messages then expire when a message with a later time
+// comes in. All remaining unmatched messages are sent out once both inputs are
+// closed. Registers as "Join".
+type Join struct {
+	flow.Gadget
+	Key       flow.Input
+	Within    flow.Input
+	Stamp     flow.Input
+	Left      flow.Input
+	Right     flow.Input
+	Out       flow.Output
+	Unmatched flow.Output
+	Err       flow.Output
+
+	Clock flow.TimeSource
+}
+
+// one message kept around for matching
+type entry struct {
+	msg     flow.PacketMap
+	t       time.Time
+	matched bool
+}
+
+// Start joining.
+func (g *Join) Run() {
+	key := ""
+	if m, ok := <-g.Key; ok {
+		key, _ = m.(string)
+	}
+	r := <-g.Within
+	within, err := durationOf(r)
+	if err == nil && key == "" {
+		err, r = fmt.Errorf("join: no key field"), nil
+	}
+	if err != nil {
+		g.Err.Send(g.Error(err, r))
+		for g.Left != nil || g.Right != nil { // drop everything
+			select {
+			case _, ok := <-g.Left:
+				if !ok {
+					g.Left = nil
+				}
+			case _, ok := <-g.Right:
+				if !ok {
+					g.Right = nil
+				}
+			}
+		}
+		return
+	}
+	stamp := ""
+	if m, ok := <-g.Stamp; ok {
+		stamp, _ = m.(string)
+	}
+	clock := g.Clock
+	if clock == nil {
+		clock = flow.SystemTime
+	}
+
+	// kept messages per side and per key, in order of arrival
+	sides := [2]map[string][]*entry{{}, {}}
+	wake := flow.NewAlarm(clock)
+
+	// send out unmatched messages older than the given time, and drop them
+	expire := func(now time.Time, all bool) {
+		var first time.Time
+		for _, side := range sides {
+			for k, list := range side {
+				keep := list[:0]
+				for _, e := range list {
+					end := e.t.Add(within)
+					switch {
+					case all || now.After(end):
+						if !e.matched {
+							g.Unmatched.Send(e.msg)
+						}
+					default:
+						if first.IsZero() || end.Before(first) {
+							first = end
+						}
+						keep = append(keep, e)
+					}
+				}
+				if len(keep) > 0 {
+					side[k] = keep
+				} else {
+					delete(side, k)
+				}
+			}
+		}
+		if stamp == "" && !first.IsZero() {
+			wake.Set(first.Add(time.Nanosecond)) // expiry is after the end
+		} else {
+			wake.Clear()
+		}
+	}
+
+	inputs := [2]flow.Input{g.Left, g.Right}
+	for inputs[0] != nil || inputs[1] != nil {
+		var m flow.Message
+		var ok bool
+		side := 0
+		select {
+		case m, ok = <-inputs[0]:
+		case m, ok = <-inputs[1]:
+			side = 1
+		case <-wake.C:
+			wake.Clear()
+			expire(clock.Now(), false)
+			continue
+		}
+		if !ok {
+			inputs[side] = nil
+			continue
+		}
+
+		v, isMap := m.(flow.PacketMap)
+		k, hasKey := interface{}(nil), false
+		if isMap {
+			k, hasKey = v.Get(key)
+		}
+		if !hasKey {
+			g.Unmatched.Send(m)
+			continue
+		}
+		t := clock.Now()
+		if stamp != "" {
+			if t, err = v.GetTime(stamp); err != nil {
+				g.Err.Send(g.Error(err, m))
+				continue
+			}
+		}
+		expire(t, false)
+
+		e := &entry{msg: v, t: t}
+		ks := fmt.Sprint(k)
+		for _, other := range sides[1-side][ks] {
+			if d := e.t.Sub(other.t); d > within || d < -within {
+				continue
+			}
+			left, right := e.msg, other.msg
+			if side == 1 {
+				left, right = right, left
+			}
+			g.Out.Send(merge(left, right))
+			e.matched, other.matched = true, true
+		}
+		sides[side][ks] = append(sides[side][ks], e)
+		if stamp == "" && wake.At().IsZero() {
+			wake.Set(t.Add(within + time.Nanosecond))
+		}
+	}
+	expire(time.Time{}, true)
+}
+
+// Merge two PacketMaps into a new one, the first one wins if both have a field.
+func merge(a, b flow.PacketMap) flow.PacketMap {
+	r := make(flow.PacketMap, len(a)+len(b))
+	for k, v := range b {
+		r[k] = v
+	}
+	for k, v := range a {
+		r[k] = v
+	}
+	return r
+}
+
+func sortedKeys(m map[string]flow.Input) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func durationOf(m flow.Message) (time.Duration, error) {
+	d, err := flow.ParseDuration(m)
+	if err != nil {
+		return 0, fmt.Errorf("join: %v", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("join: duration must be positive: %v", m)
+	}
+	return d, nil
+}
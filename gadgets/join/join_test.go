@@ -0,0 +1,125 @@
+package join
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/flowtest"
+)
+
+func ExampleZip() {
+	g := flow.NewCircuit()
+	g.Add("z", "Zip")
+	g.AddCircuitry("p", flow.Sink(func(m flow.Message) { fmt.Println(m) }))
+	g.Connect("z.Out", "p.In", 0)
+	g.Feed("z.In:a", 1)
+	g.Feed("z.In:a", 2)
+	g.Feed("z.In:a", 3)
+	g.Feed("z.In:b", "x")
+	g.Feed("z.In:b", "y")
+	g.Run()
+	// Output:
+	// map[a:1 b:x]
+	// map[a:2 b:y]
+}
+
+func TestCombineLatest(t *testing.T) {
+	g := flow.NewCircuit()
+	out := new(flowtest.Collector)
+	g.Add("c", "CombineLatest")
+	g.AddCircuitry("o", out)
+	g.Connect("c.Out", "o.In", 0)
+	g.Feed("c.In:a", 1)
+	g.Feed("c.In:b", 2)
+	g.Feed("c.In:b", 3)
+	g.Run()
+
+	// the order in which inputs are read is not fixed, but the last
+	// combination is always the same
+	n := len(out.Msgs)
+	if n < 1 || n > 2 {
+		t.Fatalf("expected one or two messages, got %v", out.Msgs)
+	}
+	if want := (flow.PacketMap{"a": 1, "b": 3}); !reflect.DeepEqual(out.Msgs[n-1], want) {
+		t.Errorf("expected %v, got %v", want, out.Msgs[n-1])
+	}
+}
+
+// a reading at the given number of seconds since the epoch
+func reading(sec int, id string, field string, value interface{}) flow.PacketMap {
+	return flow.PacketMap{"t": sec, "id": id, field: value}
+}
+
+// Run a Join, with a function which sends messages to its inputs, in order,
+// and which can wait for results as they come out.
+func runJoin(j *Join, feeds map[string]flow.Message,
+	fun func(left, right flow.Output, out, miss *flowtest.Collector)) (out, miss *flowtest.Collector) {
+	out = &flowtest.Collector{Seen: make(chan flow.Message, 10)}
+	miss = &flowtest.Collector{Seen: make(chan flow.Message, 10)}
+	g := flow.NewCircuit()
+	g.AddCircuitry("j", j)
+	g.AddCircuitry("o", out)
+	g.AddCircuitry("m", miss)
+	g.AddCircuitry("d", flow.Runner("Output: L R", func(left, right flow.Output) {
+		fun(left, right, out, miss)
+	}))
+	g.Connect("d.L", "j.Left", 0)
+	g.Connect("d.R", "j.Right", 0)
+	g.Connect("j.Out", "o.In", 0)
+	g.Connect("j.Unmatched", "m.In", 0)
+	for pin, m := range feeds {
+		g.Feed("j."+pin, m)
+	}
+	g.Run()
+	return
+}
+
+func TestJoinStamp(t *testing.T) {
+	out, miss := runJoin(new(Join), map[string]flow.Message{
+		"Key": "id", "Within": "5s", "Stamp": "t",
+	}, func(left, right flow.Output, _, _ *flowtest.Collector) {
+		left.Send(reading(10, "a", "temp", 20))
+		left.Send(reading(11, "b", "temp", 21))
+		right.Send(reading(12, "a", "hum", 60))
+		right.Send("no map")
+		left.Send(reading(14, "a", "temp", 22))
+		right.Send(reading(30, "b", "hum", 61)) // too late, b@11 expires
+	})
+
+	want := []flow.Message{
+		flow.PacketMap{"t": 10, "id": "a", "temp": 20, "hum": 60},
+		flow.PacketMap{"t": 14, "id": "a", "temp": 22, "hum": 60},
+	}
+	if !reflect.DeepEqual(out.Msgs, want) {
+		t.Errorf("expected %v, got %v", want, out.Msgs)
+	}
+	if len(miss.Msgs) != 3 || miss.Msgs[0] != "no map" {
+		t.Errorf("expected 3 unmatched, got %v", miss.Msgs)
+	}
+}
+
+func TestJoinClock(t *testing.T) {
+	clock := flow.NewManualTime(time.Unix(0, 0))
+	out, miss := runJoin(&Join{Clock: clock}, map[string]flow.Message{
+		"Key": "id", "Within": "5s",
+	}, func(left, right flow.Output, out, miss *flowtest.Collector) {
+		left.Send(flow.PacketMap{"id": "a", "temp": 20})
+		left.Send(flow.PacketMap{"id": "b", "temp": 21})
+		right.Send(flow.PacketMap{"id": "a", "hum": 60, "temp": 0})
+		if m := <-out.Seen; !reflect.DeepEqual(m, flow.PacketMap{"id": "a", "temp": 20, "hum": 60}) {
+			t.Errorf("unexpected match: %v", m)
+		}
+		clock.Advance(6 * time.Second)
+		if m := <-miss.Seen; m.(flow.PacketMap)["id"] != "b" {
+			t.Errorf("expected b to expire, got %v", m)
+		}
+		right.Send(flow.PacketMap{"id": "b", "hum": 61})
+	})
+
+	if len(out.Msgs) != 1 || len(miss.Msgs) != 2 {
+		t.Errorf("unexpected results: %v and %v", out.Msgs, miss.Msgs)
+	}
+}
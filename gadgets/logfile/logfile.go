@@ -0,0 +1,278 @@
+// Log files which are rotated by size or age, and followed as they grow.
+package logfile
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/api"
+)
+
+func init() {
+	flow.Registry["RotatingLog"] = func() flow.Circuitry { return new(RotatingLog) }
+}
+
+// RotatingLog appends incoming messages as lines to the file set on the File
+// pin, as resolved by the filesystem it uses. The file is rotated once
+// it would grow beyond MaxSize bytes, and at each multiple of the Every pin's
+// duration (i.e. "24h" for daily logs), if it is not empty. Rotated segments
+// are renamed to the file name plus a timestamp, and are gzip'ed unless false
+// is sent to the Compress pin. Only the newest Keep segments are kept, if set.
+// The names of all completed segments are sent out. Registers as "RotatingLog".
+type RotatingLog struct {
+	flow.Gadget
+	File     flow.Input
+	MaxSize  flow.Input
+	Every    flow.Input
+	Keep     flow.Input
+	Compress flow.Input
+	In       flow.Input
+	Out      flow.Output
+	Err      flow.Output
+
+	FS    api.IFileSystemAPI `gadget:"FilesystemAPI"`
+	Clock flow.TimeSource
+}
+
+// the state of one rotating log
+type logFile struct {
+	*RotatingLog
+	name     string
+	maxSize  int64
+	every    time.Duration
+	keep     int
+	compress bool
+	clock    flow.TimeSource
+
+	file api.File
+	size int64
+}
+
+// Start writing to the log file.
+func (g *RotatingLog) Run() {
+	w := &logFile{RotatingLog: g, compress: true, clock: g.Clock}
+	if w.clock == nil {
+		w.clock = flow.SystemTime
+	}
+	if err := w.configure(); err != nil {
+		g.Err.Send(g.Error(err, nil))
+		for range g.In {
+		}
+		return
+	}
+
+	alarm := flow.NewAlarm(w.clock)
+	if w.every > 0 {
+		alarm.Set(w.nextRotation())
+	}
+	if err := w.open(); err != nil {
+		g.Err.Send(g.Error(err, nil))
+	}
+
+	for {
+		select {
+		case m, ok := <-g.In:
+			if !ok {
+				w.close()
+				return
+			}
+			if _, ok := m.(flow.Tag); ok {
+				continue
+			}
+			line := fmt.Sprintln(m)
+			if w.maxSize > 0 && w.size > 0 && w.size+int64(len(line)) > w.maxSize {
+				w.rotate()
+			}
+			if err := w.write(line); err != nil {
+				g.Err.Send(g.Error(err, m))
+			}
+		case <-alarm.C:
+			alarm.Set(w.nextRotation())
+			if w.size > 0 {
+				w.rotate()
+			}
+		}
+	}
+}
+
+func (w *logFile) configure() error {
+	m, ok := <-w.RotatingLog.File
+	name, _ := m.(string)
+	if !ok || name == "" {
+		return fmt.Errorf("rotatinglog: expected a file name, got %v", m)
+	}
+	w.name = name
+	if m, ok := <-w.MaxSize; ok {
+		n, ok := flow.Int(m)
+		if !ok || n < 0 {
+			return fmt.Errorf("rotatinglog: bad size: %v", m)
+		}
+		w.maxSize = int64(n)
+	}
+	if m, ok := <-w.Every; ok {
+		d, err := flow.ParseDuration(m)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("rotatinglog: bad interval: %v", m)
+		}
+		w.every = d
+	}
+	if m, ok := <-w.Keep; ok {
+		n, ok := flow.Int(m)
+		if !ok || n < 0 {
+			return fmt.Errorf("rotatinglog: bad keep count: %v", m)
+		}
+		w.keep = n
+	}
+	if m, ok := <-w.Compress; ok {
+		if w.compress, ok = m.(bool); !ok {
+			return fmt.Errorf("rotatinglog: bad compress flag: %v", m)
+		}
+	}
+	return nil
+}
+
+// the time at which the current period ends
+func (w *logFile) nextRotation() time.Time {
+	return w.clock.Now().Truncate(w.every).Add(w.every)
+}
+
+// Open the log file for appending. A file left over from an earlier period
+// is rotated first, so that each segment only covers a single period.
+func (w *logFile) open() (err error) {
+	if w.file, err = w.FS.Append(w.name); err != nil {
+		return
+	}
+	info, err := w.file.Stat()
+	if err != nil {
+		return
+	}
+	w.size = info.Size()
+	start := w.clock.Now().Truncate(w.every)
+	if w.every > 0 && w.size > 0 && info.ModTime().Before(start) {
+		w.rotate()
+	}
+	return
+}
+
+func (w *logFile) write(line string) error {
+	if w.file == nil {
+		return errors.New("rotatinglog: no file to write to")
+	}
+	n, err := io.WriteString(w.file, line)
+	w.size += int64(n)
+	return err
+}
+
+func (w *logFile) close() {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			w.Err.Send(w.Error(err, nil))
+		}
+		w.file = nil
+	}
+}
+
+// Close the current file, turn it into a segment, and start a new one. Errors
+// are reported, but the log carries on as well as it can.
+func (w *logFile) rotate() {
+	w.close()
+	if err := w.archive(); err != nil {
+		w.Err.Send(w.Error(err, nil))
+	}
+	var err error
+	if w.file, err = w.FS.Append(w.name); err != nil {
+		w.Err.Send(w.Error(err, nil))
+	}
+	w.size = 0
+}
+
+// rename the current file to a new segment, compress it, and remove old ones
+func (w *logFile) archive() error {
+	stamp := w.name + "." + w.clock.Now().UTC().Format("20060102-150405")
+	segment := stamp
+	for i := 1; w.exists(segment) || w.exists(segment+".gz"); i++ {
+		segment = fmt.Sprintf("%s-%d", stamp, i)
+	}
+	if err := w.FS.Rename(w.name, segment); err != nil {
+		return err
+	}
+	if w.compress {
+		if err := w.gzip(segment); err != nil {
+			w.Out.Send(segment)
+			return err
+		}
+		segment += ".gz"
+	}
+	w.Out.Send(segment)
+	return w.prune()
+}
+
+func (w *logFile) exists(name string) bool {
+	_, err := w.FS.Stat(name)
+	return err == nil
+}
+
+// compress a file, and remove the original once done
+func (w *logFile) gzip(name string) error {
+	in, err := w.FS.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := w.FS.Create(name + ".gz")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if e := zw.Close(); err == nil {
+		err = e
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		w.FS.Remove(name + ".gz")
+		return err
+	}
+	return w.FS.Remove(name)
+}
+
+// remove the oldest segments, if there are more than should be kept
+func (w *logFile) prune() error {
+	if w.keep == 0 {
+		return nil
+	}
+	dir, base := path.Split(w.name)
+	if dir == "" {
+		dir = "."
+	}
+	list, err := w.FS.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var segments []string
+	for _, info := range list {
+		if strings.HasPrefix(info.Name(), base+".") && !info.IsDir() {
+			segments = append(segments, info.Name())
+		}
+	}
+	// timestamps sort by age, as long as the compression suffix is ignored
+	sort.Slice(segments, func(i, j int) bool {
+		return strings.TrimSuffix(segments[i], ".gz") < strings.TrimSuffix(segments[j], ".gz")
+	})
+	for len(segments) > w.keep {
+		if err := w.FS.Remove(path.Join(dir, segments[0])); err != nil {
+			return err
+		}
+		segments = segments[1:]
+	}
+	return nil
+}
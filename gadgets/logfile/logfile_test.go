@@ -0,0 +1,149 @@
+package logfile
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/flowtest"
+	"github.com/laughlinez/flow/gadgets/filesystem"
+)
+
+// Run a log on a manual clock, with the given settings and a function which
+// sends it messages. Returns the names of all completed segments.
+func script(g *RotatingLog, feeds map[string]flow.Message,
+	fun func(emit func(flow.Message), seen <-chan flow.Message)) []flow.Message {
+	out := &flowtest.Collector{Seen: make(chan flow.Message, 100)}
+	c := flow.NewCircuit()
+	c.AddCircuitry("g", g)
+	c.AddCircuitry("o", out)
+	c.AddCircuitry("s", flow.Source(func(emit func(flow.Message)) {
+		fun(emit, out.Seen)
+	}))
+	c.Connect("s.Out", "g.In", 0)
+	c.Connect("g.Out", "o.In", 0)
+	for pin, m := range feeds {
+		c.Feed("g."+pin, m)
+	}
+	c.Run()
+	return out.Msgs
+}
+
+func contents(t *testing.T, fs *filesystem.MemFS, name string) string {
+	f, err := fs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		f.Seek(0, 0) // not compressed
+		data, _ := ioutil.ReadAll(f)
+		return string(data)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotateSize(t *testing.T) {
+	fs := filesystem.NewMemFS()
+	clock := flow.NewManualTime(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	got := script(&RotatingLog{FS: fs, Clock: clock}, map[string]flow.Message{
+		"File": "logs/app.log", "MaxSize": 8, "Keep": 2,
+	}, func(emit func(flow.Message), seen <-chan flow.Message) {
+		for _, s := range []string{"abc", "def", "ghi", "jkl", "mno", "pqr"} {
+			emit(s)
+		}
+	})
+
+	want := []flow.Message{
+		"logs/app.log.20200102-030405.gz",
+		"logs/app.log.20200102-030405-1.gz",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected segments %v, got %v", want, got)
+	}
+	list, _ := fs.ReadDir("logs")
+	if len(list) != 3 {
+		t.Errorf("expected the log and two segments, got %d files", len(list))
+	}
+	if s := contents(t, fs, "logs/app.log"); s != "mno\npqr\n" {
+		t.Errorf("unexpected log contents: %q", s)
+	}
+	if s := contents(t, fs, want[1].(string)); s != "ghi\njkl\n" {
+		t.Errorf("unexpected segment contents: %q", s)
+	}
+}
+
+func TestRotateKeep(t *testing.T) {
+	fs := filesystem.NewMemFS()
+	clock := flow.NewManualTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	got := script(&RotatingLog{FS: fs, Clock: clock}, map[string]flow.Message{
+		"File": "app.log", "MaxSize": 4, "Keep": 1, "Compress": false,
+	}, func(emit func(flow.Message), seen <-chan flow.Message) {
+		emit("abc")
+		emit("def")
+		<-seen
+		clock.Advance(time.Second)
+		emit("ghi")
+		<-seen
+	})
+
+	if len(got) != 2 {
+		t.Fatalf("expected two segments, got %v", got)
+	}
+	if _, err := fs.Stat(got[0].(string)); err == nil {
+		t.Errorf("expected oldest segment to be removed")
+	}
+	if s := contents(t, fs, got[1].(string)); s != "def\n" {
+		t.Errorf("unexpected segment contents: %q", s)
+	}
+}
+
+func TestRotateEvery(t *testing.T) {
+	fs := filesystem.NewMemFS()
+	clock := flow.NewManualTime(time.Date(2020, 1, 1, 0, 0, 30, 0, time.UTC))
+	got := script(&RotatingLog{FS: fs, Clock: clock}, map[string]flow.Message{
+		"File": "app.log", "Every": "1m",
+	}, func(emit func(flow.Message), seen <-chan flow.Message) {
+		emit("a")
+		emit(flow.Tag{"ignored", 1})
+		emit("b")
+		clock.Advance(time.Minute) // rotates at 00:01:00
+		<-seen
+		emit("c")
+		clock.Advance(time.Minute) // rotates again, at 00:02:00
+		<-seen
+		clock.Advance(time.Minute) // but not if the log is empty
+	})
+
+	want := []flow.Message{"app.log.20200101-000130.gz", "app.log.20200101-000230.gz"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected segments %v, got %v", want, got)
+	}
+	if s := contents(t, fs, want[0].(string)); s != "a\nb\n" {
+		t.Errorf("unexpected segment contents: %q", s)
+	}
+	if s := contents(t, fs, "app.log"); s != "" {
+		t.Errorf("expected an empty log, got %q", s)
+	}
+}
+
+func TestRotateBadConfig(t *testing.T) {
+	g := flow.NewCircuit()
+	g.AddCircuitry("r", &RotatingLog{FS: filesystem.NewMemFS()})
+	g.Feed("r.File", "app.log")
+	g.Feed("r.Every", "soon")
+	g.Feed("r.In", "abc")
+	g.Run()
+
+	if errs := g.Errors(); len(errs) != 1 {
+		t.Errorf("expected one error, got %v", errs)
+	}
+}
@@ -0,0 +1,305 @@
+package logfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/api"
+)
+
+func init() {
+	flow.Registry["TailFile"] = func() flow.Circuitry { return new(TailFile) }
+}
+
+// TailFile takes strings that are filenames, and follows these files as they
+// grow, emitting each line appended to them, like "tail -F". Truncated files
+// are read again from the start, and when a file is replaced, i.e. by log
+// rotation, the rest of the old file is read before switching to the new one.
+// Each time a file is opened, an <open> tag is sent, and a <file> tag is sent
+// when lines come from a different file than the previous ones.
+//
+// Send true to the FromEnd pin to skip the lines already in a file when it is
+// first opened. To carry on where it left off after a restart, send a name to
+// the Persist pin: offsets are stored under that name and a slash, this needs
+// a "DBReadWriteAPI" provider. Files are checked on each change reported by
+// the filesystem, and every second, or as set by the Poll pin. Runs until the
+// circuit is cancelled. Registers as "TailFile".
+type TailFile struct {
+	flow.Gadget
+	FromEnd flow.Input
+	Poll    flow.Input
+	Persist flow.Input
+	In      flow.Input
+	Out     flow.Output
+	Err     flow.Output
+
+	FS    api.IFileSystemAPI  `gadget:"FilesystemAPI"`
+	DB    api.IDBReadWriteAPI `gadget:"DBReadWriteAPI,optional"`
+	Clock flow.TimeSource
+}
+
+// how many bytes at the start of a file are used to recognise it on restart
+const headSize = 64
+
+// the state of one followed file
+type tailed struct {
+	name    string
+	file    api.File    // nil while the file does not exist
+	info    os.FileInfo // as it was when the file was opened
+	head    string      // first bytes, to recognise the file after a restart
+	offset  int64       // how far the file has been read
+	partial []byte      // the start of an incomplete last line
+	saved   int64       // the offset which has been persisted
+}
+
+// the settings and state shared by all followed files
+type follower struct {
+	*TailFile
+	fromEnd bool
+	prefix  string // where to persist offsets, if set
+	current string // the file the last lines came from
+}
+
+// Start following files.
+func (g *TailFile) Run() {
+	f := &follower{TailFile: g}
+	poll := time.Second
+	if m, ok := <-g.FromEnd; ok {
+		f.fromEnd, _ = m.(bool)
+	}
+	if m, ok := <-g.Poll; ok {
+		if d, err := flow.ParseDuration(m); err == nil && d > 0 {
+			poll = d
+		} else {
+			g.Err.Send(g.Error(fmt.Errorf("tailfile: bad poll interval: %v", m), m))
+		}
+	}
+	if m, ok := <-g.Persist; ok && g.DB != nil {
+		f.prefix, _ = m.(string)
+	}
+	clock := g.Clock
+	if clock == nil {
+		clock = flow.SystemTime
+	}
+
+	var files []*tailed
+	defer func() {
+		for _, t := range files {
+			if t.file != nil {
+				t.file.Close()
+			}
+		}
+	}()
+	checkAll := func() {
+		for _, t := range files {
+			f.check(t)
+		}
+	}
+
+	events := make(chan api.FileEvent, 10)
+	watched := map[string]bool{}
+	alarm := flow.NewAlarm(clock)
+	alarm.Set(clock.Now().Add(poll))
+	in := g.In
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				in = nil // keep following the files
+				continue
+			}
+			name, ok := m.(string)
+			if !ok {
+				g.Out.Send(m)
+				continue
+			}
+			// watch the directory, so that replaced files are noticed right
+			// away, if that fails the file will still be polled
+			if dir := path.Dir(name); !watched[dir] {
+				if stop, err := g.FS.Watch(dir, events); err == nil {
+					defer stop()
+					watched[dir] = true
+				}
+			}
+			t := &tailed{name: name}
+			files = append(files, t)
+			f.check(t)
+		case <-events:
+			checkAll()
+		case <-alarm.C:
+			alarm.Set(clock.Now().Add(poll))
+			checkAll()
+		case <-g.Done():
+			return
+		}
+	}
+}
+
+// Check a file for changes, and send out any new lines.
+func (f *follower) check(t *tailed) {
+	if err := f.update(t); err != nil {
+		f.Err.Send(f.Error(err, t.name))
+	}
+	if err := f.save(t); err != nil {
+		f.Err.Send(f.Error(err, t.name))
+	}
+}
+
+func (f *follower) update(t *tailed) error {
+	info, err := f.FS.Stat(t.name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	replaced := t.file != nil && (info == nil || !sameFile(info, t.info))
+
+	if t.file != nil {
+		if info != nil && !replaced && info.Size() < t.offset {
+			// truncated, start over and drop any incomplete line
+			t.offset, t.partial, t.head = 0, nil, ""
+		}
+		// read whatever is left, even if the file has been replaced meanwhile
+		if err := f.read(t, replaced); err != nil || !replaced {
+			return err
+		}
+		t.file.Close()
+		t.file = nil
+	}
+	if info == nil {
+		return nil // wait for the file to (re)appear
+	}
+
+	first := t.info == nil
+	if t.file, err = f.FS.Open(t.name); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	if t.info, err = t.file.Stat(); err != nil {
+		return err
+	}
+	t.offset, t.partial, t.head = 0, nil, ""
+	if first {
+		t.offset = f.restore(t)
+		if t.offset < 0 {
+			t.offset = 0
+			if f.fromEnd {
+				t.offset = t.info.Size()
+			}
+		}
+	}
+	t.saved = t.offset
+	f.Out.Send(flow.Tag{"<open>", t.name})
+	f.current = t.name
+	return f.read(t, false)
+}
+
+// Read and send out all new lines, including a final incomplete one only if
+// the file is complete, i.e. has been replaced.
+func (f *follower) read(t *tailed, complete bool) error {
+	lines, err := t.read(complete)
+	if len(lines) > 0 && f.current != t.name {
+		f.Out.Send(flow.Tag{"<file>", t.name})
+		f.current = t.name
+	}
+	for _, line := range lines {
+		f.Out.Send(line)
+	}
+	return err
+}
+
+// Read all new lines, a final incomplete one only if the file is complete.
+func (t *tailed) read(complete bool) (lines []string, err error) {
+	if t.head == "" {
+		if t.head, err = t.readHead(); err != nil {
+			return
+		}
+	}
+	if _, err = t.file.Seek(t.offset, io.SeekStart); err != nil {
+		return
+	}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, t.file)
+	t.offset += n
+	data := append(t.partial, buf.Bytes()...)
+	t.partial = nil
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		lines = append(lines, strings.TrimSuffix(string(data[:i]), "\r"))
+		data = data[i+1:]
+	}
+	if len(data) > 0 {
+		if complete {
+			lines = append(lines, string(data))
+		} else {
+			t.partial = append([]byte(nil), data...)
+		}
+	}
+	return
+}
+
+// read the first bytes of the file, to recognise it again later
+func (t *tailed) readHead() (string, error) {
+	if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	buf := make([]byte, headSize)
+	n, err := io.ReadFull(t.file, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return string(buf[:n]), err
+}
+
+// Look up the offset saved for a file, returns -1 if there is none or if the
+// file is not the same one as before, i.e. because it has been rotated since.
+func (f *follower) restore(t *tailed) int64 {
+	if f.prefix == "" {
+		return -1
+	}
+	value, err := f.DB.Get(f.prefix + "/" + t.name)
+	state, ok := value.(map[string]interface{})
+	if err != nil || !ok {
+		return -1
+	}
+	head, _ := state["head"].(string)
+	offset, ok := flow.Int(state["offset"])
+	current, err := t.readHead()
+	if err != nil || !ok || !strings.HasPrefix(current, head) || int64(offset) > t.info.Size() {
+		return -1
+	}
+	return int64(offset)
+}
+
+// Persist how far a file has been read, up to the last complete line.
+func (f *follower) save(t *tailed) error {
+	offset := t.offset - int64(len(t.partial))
+	if f.prefix == "" || t.file == nil || offset == t.saved {
+		return nil
+	}
+	t.saved = offset
+	return f.DB.Put(f.prefix+"/"+t.name, map[string]interface{}{
+		"head":   t.head,
+		"offset": offset,
+	})
+}
+
+// Files are the same if the system says so, or if they share the same
+// underlying object, as is the case for the in-memory filesystem.
+func sameFile(a, b os.FileInfo) bool {
+	if os.SameFile(a, b) {
+		return true
+	}
+	sa, sb := a.Sys(), b.Sys()
+	return sa != nil && reflect.TypeOf(sa).Comparable() && sa == sb
+}
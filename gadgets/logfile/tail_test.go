@@ -0,0 +1,164 @@
+package logfile
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/api"
+	"github.com/laughlinez/flow/flowtest"
+	"github.com/laughlinez/flow/gadgets/database"
+	"github.com/laughlinez/flow/gadgets/filesystem"
+)
+
+// The database provider gets registered by importing its package, and then
+// wants a data directory, even for followers which persist nothing.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "logfile")
+	if err != nil {
+		panic(err)
+	}
+	flow.Config["DATA_DIR"] = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// Follow files until fun returns, then cancel the circuit. Returns all
+// messages sent out. Fun can wait for each message with next.
+func follow(t *testing.T, g *TailFile, feeds map[string]flow.Message,
+	fun func(next func() flow.Message)) []flow.Message {
+	out := &flowtest.Collector{Seen: make(chan flow.Message, 100)}
+	c := flow.NewCircuit()
+	c.AddCircuitry("g", g)
+	c.AddCircuitry("o", out)
+	c.Connect("g.Out", "o.In", 0)
+	for pin, m := range feeds {
+		c.Feed("g."+pin, m)
+	}
+	go c.Run()
+
+	fun(func() flow.Message {
+		select {
+		case m := <-out.Seen:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for output")
+			return nil
+		}
+	})
+	c.Cancel(errors.New("done"))
+	for range out.Seen {
+	}
+	return out.Msgs
+}
+
+func appendTo(fs api.IFileSystemAPI, name, text string) {
+	f, _ := fs.Append(name)
+	f.Write([]byte(text))
+	f.Close()
+}
+
+func TestTailFile(t *testing.T) {
+	fs := filesystem.NewMemFS()
+	appendTo(fs, "app.log", "old\n")
+	clock := flow.NewManualTime(time.Unix(0, 0))
+
+	open := flow.Tag{"<open>", "app.log"}
+	got := follow(t, &TailFile{FS: fs, Clock: clock}, map[string]flow.Message{
+		"In": "app.log", "FromEnd": true,
+	}, func(next func() flow.Message) {
+		next() // <open>
+		appendTo(fs, "app.log", "new\nhalf")
+		next()
+		appendTo(fs, "app.log", "done\n")
+		next()
+
+		// truncated
+		f, _ := fs.Create("app.log")
+		f.Write([]byte("x\n"))
+		f.Close()
+		next()
+
+		// rotated, with a last incomplete line in the old file
+		appendTo(fs, "app.log", "last")
+		fs.Rename("app.log", "app.log.1")
+		appendTo(fs, "app.log", "fresh\n")
+		for m := next(); m != "fresh"; m = next() {
+		}
+	})
+
+	want := []flow.Message{open, "new", "halfdone", "x", "last", open, "fresh"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestTailFilePersist(t *testing.T) {
+	fs := filesystem.NewMemFS()
+	db := database.NewMemStore()
+	appendTo(fs, "app.log", "a\nb\n")
+
+	run := func(n int) []flow.Message {
+		return follow(t, &TailFile{FS: fs, DB: db}, map[string]flow.Message{
+			"In": "app.log", "Persist": "tail",
+		}, func(next func() flow.Message) {
+			for i := 0; i < n; i++ {
+				next()
+			}
+		})
+	}
+
+	open := flow.Tag{"<open>", "app.log"}
+	if got, want := run(3), []flow.Message{open, "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// carry on after a restart
+	appendTo(fs, "app.log", "c\n")
+	if got, want := run(2), []flow.Message{open, "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after restart: expected %v, got %v", want, got)
+	}
+
+	// but not when the file has been replaced meanwhile
+	fs.Remove("app.log")
+	appendTo(fs, "app.log", "z\n")
+	if got, want := run(2), []flow.Message{open, "z"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after replacing: expected %v, got %v", want, got)
+	}
+}
+
+func TestTailFilePoll(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(name, []byte("a\n"), 0666)
+	clock := flow.NewManualTime(time.Unix(0, 0))
+
+	open := flow.Tag{"<open>", "app.log"}
+	got := follow(t, &TailFile{FS: filesystem.NewDirFS(dir), Clock: clock},
+		map[string]flow.Message{
+			"In": "app.log", "Poll": "1s",
+		}, func(next func() flow.Message) {
+			next()
+			next()
+			appendTo(filesystem.NewDirFS(dir), "app.log", "b\n")
+			clock.Advance(time.Second)
+			next()
+
+			os.Rename(name, name+".1")
+			ioutil.WriteFile(name, []byte("c\n"), 0666)
+			clock.Advance(time.Second)
+			next()
+			next()
+		})
+
+	want := []flow.Message{open, "a", "b", open, "c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
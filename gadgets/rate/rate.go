@@ -0,0 +1,384 @@
+// Gadgets which limit the rate of messages, or collapse bursts of them.
+package rate
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+
+	"github.com/laughlinez/flow"
+)
+
+func init() {
+	flow.Registry["RateLimit"] = func() flow.Circuitry { return new(RateLimit) }
+	flow.Registry["Throttle"] = func() flow.Circuitry { return new(Throttle) }
+	flow.Registry["Debounce"] = func() flow.Circuitry { return new(Debounce) }
+}
+
+// All the gadgets in this package can work per key: if a field name is sent to
+// the Key pin, PacketMaps are handled separately for each value of that field.
+// Tags are always passed on right away. Time is told by the Clock, which is the
+// system time by default. Bad settings are reported on the Err pin, and then
+// all messages are passed on unchanged.
+
+// RateLimit passes on messages at no more than the rate set on the Rate pin,
+// as a number of messages per second, or as the duration between messages.
+// Short bursts are allowed up to the number set on the Burst pin (1 by default).
+// This is a token bucket: tokens are added at the given rate, up to the burst
+// size, and each message takes one. If the Mode pin is set to "drop", messages
+// for which there is no token are dropped, else they are queued until there is
+// (the default, "queue"). Queued messages are still sent out at the given rate
+// after the In pin has been closed. Registers as "RateLimit".
+type RateLimit struct {
+	flow.Gadget
+	Rate  flow.Input
+	Burst flow.Input
+	Mode  flow.Input
+	Key   flow.Input
+	In    flow.Input
+	Out   flow.Output
+	Err   flow.Output
+
+	Clock flow.TimeSource
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time // when tokens were last added
+	queue  []flow.Message
+}
+
+// Start limiting the rate.
+func (g *RateLimit) Run() {
+	r := <-g.Rate
+	rate, ok := flow.Number(r)
+	if d, err := durationOf(r); err == nil {
+		rate, ok = float64(time.Second)/float64(d), true
+	}
+	burst, drop := 1.0, false
+	if m, isSet := <-g.Burst; isSet && ok && rate > 0 {
+		r = m
+		burst, ok = flow.Number(m)
+	}
+	if m, isSet := <-g.Mode; isSet && ok && rate > 0 && burst >= 1 {
+		r = m
+		drop, ok = m == "drop", m == "drop" || m == "queue"
+	}
+	if !ok || rate <= 0 || burst < 1 {
+		g.Err.Send(g.Error(fmt.Errorf("rate: bad setting: %v", r), r))
+		flow.PassThrough(g.In, g.Out)
+		return
+	}
+	clock := clockOf(g.Clock)
+	key := keyField(g.Key)
+
+	buckets := map[string]*bucket{}
+	refill := func(b *bucket, now time.Time) {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	}
+
+	// send out whatever can be sent, and set the alarm for the next token
+	wake := flow.NewAlarm(clock)
+	drain := func() {
+		now := clock.Now()
+		var next time.Time
+		for k, b := range buckets {
+			refill(b, now)
+			for len(b.queue) > 0 && b.tokens >= 1 {
+				b.tokens--
+				g.Out.Send(b.queue[0])
+				b.queue = b.queue[1:]
+			}
+			if len(b.queue) > 0 {
+				at := now.Add(time.Duration((1 - b.tokens) / rate * float64(time.Second)))
+				if next.IsZero() || at.Before(next) {
+					next = at
+				}
+			} else if b.tokens >= burst {
+				delete(buckets, k) // a new bucket would be the same
+			}
+		}
+		wake.Set(next)
+	}
+
+	in := g.In
+	for in != nil || !wake.At().IsZero() {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			if _, ok := m.(flow.Tag); ok {
+				g.Out.Send(m)
+				continue
+			}
+			k := flow.KeyOf(m, key)
+			now := clock.Now()
+			b := buckets[k]
+			if b == nil {
+				b = &bucket{tokens: burst, last: now}
+				buckets[k] = b
+			}
+			refill(b, now)
+			switch {
+			case len(b.queue) == 0 && b.tokens >= 1:
+				b.tokens--
+				g.Out.Send(m)
+			case !drop:
+				b.queue = append(b.queue, m)
+			}
+			drain() // also forgets about buckets which are full again
+		case <-wake.C:
+			wake.Clear()
+			drain()
+		}
+	}
+}
+
+// Throttle passes on at most one message per interval, as set on the Interval
+// pin. With the Mode pin set to "first" (the default), the first message is
+// sent out right away, and the rest is dropped until the interval is over.
+// With "latest", the first message starts an interval, and at the end of it
+// the last message received in that interval is sent out. Pending messages are
+// sent out when the In pin is closed. Registers as "Throttle".
+type Throttle struct {
+	flow.Gadget
+	Interval flow.Input
+	Mode     flow.Input
+	Key      flow.Input
+	In       flow.Input
+	Out      flow.Output
+	Err      flow.Output
+
+	Clock flow.TimeSource
+}
+
+// the state of one key, for Throttle and Debounce
+type pending struct {
+	key    string
+	until  time.Time    // end of the current interval, or quiet period
+	latest flow.Message // message to send out at that time
+	has    bool         // true if there is a latest message
+	index  int          // position in the schedule's queue
+}
+
+// Start throttling.
+func (g *Throttle) Run() {
+	r := <-g.Interval
+	interval, err := durationOf(r)
+	latest := false
+	if m, ok := <-g.Mode; ok && err == nil {
+		switch m {
+		case "latest":
+			latest = true
+		case "first":
+		default:
+			err = fmt.Errorf("rate: unknown mode: %v", m)
+			r = m
+		}
+	}
+	if err != nil {
+		g.Err.Send(g.Error(err, r))
+		flow.PassThrough(g.In, g.Out)
+		return
+	}
+	clock := clockOf(g.Clock)
+	key := keyField(g.Key)
+	keys := newSchedule()
+	wake := flow.NewAlarm(clock)
+
+	for {
+		select {
+		case m, ok := <-g.In:
+			if !ok {
+				keys.flush(g.Out)
+				return
+			}
+			if _, ok := m.(flow.Tag); ok {
+				g.Out.Send(m)
+				continue
+			}
+			now := clock.Now()
+			keys.expire(now, g.Out)
+			k := flow.KeyOf(m, key)
+			p := keys.byKey[k]
+			switch {
+			case p == nil && !latest:
+				keys.put(&pending{key: k, until: now.Add(interval)})
+				g.Out.Send(m)
+			case p == nil:
+				keys.put(&pending{key: k, until: now.Add(interval), latest: m, has: true})
+			case latest:
+				p.latest, p.has = m, true
+			}
+			wake.Set(keys.first())
+		case <-wake.C:
+			wake.Clear()
+			keys.expire(clock.Now(), g.Out)
+			wake.Set(keys.first())
+		}
+	}
+}
+
+// Debounce sends out a message once no other message has come in for the
+// duration set on the Quiet pin, i.e. the last one of each burst. Pending
+// messages are sent out when the In pin is closed. Registers as "Debounce".
+type Debounce struct {
+	flow.Gadget
+	Quiet flow.Input
+	Key   flow.Input
+	In    flow.Input
+	Out   flow.Output
+	Err   flow.Output
+
+	Clock flow.TimeSource
+}
+
+// Start debouncing.
+func (g *Debounce) Run() {
+	r := <-g.Quiet
+	quiet, err := durationOf(r)
+	if err != nil {
+		g.Err.Send(g.Error(err, r))
+		flow.PassThrough(g.In, g.Out)
+		return
+	}
+	clock := clockOf(g.Clock)
+	key := keyField(g.Key)
+	keys := newSchedule()
+	wake := flow.NewAlarm(clock)
+
+	for {
+		select {
+		case m, ok := <-g.In:
+			if !ok {
+				keys.flush(g.Out)
+				return
+			}
+			if _, ok := m.(flow.Tag); ok {
+				g.Out.Send(m)
+				continue
+			}
+			now := clock.Now()
+			keys.expire(now, g.Out)
+			k := flow.KeyOf(m, key)
+			keys.put(&pending{key: k, until: now.Add(quiet), latest: m, has: true})
+			wake.Set(keys.first())
+		case <-wake.C:
+			wake.Clear()
+			keys.expire(clock.Now(), g.Out)
+			wake.Set(keys.first())
+		}
+	}
+}
+
+// The pending keys of Throttle and Debounce, in the order in which they are
+// done, so that the first ones can be found without looking at all of them.
+type schedule struct {
+	byKey map[string]*pending
+	queue pendingQueue
+}
+
+func newSchedule() *schedule {
+	return &schedule{byKey: map[string]*pending{}}
+}
+
+// Add a key, or replace it if it is already pending.
+func (s *schedule) put(p *pending) {
+	if old, ok := s.byKey[p.key]; ok {
+		p.index = old.index
+		s.queue[p.index] = p
+		heap.Fix(&s.queue, p.index)
+	} else {
+		heap.Push(&s.queue, p)
+	}
+	s.byKey[p.key] = p
+}
+
+// Send out the latest message for all keys which are done, in time order.
+func (s *schedule) expire(now time.Time, out flow.Output) {
+	for len(s.queue) > 0 && !now.Before(s.queue[0].until) {
+		s.pop(out)
+	}
+}
+
+// Send out all pending messages, in time order.
+func (s *schedule) flush(out flow.Output) {
+	for len(s.queue) > 0 {
+		s.pop(out)
+	}
+}
+
+func (s *schedule) pop(out flow.Output) {
+	p := heap.Pop(&s.queue).(*pending)
+	delete(s.byKey, p.key)
+	if p.has {
+		out.Send(p.latest)
+	}
+}
+
+// The time at which the first key will be done, or zero if there are none.
+func (s *schedule) first() time.Time {
+	if len(s.queue) == 0 {
+		return time.Time{}
+	}
+	return s.queue[0].until
+}
+
+// A heap of pending keys, see container/heap.
+type pendingQueue []*pending
+
+func (q pendingQueue) Len() int { return len(q) }
+func (q pendingQueue) Less(i, j int) bool {
+	if !q[i].until.Equal(q[j].until) {
+		return q[i].until.Before(q[j].until)
+	}
+	return q[i].key < q[j].key
+}
+func (q pendingQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *pendingQueue) Push(x interface{}) {
+	p := x.(*pending)
+	p.index = len(*q)
+	*q = append(*q, p)
+}
+func (q *pendingQueue) Pop() interface{} {
+	old := *q
+	p := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return p
+}
+
+func clockOf(clock flow.TimeSource) flow.TimeSource {
+	if clock == nil {
+		return flow.SystemTime
+	}
+	return clock
+}
+
+func keyField(pin flow.Input) string {
+	if m, ok := <-pin; ok {
+		s, _ := m.(string)
+		return s
+	}
+	return ""
+}
+
+func durationOf(m flow.Message) (time.Duration, error) {
+	d, err := flow.ParseDuration(m)
+	if err != nil {
+		return 0, fmt.Errorf("rate: %v", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("rate: duration must be positive: %v", m)
+	}
+	return d, nil
+}
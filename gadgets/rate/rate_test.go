@@ -0,0 +1,204 @@
+package rate
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/flowtest"
+)
+
+var syncTag = flow.Tag{"<sync>", nil}
+
+// A driver sends messages to a gadget running on a manual clock.
+type driver struct {
+	emit  func(flow.Message)
+	clock *flow.ManualTime
+	out   *flowtest.Collector
+}
+
+// Wait until all messages sent so far have been handled, then move the clock.
+func (d *driver) step(dt time.Duration) {
+	d.emit(syncTag)
+	for d.next() != syncTag {
+	}
+	d.clock.Advance(dt)
+}
+
+// Wait for the next message sent out.
+func (d *driver) next() flow.Message {
+	return <-d.out.Seen
+}
+
+// Run a gadget on a manual clock, with the given settings and a function which
+// drives it. Returns all messages sent out, without the sync tags.
+func script(g flow.Circuitry, clock *flow.ManualTime, feeds map[string]flow.Message,
+	fun func(d *driver)) []flow.Message {
+	out := &flowtest.Collector{Seen: make(chan flow.Message, 100)}
+	c := flow.NewCircuit()
+	c.AddCircuitry("g", g)
+	c.AddCircuitry("o", out)
+	c.AddCircuitry("s", flow.Source(func(emit func(flow.Message)) {
+		fun(&driver{emit, clock, out})
+	}))
+	c.Connect("s.Out", "g.In", 0)
+	c.Connect("g.Out", "o.In", 0)
+	for pin, m := range feeds {
+		c.Feed("g."+pin, m)
+	}
+	c.Run()
+
+	var r []flow.Message
+	for _, m := range out.Msgs {
+		if m != syncTag {
+			r = append(r, m)
+		}
+	}
+	return r
+}
+
+func TestRateLimitDrop(t *testing.T) {
+	clock := flow.NewManualTime(time.Unix(0, 0))
+	got := script(&RateLimit{Clock: clock}, clock, map[string]flow.Message{
+		"Rate": 2, "Burst": 2, "Mode": "drop",
+	}, func(d *driver) {
+		for i := 1; i <= 4; i++ {
+			d.emit(i) // only 1 and 2 get through, the burst
+		}
+		d.step(500 * time.Millisecond)
+		d.emit(5) // one new token
+		d.emit(6)
+	})
+	if want := []flow.Message{1, 2, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestRateLimitDropKeys(t *testing.T) {
+	clock := flow.NewManualTime(time.Unix(0, 0))
+	got := script(&RateLimit{Clock: clock}, clock, map[string]flow.Message{
+		"Rate": "1s", "Mode": "drop", "Key": "k",
+	}, func(d *driver) {
+		d.emit(flow.PacketMap{"k": "a", "n": 1})
+		d.emit(flow.PacketMap{"k": "b", "n": 2})
+		d.emit(flow.PacketMap{"k": "a", "n": 3}) // dropped
+		d.step(time.Second)                      // both buckets are full again
+		d.emit(flow.PacketMap{"k": "b", "n": 4})
+		d.emit(flow.PacketMap{"k": "a", "n": 5})
+		d.emit(flow.PacketMap{"k": "a", "n": 6}) // dropped
+	})
+	var order []interface{}
+	for _, m := range got {
+		order = append(order, m.(flow.PacketMap)["n"])
+	}
+	if want := []interface{}{1, 2, 4, 5}; !reflect.DeepEqual(order, want) {
+		t.Errorf("expected %v, got %v", want, order)
+	}
+}
+
+func TestRateLimitQueue(t *testing.T) {
+	clock := flow.NewManualTime(time.Unix(0, 0))
+	got := script(&RateLimit{Clock: clock}, clock, map[string]flow.Message{
+		"Rate": "1s", "Key": "k",
+	}, func(d *driver) {
+		d.emit(flow.PacketMap{"k": "a", "n": 1})
+		d.emit(flow.PacketMap{"k": "a", "n": 2})
+		d.emit(flow.PacketMap{"k": "b", "n": 3})
+		d.emit(flow.PacketMap{"k": "a", "n": 4})
+		d.step(time.Second)
+		for d.next() == syncTag { // wait for 2 to be sent out
+		}
+		d.clock.Advance(time.Second) // after which 4 follows
+	})
+	var order []interface{}
+	for _, m := range got {
+		order = append(order, m.(flow.PacketMap)["n"])
+	}
+	if want := []interface{}{1, 3, 2, 4}; !reflect.DeepEqual(order, want) {
+		t.Errorf("expected %v, got %v", want, order)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	for mode, want := range map[string][]flow.Message{
+		"first":  {1, 4},
+		"latest": {3, 5},
+	} {
+		clock := flow.NewManualTime(time.Unix(0, 0))
+		got := script(&Throttle{Clock: clock}, clock, map[string]flow.Message{
+			"Interval": "1s", "Mode": mode,
+		}, func(d *driver) {
+			d.emit(1)
+			d.step(500 * time.Millisecond)
+			d.emit(2)
+			d.emit(3)
+			d.step(600 * time.Millisecond)
+			d.emit(4)
+			d.emit(5) // pending at the end, for "latest"
+		})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, got %v", mode, want, got)
+		}
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	clock := flow.NewManualTime(time.Unix(0, 0))
+	got := script(&Debounce{Clock: clock}, clock, map[string]flow.Message{
+		"Quiet": "1s", "Key": "k",
+	}, func(d *driver) {
+		d.emit(flow.PacketMap{"k": "a", "n": 1})
+		d.step(500 * time.Millisecond)
+		d.emit(flow.PacketMap{"k": "a", "n": 2})
+		d.emit(flow.PacketMap{"k": "b", "n": 3})
+		d.step(500 * time.Millisecond)
+		d.emit(flow.PacketMap{"k": "b", "n": 4})
+		d.step(time.Second) // a and b are both quiet now
+		d.emit(flow.PacketMap{"k": "a", "n": 5})
+	})
+	var order []interface{}
+	for _, m := range got {
+		order = append(order, m.(flow.PacketMap)["n"])
+	}
+	if want := []interface{}{2, 4, 5}; !reflect.DeepEqual(order, want) {
+		t.Errorf("expected %v, got %v", want, order)
+	}
+}
+
+func TestDebounceManyKeys(t *testing.T) {
+	clock := flow.NewManualTime(time.Unix(0, 0))
+	got := script(&Debounce{Clock: clock}, clock, map[string]flow.Message{
+		"Quiet": "1s", "Key": "k",
+	}, func(d *driver) {
+		for _, k := range "edcba" {
+			d.emit(flow.PacketMap{"k": string(k)})
+			d.step(100 * time.Millisecond)
+		}
+		d.emit(flow.PacketMap{"k": "d"}) // restarts d, which now comes last
+	})
+	var order string
+	for _, m := range got {
+		order += m.(flow.PacketMap)["k"].(string)
+	}
+	if order != "ecbad" {
+		t.Errorf("expected ecbad, got %s", order)
+	}
+}
+
+func TestBadSetting(t *testing.T) {
+	g := flow.NewCircuit()
+	out, errs := &flowtest.Collector{Seen: make(chan flow.Message, 10)}, &flowtest.Collector{Seen: make(chan flow.Message, 10)}
+	g.AddCircuitry("r", new(RateLimit))
+	g.AddCircuitry("o", out)
+	g.AddCircuitry("e", errs)
+	g.Connect("r.Out", "o.In", 0)
+	g.Connect("r.Err", "e.In", 0)
+	g.Feed("r.Rate", 10)
+	g.Feed("r.Mode", "bounce")
+	g.Feed("r.In", 1)
+	g.Run()
+	if len(errs.Msgs) != 1 || !reflect.DeepEqual(out.Msgs, []flow.Message{1}) {
+		t.Errorf("expected an error and pass-through, got %v and %v", errs.Msgs, out.Msgs)
+	}
+}
@@ -0,0 +1,391 @@
+package router
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/laughlinez/flow"
+)
+
+// An Expr is a compiled rule expression, which can be evaluated against
+// messages. The syntax is similar to Go's:
+//
+//	temp > 20 && meta.device == "rf12"
+//	!(name =~ "^room[0-9]+$") || $ == "reset"
+//
+// Names refer to fields of PacketMaps (or any other map[string]interface{}),
+// dotted names to fields of nested maps, and "$" to the message itself. Fields
+// which don't exist evaluate to null. Literals are numbers, strings in single
+// or double quotes, true, false, and null.
+//
+// Operators, from low to high precedence: || && (== != < <= > >= =~ !~) !
+// Comparisons between numbers of any type are numeric, between strings they
+// are lexical, and only == and != apply to other values. A comparison with
+// mismatched types is false. The right side of =~ and !~ must be a string
+// literal, with a regular expression as accepted by the regexp package.
+// Values used as a condition are true if not false, null, zero, or empty.
+type Expr struct {
+	src  string
+	root node
+}
+
+// Compile an expression, reporting syntax errors with their position.
+func Compile(src string) (*Expr, error) {
+	p := &parser{src: src}
+	p.next()
+	root, err := p.parseOr()
+	if err == nil && p.err != nil {
+		err = p.err
+	}
+	if err == nil && p.tok.kind != tEOF {
+		err = p.errorf("unexpected %q", p.tok.text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Expr{src, root}, nil
+}
+
+// Evaluate the expression against a message.
+func (e *Expr) Eval(m flow.Message) interface{} {
+	return e.root.eval(m)
+}
+
+// Evaluate the expression as a condition.
+func (e *Expr) Match(m flow.Message) bool {
+	return truth(e.root.eval(m))
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+//===== evaluation =====
+
+type node interface {
+	eval(m flow.Message) interface{}
+}
+
+type literal struct{ value interface{} }
+
+func (n literal) eval(m flow.Message) interface{} { return n.value }
+
+type field struct{ path []string } // empty path is the message itself
+
+func (n field) eval(m flow.Message) interface{} {
+	var x interface{} = m
+	for _, name := range n.path {
+		switch v := x.(type) {
+		case flow.PacketMap:
+			x = v[name]
+		case map[string]interface{}:
+			x = v[name]
+		default:
+			return nil
+		}
+	}
+	return x
+}
+
+type not struct{ x node }
+
+func (n not) eval(m flow.Message) interface{} { return !truth(n.x.eval(m)) }
+
+type logical struct {
+	and  bool
+	x, y node
+}
+
+func (n logical) eval(m flow.Message) interface{} {
+	if truth(n.x.eval(m)) != n.and {
+		return !n.and // short-circuit
+	}
+	return truth(n.y.eval(m))
+}
+
+type compare struct {
+	op   string
+	x, y node
+}
+
+func (n compare) eval(m flow.Message) interface{} {
+	a, b := n.x.eval(m), n.y.eval(m)
+	if fa, ok := flow.Number(a); ok {
+		if fb, ok := flow.Number(b); ok {
+			return ordered(n.op, fa < fb, fa == fb)
+		}
+	}
+	if sa, ok := a.(string); ok {
+		if sb, ok := b.(string); ok {
+			return ordered(n.op, sa < sb, sa == sb)
+		}
+	}
+	switch n.op {
+	case "==":
+		return flow.Equal(a, b)
+	case "!=":
+		return !flow.Equal(a, b)
+	}
+	return false
+}
+
+func ordered(op string, less, eq bool) bool {
+	switch op {
+	case "==":
+		return eq
+	case "!=":
+		return !eq
+	case "<":
+		return less
+	case "<=":
+		return less || eq
+	case ">":
+		return !less && !eq
+	}
+	return !less // ">="
+}
+
+type match struct {
+	re     *regexp.Regexp
+	negate bool
+	x      node
+}
+
+func (n match) eval(m flow.Message) interface{} {
+	var s string
+	switch v := n.x.eval(m).(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case nil:
+		return n.negate
+	default:
+		s = fmt.Sprint(v)
+	}
+	return n.re.MatchString(s) != n.negate
+}
+
+func truth(x interface{}) bool {
+	if f, ok := flow.Number(x); ok {
+		return f != 0
+	}
+	switch v := x.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case []byte:
+		return len(v) > 0
+	}
+	return true
+}
+
+//===== parsing =====
+
+const (
+	tEOF = iota
+	tName
+	tNumber
+	tString
+	tOp
+)
+
+type token struct {
+	kind int
+	text string // for strings: the unquoted value
+	pos  int
+}
+
+type parser struct {
+	src string
+	pos int
+	tok token
+	err error // from the scanner
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("expression %q at %d: %s", p.src, p.tok.pos+1,
+		fmt.Sprintf(format, args...))
+}
+
+var operators = []string{"||", "&&", "==", "!=", "<=", ">=", "=~", "!~",
+	"<", ">", "!", "(", ")"}
+
+// Scan the next token.
+func (p *parser) next() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	start := p.pos
+	p.tok = token{pos: start}
+	if p.pos >= len(p.src) {
+		return
+	}
+
+	c := p.src[p.pos]
+	switch {
+	case c == '"' || c == '\'':
+		end := p.pos + 1
+		for end < len(p.src) && p.src[end] != c {
+			if p.src[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(p.src) {
+			p.err = p.errorf("unterminated string")
+			p.pos = len(p.src)
+			return
+		}
+		text := p.src[p.pos : end+1]
+		if c == '\'' { // requote, so that strconv can handle it
+			text = `"` + strings.Replace(text[1:len(text)-1], `"`, `\"`, -1) + `"`
+		}
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			p.err = p.errorf("bad string: %v", err)
+		}
+		p.tok = token{tString, s, start}
+		p.pos = end + 1
+	case c >= '0' && c <= '9' || c == '-' || c == '.':
+		end := p.pos + 1
+		for end < len(p.src) && strings.IndexByte("0123456789.eE+-", p.src[end]) >= 0 &&
+			!((p.src[end] == '+' || p.src[end] == '-') && !strings.ContainsAny(p.src[end-1:end], "eE")) {
+			end++
+		}
+		p.tok = token{tNumber, p.src[p.pos:end], start}
+		p.pos = end
+	case c == '$' || c == '_' || unicode.IsLetter(rune(c)):
+		end := p.pos + 1
+		for end < len(p.src) && (p.src[end] == '_' || p.src[end] == '.' ||
+			unicode.IsLetter(rune(p.src[end])) || unicode.IsDigit(rune(p.src[end]))) {
+			end++
+		}
+		p.tok = token{tName, p.src[p.pos:end], start}
+		p.pos = end
+	default:
+		for _, op := range operators {
+			if strings.HasPrefix(p.src[p.pos:], op) {
+				p.tok = token{tOp, op, start}
+				p.pos += len(op)
+				return
+			}
+		}
+		p.err = p.errorf("unexpected %q", string(c))
+		p.pos = len(p.src)
+	}
+}
+
+func (p *parser) parseOr() (node, error) {
+	x, err := p.parseAnd()
+	for err == nil && p.tok.text == "||" && p.tok.kind == tOp {
+		p.next()
+		var y node
+		y, err = p.parseAnd()
+		x = logical{false, x, y}
+	}
+	return x, err
+}
+
+func (p *parser) parseAnd() (node, error) {
+	x, err := p.parseCompare()
+	for err == nil && p.tok.text == "&&" && p.tok.kind == tOp {
+		p.next()
+		var y node
+		y, err = p.parseCompare()
+		x = logical{true, x, y}
+	}
+	return x, err
+}
+
+func (p *parser) parseCompare() (node, error) {
+	x, err := p.parseUnary()
+	if err != nil || p.tok.kind != tOp {
+		return x, err
+	}
+	switch op := p.tok.text; op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+		y, err := p.parseUnary()
+		return compare{op, x, y}, err
+	case "=~", "!~":
+		p.next()
+		if p.err != nil {
+			return nil, p.err
+		}
+		if p.tok.kind != tString {
+			return nil, p.errorf("expected a regular expression string")
+		}
+		re, err := regexp.Compile(p.tok.text)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		p.next()
+		return match{re, op == "!~", x}, nil
+	}
+	return x, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	tok := p.tok
+	switch tok.kind {
+	case tEOF:
+		return nil, p.errorf("unexpected end")
+	case tString:
+		p.next()
+		return literal{tok.text}, nil
+	case tNumber:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("bad number %q", tok.text)
+		}
+		p.next()
+		return literal{f}, nil
+	case tName:
+		p.next()
+		switch tok.text {
+		case "true":
+			return literal{true}, nil
+		case "false":
+			return literal{false}, nil
+		case "null":
+			return literal{nil}, nil
+		case "$":
+			return field{}, nil
+		}
+		path := strings.Split(strings.TrimPrefix(tok.text, "$."), ".")
+		for _, name := range path {
+			if name == "" || strings.Contains(name, "$") {
+				return nil, p.errorf("bad field name %q", tok.text)
+			}
+		}
+		return field{path}, nil
+	}
+	switch tok.text {
+	case "!":
+		p.next()
+		x, err := p.parseUnary()
+		return not{x}, err
+	case "(":
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.text != ")" || p.tok.kind != tOp {
+			return nil, p.errorf("expected )")
+		}
+		p.next()
+		return x, nil
+	}
+	return nil, p.errorf("unexpected %q", tok.text)
+}
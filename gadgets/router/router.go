@@ -0,0 +1,125 @@
+// Content-based routing of messages, using rule expressions.
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/laughlinez/flow"
+)
+
+func init() {
+	flow.Registry["Router"] = func() flow.Circuitry { return new(Router) }
+}
+
+// A Router sends each message to one of its outputs, based on a list of rules
+// such as [{"when": "temp > 20", "to": "hot"}, {"when": "temp < 5", "to": "cold"}],
+// see Expr for the syntax of the expressions. The first matching rule wins,
+// messages which don't match any rule are sent to Else, as are messages routed
+// to an output which is not connected. Rules are taken from the Rules pin, as
+// a list or as JSON text, and can be replaced while running. The outputs are
+// named as in "Out:hot". Registers as "Router".
+type Router struct {
+	flow.Gadget
+	Rules flow.Input
+	In    flow.Input
+	Out   map[string]flow.Output
+	Else  flow.Output
+}
+
+// A Rule routes all messages matching an expression to a named output.
+type Rule struct {
+	When string `json:"when"`
+	To   string `json:"to"`
+}
+
+type rule struct {
+	expr *Expr
+	to   string
+}
+
+// Start routing messages.
+func (g *Router) Run() {
+	var rules []rule
+	in, updates := g.In, g.Rules
+	if m, ok := <-updates; ok {
+		rules = g.compile(m)
+	} else {
+		updates = nil
+	}
+
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return
+			}
+			g.route(rules, m)
+		case m, ok := <-updates:
+			if !ok {
+				updates = nil
+				continue
+			}
+			rules = g.compile(m)
+		}
+	}
+}
+
+func (g *Router) route(rules []rule, m flow.Message) {
+	for _, r := range rules {
+		if r.expr.Match(m) {
+			if out, ok := g.Out[r.to]; ok {
+				out.Send(m)
+				return
+			}
+			break
+		}
+	}
+	g.Else.Send(m)
+}
+
+// Compile a new set of rules, bad ones are reported and left out.
+func (g *Router) compile(m flow.Message) []rule {
+	list, err := parseRules(m)
+	if err != nil {
+		glog.Errorln("router:", err)
+		return nil
+	}
+	rules := []rule{}
+	for _, r := range list {
+		e, err := Compile(r.When)
+		if err != nil {
+			glog.Errorln("router:", err)
+			continue
+		}
+		if _, ok := g.Out[r.To]; !ok {
+			glog.Warningf("router: output %q is not connected", r.To)
+		}
+		rules = append(rules, rule{e, r.To})
+	}
+	return rules
+}
+
+// Accepts a list of Rules, decoded JSON, or JSON text.
+func parseRules(m flow.Message) ([]Rule, error) {
+	var data []byte
+	switch v := m.(type) {
+	case []Rule:
+		return v, nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("bad rules: %v", err)
+	}
+	return rules, nil
+}
@@ -0,0 +1,79 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/flowtest"
+)
+
+var msg = flow.PacketMap{"temp": 21.5, "count": 3, "name": "room12",
+	"meta": map[string]interface{}{"device": "rf12", "ok": true}}
+
+func TestExpr(t *testing.T) {
+	tests := map[string]bool{
+		`temp > 20`:                     true,
+		`temp >= 21.5 && count == 3`:    true,
+		`count < 3 || name == "room12"`: true,
+		`meta.device == 'rf12'`:         true,
+		`meta.ok && !meta.missing`:      true,
+		`missing == null`:               true,
+		`missing > 0`:                   false,
+		`name =~ "^room[0-9]+$"`:        true,
+		`name !~ "^room"`:               false,
+		`count =~ "^3$"`:                true,
+		`!(temp < 0 || count != 3)`:     true,
+		`name > 3`:                      false,
+		`meta == meta`:                  false,
+		`$.temp == temp && $ != null`:   true,
+		`"abc" < "abd" && -1.5e1 < -14`: true,
+		`meta.device.x == null && temp`: true,
+	}
+	for src, want := range tests {
+		e, err := Compile(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if got := e.Match(msg); got != want {
+			t.Errorf("%s: got %v, want %v", src, got, want)
+		}
+	}
+
+	if e, _ := Compile(`$ == "reset"`); !e.Match("reset") || e.Match(msg) {
+		t.Error("$ does not refer to the message")
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	for _, src := range []string{``, `temp >`, `(temp > 1`, `temp > 1)`,
+		`name =~ name`, `name =~ "("`, `"abc`, `temp # 1`, `a..b == 1`} {
+		if _, err := Compile(src); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	hot, cold, other := new(flowtest.Collector), new(flowtest.Collector), new(flowtest.Collector)
+	g := flow.NewCircuit()
+	g.Add("r", "Router")
+	g.AddCircuitry("hot", hot)
+	g.AddCircuitry("cold", cold)
+	g.AddCircuitry("other", other)
+	g.Connect("r.Out:hot", "hot.In", 0)
+	g.Connect("r.Out:cold", "cold.In", 0)
+	g.Connect("r.Else", "other.In", 0)
+	g.Feed("r.Rules", `[{"when": "temp > 20", "to": "hot"},
+		{"when": "temp < 5", "to": "cold"},
+		{"when": "temp < 10", "to": "chilly"}]`)
+	for _, v := range []float64{25, 0, 12, 7, 30} {
+		g.Feed("r.In", flow.PacketMap{"temp": v})
+	}
+	g.Feed("r.In", "abc")
+	g.Run()
+
+	if len(hot.Msgs) != 2 || len(cold.Msgs) != 1 || len(other.Msgs) != 3 {
+		t.Errorf("unexpected routing: %v / %v / %v", hot.Msgs, cold.Msgs, other.Msgs)
+	}
+}
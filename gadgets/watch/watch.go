@@ -0,0 +1,326 @@
+// Gadgets which report changes in the filesystem.
+package watch
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/api"
+)
+
+func init() {
+	flow.Registry["WatchDir"] = func() flow.Circuitry { return new(WatchDir) }
+}
+
+// WatchDir takes strings that are directory names, and reports each change to
+// the entries in those directories as a PacketMap, with the name of the entry,
+// the operation ("create", "write", "remove", or "rename"), and the directory
+// being watched as "root". Send true to the Recursive pin to also watch all
+// subdirectories, including new ones. Send one or more glob patterns to the
+// Pattern pin to only report matching entries, patterns are matched against
+// the base name, and against the name relative to the root if they contain
+// a slash (see path.Match for the syntax).
+//
+// A duration sent to the Debounce pin (i.e. "100ms") turns each burst of
+// changes to the same entry into a single event, sent once there have been
+// no further changes for that long. A create or write is reported as such,
+// unless the entry was removed or renamed by the end of the burst.
+//
+// Stops once the input closes, or the circuit is cancelled. To keep watching
+// a fixed set of directories, connect a Forever gadget to the input as well.
+// Registers as "WatchDir".
+type WatchDir struct {
+	flow.Gadget
+	Recursive flow.Input
+	Pattern   flow.Input
+	Debounce  flow.Input
+	In        flow.Input
+	Out       flow.Output
+	Err       flow.Output
+
+	FS    api.IFileSystemAPI `gadget:"FilesystemAPI"`
+	Clock flow.TimeSource
+}
+
+// an event, along with the watch it came from
+type change struct {
+	api.FileEvent
+	dir string
+}
+
+// a change waiting for the end of its burst
+type pending struct {
+	event flow.PacketMap
+	until time.Time
+}
+
+// the state of a running WatchDir
+type watcher struct {
+	*WatchDir
+	recursive bool
+	patterns  []string
+	changes   chan change
+	stops     map[string]func() // all watched directories
+	roots     map[string]bool   // the directories being watched explicitly
+}
+
+// Start watching directories.
+func (g *WatchDir) Run() {
+	w := &watcher{
+		WatchDir: g,
+		changes:  make(chan change),
+		stops:    map[string]func(){},
+		roots:    map[string]bool{},
+	}
+	defer func() {
+		for _, stop := range w.stops {
+			stop()
+		}
+	}()
+	if m, ok := <-g.Recursive; ok {
+		w.recursive, _ = m.(bool)
+	}
+	if m, ok := <-g.Pattern; ok {
+		if w.patterns = stringsOf(m); w.patterns == nil {
+			g.Err.Send(g.Error(fmt.Errorf("watchdir: bad pattern: %v", m), m))
+		}
+		for _, p := range w.patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				g.Err.Send(g.Error(fmt.Errorf("watchdir: bad pattern: %s", p), m))
+			}
+		}
+	}
+	var quiet time.Duration
+	if m, ok := <-g.Debounce; ok {
+		if d, err := flow.ParseDuration(m); err == nil && d >= 0 {
+			quiet = d
+		} else {
+			g.Err.Send(g.Error(fmt.Errorf("watchdir: bad debounce: %v", m), m))
+		}
+	}
+	clock := g.Clock
+	if clock == nil {
+		clock = flow.SystemTime
+	}
+
+	bursts := map[string]*pending{}
+	wake := flow.NewAlarm(clock)
+	for {
+		select {
+		case m, ok := <-g.In:
+			if !ok {
+				flush(bursts, time.Time{}, g.Out)
+				return
+			}
+			dir, ok := m.(string)
+			if !ok {
+				g.Out.Send(m)
+				continue
+			}
+			w.roots[cleanDir(dir)] = true
+			if err := w.watch(cleanDir(dir)); err != nil {
+				g.Err.Send(g.Error(err, m))
+			}
+		case c := <-w.changes:
+			event := w.handle(c)
+			if event == nil {
+				continue
+			}
+			if quiet == 0 {
+				g.Out.Send(event)
+				continue
+			}
+			name := event["name"].(string)
+			if p := bursts[name]; p != nil {
+				event["op"] = merge(p.event["op"], event["op"])
+			}
+			bursts[name] = &pending{event, clock.Now().Add(quiet)}
+			wake.Set(first(bursts))
+		case <-wake.C:
+			wake.Clear()
+			flush(bursts, clock.Now(), g.Out)
+			wake.Set(first(bursts))
+		case <-g.Done():
+			return
+		}
+	}
+}
+
+// Watch a directory, and all its subdirectories if recursive. Each watch gets
+// its own channel, so that events can be traced back to the directory.
+func (w *watcher) watch(dir string) error {
+	if _, ok := w.stops[dir]; ok {
+		return nil
+	}
+	events := make(chan api.FileEvent)
+	stop, err := w.FS.Watch(dir, events)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	w.stops[dir] = func() {
+		stop()
+		close(done)
+	}
+	go func() {
+		for {
+			select {
+			case ev := <-events:
+				select {
+				case w.changes <- change{ev, dir}:
+				case <-done:
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if !w.recursive {
+		return nil
+	}
+	list, err := w.FS.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range list {
+		if info.IsDir() {
+			if err := w.watch(path.Join(dir, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// stop watching a directory which is gone, along with its subdirectories
+func (w *watcher) unwatch(dir string) {
+	for d, stop := range w.stops {
+		if d == dir || strings.HasPrefix(d, dir+"/") {
+			stop()
+			delete(w.stops, d)
+		}
+	}
+}
+
+// Turn a change into an event, or nil if it should not be reported.
+func (w *watcher) handle(c change) flow.PacketMap {
+	if _, ok := w.stops[c.dir]; !ok {
+		return nil // arrived after the watch was stopped
+	}
+	name := cleanDir(c.Name)
+	if name == c.dir && !w.roots[c.dir] {
+		return nil // also reported by the watch on the parent directory
+	}
+	if w.recursive {
+		switch c.Op {
+		case api.FileCreate:
+			if info, err := w.FS.Stat(name); err == nil && info.IsDir() {
+				if err := w.watch(name); err != nil {
+					w.Err.Send(w.Error(err, name))
+				}
+			}
+		case api.FileRemove, api.FileRename:
+			if name != c.dir {
+				w.unwatch(name)
+			}
+		}
+	}
+
+	root := c.dir
+	for !w.roots[root] && root != path.Dir(root) {
+		root = path.Dir(root)
+	}
+	if !w.matches(name, root) {
+		return nil
+	}
+	return flow.PacketMap{"name": name, "op": string(c.Op), "root": root}
+}
+
+func (w *watcher) matches(name, root string) bool {
+	if w.patterns == nil {
+		return true
+	}
+	base := path.Base(name)
+	rel := strings.TrimPrefix(name, root+"/")
+	for _, p := range w.patterns {
+		if ok, _ := path.Match(p, base); ok {
+			return true
+		}
+		if strings.Contains(p, "/") {
+			if ok, _ := path.Match(p, rel); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The operation to report for a burst, removal wins, else the first one.
+func merge(old, new interface{}) interface{} {
+	if new == string(api.FileRemove) || new == string(api.FileRename) {
+		return new
+	}
+	if old == string(api.FileRemove) || old == string(api.FileRename) {
+		return new // it came back
+	}
+	return old
+}
+
+// Send out all events whose burst is over, in time order, or all of them if
+// now is zero.
+func flush(bursts map[string]*pending, now time.Time, out flow.Output) {
+	var names []string
+	for name, p := range bursts {
+		if now.IsZero() || !now.Before(p.until) {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := bursts[names[i]], bursts[names[j]]
+		if !a.until.Equal(b.until) {
+			return a.until.Before(b.until)
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		out.Send(bursts[name].event)
+		delete(bursts, name)
+	}
+}
+
+// The time at which the first burst will be over, or zero if there are none.
+func first(bursts map[string]*pending) (t time.Time) {
+	for _, p := range bursts {
+		if t.IsZero() || p.until.Before(t) {
+			t = p.until
+		}
+	}
+	return
+}
+
+// directory names are compared without a trailing slash
+func cleanDir(name string) string {
+	return path.Clean(name)
+}
+
+func stringsOf(m flow.Message) (r []string) {
+	switch v := m.(type) {
+	case string:
+		r = []string{v}
+	case []string:
+		r = v
+	case []interface{}:
+		for _, x := range v {
+			if s, ok := x.(string); ok {
+				r = append(r, s)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,201 @@
+package watch
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/flowtest"
+	"github.com/laughlinez/flow/gadgets/filesystem"
+)
+
+var syncTag = flow.Tag{"<sync>", nil}
+
+// Watch directories, as driven by fun, which gets a function to send messages
+// to the input, and one to wait for the next output. Returns all events.
+func script(t *testing.T, g *WatchDir, feeds map[string]flow.Message,
+	fun func(emit func(flow.Message), next func() flow.Message)) []flow.Message {
+	out := &flowtest.Collector{Seen: make(chan flow.Message, 100)}
+	c := flow.NewCircuit()
+	c.AddCircuitry("g", g)
+	c.AddCircuitry("o", out)
+	c.AddCircuitry("s", flow.Source(func(emit func(flow.Message)) {
+		fun(emit, func() flow.Message {
+			select {
+			case m := <-out.Seen:
+				return m
+			case <-time.After(5 * time.Second):
+				t.Error("timeout waiting for output")
+				return nil
+			}
+		})
+	}))
+	c.Connect("s.Out", "g.In", 0)
+	c.Connect("g.Out", "o.In", 0)
+	for pin, m := range feeds {
+		c.Feed("g."+pin, m)
+	}
+	c.Run()
+
+	var r []flow.Message
+	for _, m := range out.Msgs {
+		if m != syncTag {
+			r = append(r, m)
+		}
+	}
+	return r
+}
+
+// start watching a directory, and wait until the watch is in place
+func start(dir string, emit func(flow.Message), next func() flow.Message) {
+	emit(dir)
+	emit(syncTag)
+	for next() != syncTag {
+	}
+}
+
+func event(name, op, root string) flow.PacketMap {
+	return flow.PacketMap{"name": name, "op": op, "root": root}
+}
+
+func TestWatchDir(t *testing.T) {
+	fs := filesystem.NewMemFS()
+	touch(fs, "logs/old.txt")
+
+	got := script(t, &WatchDir{FS: fs}, nil, func(emit func(flow.Message), next func() flow.Message) {
+		start("logs", emit, next)
+		f, _ := fs.Create("logs/a.txt")
+		f.Write([]byte("abc"))
+		f.Close()
+		fs.Remove("logs/old.txt")
+		fs.Rename("logs/a.txt", "logs/b.txt")
+		for i := 0; i < 5; i++ {
+			next()
+		}
+	})
+
+	want := []flow.Message{
+		event("logs/a.txt", "create", "logs"),
+		event("logs/a.txt", "write", "logs"),
+		event("logs/old.txt", "remove", "logs"),
+		event("logs/a.txt", "rename", "logs"),
+		event("logs/b.txt", "create", "logs"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestWatchDirRecursive(t *testing.T) {
+	fs := filesystem.NewMemFS()
+	touch(fs, "data/sub/old.log")
+
+	got := script(t, &WatchDir{FS: fs}, map[string]flow.Message{
+		"Recursive": true,
+		"Pattern":   []interface{}{"*.log", "new"},
+	}, func(emit func(flow.Message), next func() flow.Message) {
+		start("data/", emit, next)
+		touch(fs, "data/sub/skip.txt")
+		touch(fs, "data/sub/x.log")
+		next()
+		fs.Create("data/new/y.tmp") // creates the directory, which is watched
+		next()
+		touch(fs, "data/new/y.log")
+		next()
+		fs.Remove("data/new/y.log")
+		fs.Remove("data/new/y.tmp")
+		fs.Remove("data/new")
+		next()
+		next()
+	})
+
+	want := []flow.Message{
+		event("data/sub/x.log", "create", "data"),
+		event("data/new", "create", "data"),
+		event("data/new/y.log", "create", "data"),
+		event("data/new/y.log", "remove", "data"),
+		event("data/new", "remove", "data"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestWatchDirDebounce(t *testing.T) {
+	fs := filesystem.NewMemFS()
+	touch(fs, "logs/c.txt")
+	clock := flow.NewManualTime(time.Unix(0, 0))
+
+	got := script(t, &WatchDir{FS: fs, Clock: clock}, map[string]flow.Message{
+		"Pattern": "*.txt", "Debounce": "1s",
+	}, func(emit func(flow.Message), next func() flow.Message) {
+		// wait until all changes so far have been handled, by making two
+		// more which are ignored: the second one is only picked up once the
+		// gadget is done with everything before the first one
+		settle := func() {
+			touch(fs, "logs/ignored")
+			touch(fs, "logs/ignored")
+		}
+
+		start("logs", emit, next)
+		f, _ := fs.Create("logs/b.txt")
+		f.Write([]byte("abc"))
+		f.Close()
+		touch(fs, "logs/a.txt")
+		touch(fs, "logs/c.txt")
+		fs.Remove("logs/c.txt")
+		settle()
+		clock.Advance(time.Second)
+		for i := 0; i < 3; i++ {
+			next()
+		}
+
+		touch(fs, "logs/a.txt")
+		fs.Remove("logs/a.txt")
+		touch(fs, "logs/a.txt")
+		settle()
+		// closing the input sends out whatever is pending
+	})
+
+	want := []flow.Message{
+		event("logs/a.txt", "create", "logs"),
+		event("logs/b.txt", "create", "logs"),
+		event("logs/c.txt", "remove", "logs"),
+		event("logs/a.txt", "create", "logs"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestWatchDirStops(t *testing.T) {
+	fs := filesystem.NewMemFS()
+	touch(fs, "logs/a.txt")
+
+	// stops when the input closes
+	g := flow.NewCircuit()
+	g.AddCircuitry("w", &WatchDir{FS: fs})
+	g.Feed("w.In", "logs")
+	g.Run()
+
+	// or when the circuit is cancelled, here on the first error
+	g = flow.NewCircuit()
+	g.AddCircuitry("w", &WatchDir{FS: fs})
+	g.AddCircuitry("s", flow.Source(func(emit func(flow.Message)) {
+		emit("logs")
+		emit("missing")
+		<-g.Done()
+	}))
+	g.Connect("s.Out", "w.In", 0)
+	g.OnError(func(e *flow.Error) {
+		g.Cancel(e)
+	})
+	g.Run()
+}
+
+// create an empty file, or truncate it if it exists
+func touch(fs *filesystem.MemFS, name string) {
+	f, _ := fs.Create(name)
+	f.Close()
+}
@@ -0,0 +1,468 @@
+// Batching and windowing of message streams, for aggregation over time.
+package window
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/laughlinez/flow"
+)
+
+func init() {
+	flow.Registry["Batch"] = func() flow.Circuitry { return new(Batch) }
+	flow.Registry["Window"] = func() flow.Circuitry { return new(Window) }
+	flow.Registry["SlidingWindow"] = func() flow.Circuitry { return new(SlidingWindow) }
+	flow.Registry["SessionWindow"] = func() flow.Circuitry { return new(SessionWindow) }
+}
+
+// All the gadgets in this package collect messages into groups, and send out
+// each group once it is complete, or when the In pin is closed. A group is
+// sent out as a slice of messages, or, if a field name has been sent to the
+// Field pin, as a summary of the numeric values of that field in the messages:
+// a PacketMap with "count", "sum", "min", "max", and "mean" entries. For time
+// windows, "start" and "end" entries with the window's time range are added.
+// Tags are passed on right away, and are not included in the groups.
+//
+// Time windows go by the time at which messages come in, as told by the Clock
+// (the system time by default). Alternatively, if a field name is sent to the
+// Stamp pin, the time is taken from that field in each PacketMap instead (see
+// PacketMap.GetTime). A window is then complete once a message with a later
+// time comes in, and messages which arrive too late for their window are sent
+// to the Err pin, as are messages without a valid time stamp.
+
+// Batch collects a fixed number of messages, as set on the Size pin.
+// Registers as "Batch".
+type Batch struct {
+	flow.Gadget
+	Size  flow.Input
+	Field flow.Input
+	In    flow.Input
+	Out   flow.Output
+	Err   flow.Output
+}
+
+// Start collecting messages.
+func (g *Batch) Run() {
+	r := <-g.Size
+	size, ok := flow.Int(r)
+	if !ok || size < 1 {
+		g.Err.Send(g.Error(fmt.Errorf("window: bad batch size: %v", r), r))
+		flow.PassThrough(g.In, g.Out)
+		return
+	}
+	e := newEmitter(g.Field, g.Out)
+	var msgs []interface{}
+	for m := range g.In {
+		if _, ok := m.(flow.Tag); ok {
+			g.Out.Send(m)
+			continue
+		}
+		msgs = append(msgs, m)
+		if len(msgs) >= size {
+			e.emit(msgs, nil)
+			msgs = nil
+		}
+	}
+	if len(msgs) > 0 {
+		e.emit(msgs, nil)
+	}
+}
+
+// Window collects messages in consecutive windows of a fixed duration, as set
+// on the Size pin, i.e. "1m". Windows are aligned to multiples of this size.
+// Registers as "Window".
+type Window struct {
+	flow.Gadget
+	Size  flow.Input
+	Field flow.Input
+	Stamp flow.Input
+	In    flow.Input
+	Out   flow.Output
+	Err   flow.Output
+
+	Clock flow.TimeSource
+}
+
+// Start collecting messages.
+func (g *Window) Run() {
+	r := <-g.Size
+	size, err := durationOf(r)
+	if err != nil {
+		g.Err.Send(g.Error(err, r))
+		flow.PassThrough(g.In, g.Out)
+		return
+	}
+	e := newEmitter(g.Field, g.Out)
+	s := newStamper(g.Stamp, g.Clock)
+
+	var cur *group
+	wake := flow.NewAlarm(s.clock)
+	for {
+		select {
+		case m, ok := <-g.In:
+			if !ok {
+				if cur != nil {
+					e.emit(cur.msgs, cur)
+				}
+				return
+			}
+			if _, ok := m.(flow.Tag); ok {
+				g.Out.Send(m)
+				continue
+			}
+			t, err := s.timeOf(m)
+			if err == nil && cur != nil && t.Before(cur.start) {
+				err = fmt.Errorf("window: too late for %v", cur.start)
+			}
+			if err != nil {
+				g.Err.Send(g.Error(err, m))
+				continue
+			}
+			if cur != nil && !t.Before(cur.end) {
+				e.emit(cur.msgs, cur)
+				cur = nil
+			}
+			if cur == nil {
+				start := t.Truncate(size)
+				cur = &group{start: start, end: start.Add(size)}
+				if s.field == "" {
+					wake.Set(cur.end)
+				}
+			}
+			cur.msgs = append(cur.msgs, m)
+		case <-wake.C:
+			wake.Clear()
+			if cur != nil {
+				e.emit(cur.msgs, cur)
+				cur = nil
+			}
+		}
+	}
+}
+
+// SlidingWindow collects messages in overlapping windows of a fixed duration,
+// as set on the Size pin, one ending at each multiple of the duration set on
+// the Every pin. Windows without messages are not sent out.
+// Registers as "SlidingWindow".
+type SlidingWindow struct {
+	flow.Gadget
+	Size  flow.Input
+	Every flow.Input
+	Field flow.Input
+	Stamp flow.Input
+	In    flow.Input
+	Out   flow.Output
+	Err   flow.Output
+
+	Clock flow.TimeSource
+}
+
+type stamped struct {
+	t time.Time
+	m flow.Message
+}
+
+// Start collecting messages.
+func (g *SlidingWindow) Run() {
+	r := <-g.Size
+	size, err := durationOf(r)
+	if err == nil {
+		r = <-g.Every
+		var every time.Duration
+		every, err = durationOf(r)
+		if err == nil {
+			g.run(size, every)
+			return
+		}
+	}
+	g.Err.Send(g.Error(err, r))
+	flow.PassThrough(g.In, g.Out)
+}
+
+func (g *SlidingWindow) run(size, every time.Duration) {
+	e := newEmitter(g.Field, g.Out)
+	s := newStamper(g.Stamp, g.Clock)
+
+	var pending []stamped // in order of time
+	var next time.Time    // end of the next window, zero if there is none
+	wake := flow.NewAlarm(s.clock)
+
+	// send out the window ending at next, and move on to the one after it
+	flush := func() {
+		w := &group{start: next.Add(-size), end: next}
+		for _, p := range pending {
+			if !p.t.Before(w.start) && p.t.Before(w.end) {
+				w.msgs = append(w.msgs, p.m)
+			}
+		}
+		if len(w.msgs) > 0 {
+			e.emit(w.msgs, w)
+		}
+		next = next.Add(every)
+		keep := pending[:0]
+		for _, p := range pending {
+			if !p.t.Before(next.Add(-size)) {
+				keep = append(keep, p)
+			}
+		}
+		pending = keep
+		if len(pending) == 0 {
+			next = time.Time{}
+		}
+		if s.field == "" {
+			wake.Set(next)
+		}
+	}
+
+	for {
+		select {
+		case m, ok := <-g.In:
+			if !ok {
+				for !next.IsZero() {
+					flush()
+				}
+				return
+			}
+			if _, ok := m.(flow.Tag); ok {
+				g.Out.Send(m)
+				continue
+			}
+			t, err := s.timeOf(m)
+			if err == nil && len(pending) > 0 && t.Before(pending[len(pending)-1].t) {
+				err = fmt.Errorf("window: out of order")
+			}
+			if err != nil {
+				g.Err.Send(g.Error(err, m))
+				continue
+			}
+			for !next.IsZero() && !t.Before(next) {
+				flush()
+			}
+			pending = append(pending, stamped{t, m})
+			if next.IsZero() {
+				next = t.Truncate(every).Add(every)
+				if s.field == "" {
+					wake.Set(next)
+				}
+			}
+		case <-wake.C:
+			wake.Clear()
+			for !next.IsZero() && !s.clock.Now().Before(next) {
+				flush()
+			}
+		}
+	}
+}
+
+// SessionWindow collects messages per key, until no more messages for that key
+// have come in for the duration set on the Gap pin. The key is the value of the
+// field named on the Key pin. Summaries include the key as "key", and use the
+// time of the first and last message as "start" and "end".
+// Registers as "SessionWindow".
+type SessionWindow struct {
+	flow.Gadget
+	Gap   flow.Input
+	Key   flow.Input
+	Field flow.Input
+	Stamp flow.Input
+	In    flow.Input
+	Out   flow.Output
+	Err   flow.Output
+
+	Clock flow.TimeSource
+}
+
+// Start collecting messages.
+func (g *SessionWindow) Run() {
+	r := <-g.Gap
+	gap, err := durationOf(r)
+	if err != nil {
+		g.Err.Send(g.Error(err, r))
+		flow.PassThrough(g.In, g.Out)
+		return
+	}
+	key := ""
+	if m, ok := <-g.Key; ok {
+		key, _ = m.(string)
+	}
+	e := newEmitter(g.Field, g.Out)
+	s := newStamper(g.Stamp, g.Clock)
+
+	sessions := map[string]*group{}
+	wake := flow.NewAlarm(s.clock)
+
+	// send out all sessions which have ended at the given time, oldest first
+	expire := func(now time.Time, all bool) {
+		var done []*group
+		for k, w := range sessions {
+			if all || !now.Before(w.end.Add(gap)) {
+				done = append(done, w)
+				delete(sessions, k)
+			}
+		}
+		sort.Sort(byStart(done))
+		for _, w := range done {
+			e.emit(w.msgs, w)
+		}
+	}
+
+	// set the alarm for the first session to end, if time is taken from the clock
+	rearm := func() {
+		if s.field == "" {
+			var first time.Time
+			for _, w := range sessions {
+				if end := w.end.Add(gap); first.IsZero() || end.Before(first) {
+					first = end
+				}
+			}
+			wake.Set(first)
+		}
+	}
+
+	for {
+		select {
+		case m, ok := <-g.In:
+			if !ok {
+				expire(time.Time{}, true)
+				return
+			}
+			if _, ok := m.(flow.Tag); ok {
+				g.Out.Send(m)
+				continue
+			}
+			t, err := s.timeOf(m)
+			if err != nil {
+				g.Err.Send(g.Error(err, m))
+				continue
+			}
+			expire(t, false)
+			k := flow.KeyOf(m, key)
+			w := sessions[k]
+			if w == nil {
+				w = &group{start: t, end: t, key: k}
+				sessions[k] = w
+			}
+			if t.After(w.end) {
+				w.end = t
+			}
+			w.msgs = append(w.msgs, m)
+			rearm()
+		case <-wake.C:
+			wake.Clear()
+			expire(s.clock.Now(), false)
+			rearm()
+		}
+	}
+}
+
+// A group of messages collected in the same batch or window.
+type group struct {
+	start, end time.Time
+	key        interface{} // only used for sessions
+	msgs       []interface{}
+}
+
+type byStart []*group
+
+func (l byStart) Len() int      { return len(l) }
+func (l byStart) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l byStart) Less(i, j int) bool {
+	if !l[i].start.Equal(l[j].start) {
+		return l[i].start.Before(l[j].start)
+	}
+	return fmt.Sprint(l[i].key) < fmt.Sprint(l[j].key)
+}
+
+// Sends out groups, either as slices or as summaries of one field.
+type emitter struct {
+	field string
+	out   flow.Output
+}
+
+func newEmitter(pin flow.Input, out flow.Output) *emitter {
+	e := &emitter{out: out}
+	if m, ok := <-pin; ok {
+		e.field, _ = m.(string)
+	}
+	return e
+}
+
+// Send out the messages, with details of the window for summaries, if any.
+func (e *emitter) emit(msgs []interface{}, w *group) {
+	if e.field == "" {
+		e.out.Send(msgs)
+		return
+	}
+	r := flow.PacketMap{"count": 0}
+	n, sum, min, max := 0, 0.0, math.Inf(1), math.Inf(-1)
+	for _, m := range msgs {
+		v, ok := m.(flow.PacketMap)
+		if !ok {
+			continue
+		}
+		f, err := v.GetFloat64(e.field)
+		if err != nil {
+			continue
+		}
+		n++
+		sum += f
+		min = math.Min(min, f)
+		max = math.Max(max, f)
+	}
+	r["count"] = n
+	if n > 0 {
+		r["sum"] = sum
+		r["min"] = min
+		r["max"] = max
+		r["mean"] = sum / float64(n)
+	}
+	if w != nil {
+		r["start"] = w.start
+		r["end"] = w.end
+		if w.key != nil {
+			r["key"] = w.key
+		}
+	}
+	e.out.Send(r)
+}
+
+// Works out the time of each message, from a field or from the clock.
+type stamper struct {
+	field string
+	clock flow.TimeSource
+}
+
+func newStamper(pin flow.Input, clock flow.TimeSource) *stamper {
+	s := &stamper{clock: clock}
+	if s.clock == nil {
+		s.clock = flow.SystemTime
+	}
+	if m, ok := <-pin; ok {
+		s.field, _ = m.(string)
+	}
+	return s
+}
+
+func (s *stamper) timeOf(m flow.Message) (time.Time, error) {
+	if s.field == "" {
+		return s.clock.Now(), nil
+	}
+	v, ok := m.(flow.PacketMap)
+	if !ok {
+		return time.Time{}, fmt.Errorf("window: no time stamp in %T", m)
+	}
+	return v.GetTime(s.field)
+}
+
+func durationOf(m flow.Message) (time.Duration, error) {
+	d, err := flow.ParseDuration(m)
+	if err != nil {
+		return 0, fmt.Errorf("window: %v", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("window: duration must be positive: %v", m)
+	}
+	return d, nil
+}
@@ -0,0 +1,218 @@
+package window
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/flowtest"
+)
+
+// a reading at the given number of seconds since the epoch
+func reading(sec int, key string, value float64) flow.PacketMap {
+	return flow.PacketMap{"t": sec, "key": key, "value": value}
+}
+
+// run a gadget with the given feeds, returning what it sends out
+func collect(g flow.Circuitry, feeds map[string][]flow.Message) (out, errs []flow.Message) {
+	c := flow.NewCircuit()
+	o, e := new(flowtest.Collector), new(flowtest.Collector)
+	c.AddCircuitry("w", g)
+	c.AddCircuitry("o", o)
+	c.AddCircuitry("e", e)
+	c.Connect("w.Out", "o.In", 0)
+	c.Connect("w.Err", "e.In", 0)
+	for pin, msgs := range feeds {
+		for _, m := range msgs {
+			c.Feed("w."+pin, m)
+		}
+	}
+	c.Run()
+	return o.Msgs, e.Msgs
+}
+
+// check a summary, ignoring the start and end times if they are zero
+func checkSummary(t *testing.T, m flow.Message, count int, sum float64, start, end int) {
+	v, ok := m.(flow.PacketMap)
+	if !ok {
+		t.Fatalf("expected a summary, got %T: %v", m, m)
+	}
+	if v["count"] != count || count > 0 && v["sum"] != sum {
+		t.Errorf("expected count %d and sum %g, got %v", count, sum, v)
+	}
+	if start != 0 && !v["start"].(time.Time).Equal(time.Unix(int64(start), 0)) {
+		t.Errorf("expected start %d, got %v", start, v["start"])
+	}
+	if end != 0 && !v["end"].(time.Time).Equal(time.Unix(int64(end), 0)) {
+		t.Errorf("expected end %d, got %v", end, v["end"])
+	}
+}
+
+func ExampleBatch() {
+	g := flow.NewCircuit()
+	g.Add("b", "Batch")
+	g.AddCircuitry("p", flow.Sink(func(m flow.Message) { fmt.Println(m) }))
+	g.Connect("b.Out", "p.In", 0)
+	g.Feed("b.Size", 2)
+	for i := 1; i <= 5; i++ {
+		g.Feed("b.In", i)
+	}
+	g.Run()
+	// Output:
+	// [1 2]
+	// [3 4]
+	// [5]
+}
+
+func TestBatchSummary(t *testing.T) {
+	out, _ := collect(new(Batch), map[string][]flow.Message{
+		"Size":  {2.0},
+		"Field": {"value"},
+		"In": {reading(0, "", 1), flow.Tag{"<tag>", 0},
+			reading(0, "", 2), flow.PacketMap{}, reading(0, "", 4.5)},
+	})
+	if len(out) != 3 {
+		t.Fatalf("expected 3 messages, got %v", out)
+	}
+	if out[0] != (flow.Tag{"<tag>", 0}) {
+		t.Errorf("expected the tag first, got %v", out[0])
+	}
+	checkSummary(t, out[1], 2, 3, 0, 0)
+	checkSummary(t, out[2], 1, 4.5, 0, 0)
+	want := flow.PacketMap{"count": 1, "sum": 4.5, "min": 4.5, "max": 4.5, "mean": 4.5}
+	if !reflect.DeepEqual(out[2], want) {
+		t.Errorf("expected %v, got %v", want, out[2])
+	}
+}
+
+func TestBadConfig(t *testing.T) {
+	out, errs := collect(new(Window), map[string][]flow.Message{
+		"Size": {"soon"},
+		"In":   {1, 2},
+	})
+	if len(errs) != 1 || !reflect.DeepEqual(out, []flow.Message{1, 2}) {
+		t.Errorf("expected an error and pass-through, got %v and %v", errs, out)
+	}
+}
+
+func TestWindowStamp(t *testing.T) {
+	out, errs := collect(new(Window), map[string][]flow.Message{
+		"Size":  {"1m"},
+		"Field": {"value"},
+		"Stamp": {"t"},
+		"In": {reading(60, "", 1), reading(119, "", 2), reading(180, "", 3),
+			reading(179, "", 4), flow.PacketMap{"value": 5}, reading(200, "", 6)},
+	})
+	if len(errs) != 2 {
+		t.Errorf("expected 2 errors, got %v", errs)
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected 2 windows, got %v", out)
+	}
+	checkSummary(t, out[0], 2, 3, 60, 120)
+	checkSummary(t, out[1], 2, 9, 180, 240)
+}
+
+func TestWindowClock(t *testing.T) {
+	clock := flow.NewManualTime(time.Unix(30, 0))
+	out := &flowtest.Collector{Seen: make(chan flow.Message, 10)}
+
+	g := flow.NewCircuit()
+	g.AddCircuitry("w", &Window{Clock: clock})
+	g.AddCircuitry("o", out)
+	g.AddCircuitry("d", flow.Source(func(emit func(flow.Message)) {
+		emit(1)
+		emit(2)
+		emit(flow.Tag{"<sync>", nil}) // once sent, 1 and 2 have been handled
+		if m := <-out.Seen; m != (flow.Tag{"<sync>", nil}) {
+			t.Errorf("expected the tag, got %v", m)
+		}
+		clock.Advance(30 * time.Second) // now at the end of the window
+		if m := <-out.Seen; !reflect.DeepEqual(m, []interface{}{1, 2}) {
+			t.Errorf("expected the first window, got %v", m)
+		}
+		emit(3)
+	}))
+	g.Connect("d.Out", "w.In", 0)
+	g.Connect("w.Out", "o.In", 0)
+	g.Feed("w.Size", "1m")
+	g.Run()
+
+	if m := <-out.Seen; !reflect.DeepEqual(m, []interface{}{3}) {
+		t.Errorf("expected the last window to be flushed, got %v", m)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	out, _ := collect(new(SlidingWindow), map[string][]flow.Message{
+		"Size":  {"1m"},
+		"Every": {"30s"},
+		"Field": {"value"},
+		"Stamp": {"t"},
+		"In":    {reading(10, "", 1), reading(40, "", 2), reading(200, "", 4)},
+	})
+	if len(out) != 5 {
+		t.Fatalf("expected 5 windows, got %v", out)
+	}
+	checkSummary(t, out[0], 1, 1, -30, 30)
+	checkSummary(t, out[1], 2, 3, 0, 60)
+	checkSummary(t, out[2], 1, 2, 30, 90)
+	checkSummary(t, out[3], 1, 4, 150, 210)
+	checkSummary(t, out[4], 1, 4, 180, 240)
+}
+
+func TestSessionWindow(t *testing.T) {
+	out, _ := collect(new(SessionWindow), map[string][]flow.Message{
+		"Gap":   {"10s"},
+		"Key":   {"key"},
+		"Field": {"value"},
+		"Stamp": {"t"},
+		"In": {reading(1, "a", 1), reading(2, "b", 2), reading(8, "a", 3),
+			reading(16, "b", 4), reading(30, "a", 5)},
+	})
+	if len(out) != 4 {
+		t.Fatalf("expected 4 sessions, got %v", out)
+	}
+	checkSummary(t, out[0], 1, 2, 2, 2) // b ends first, a is still going on
+	checkSummary(t, out[1], 2, 4, 1, 8)
+	checkSummary(t, out[2], 1, 4, 16, 16)
+	checkSummary(t, out[3], 1, 5, 30, 30)
+	if out[0].(flow.PacketMap)["key"] != "b" || out[1].(flow.PacketMap)["key"] != "a" {
+		t.Errorf("unexpected keys: %v", out)
+	}
+}
+
+func TestSessionClock(t *testing.T) {
+	clock := flow.NewManualTime(time.Unix(0, 0))
+	out := &flowtest.Collector{Seen: make(chan flow.Message, 10)}
+
+	g := flow.NewCircuit()
+	g.AddCircuitry("w", &SessionWindow{Clock: clock})
+	g.AddCircuitry("o", out)
+	g.AddCircuitry("d", flow.Source(func(emit func(flow.Message)) {
+		// wait until all messages so far have been handled, then move on
+		step := func(d time.Duration) {
+			emit(flow.Tag{"<sync>", nil})
+			<-out.Seen
+			clock.Advance(d)
+		}
+		emit(flow.PacketMap{"k": "a"})
+		step(5 * time.Second)
+		emit(flow.PacketMap{"k": "b"})
+		step(5 * time.Second)
+		if m := <-out.Seen; len(m.([]interface{})) != 1 {
+			t.Errorf("expected the session for a, got %v", m)
+		}
+	}))
+	g.Connect("d.Out", "w.In", 0)
+	g.Connect("w.Out", "o.In", 0)
+	g.Feed("w.Gap", "10s")
+	g.Feed("w.Key", "k")
+	g.Run()
+
+	if m := <-out.Seen; !reflect.DeepEqual(m, []interface{}{flow.PacketMap{"k": "b"}}) {
+		t.Errorf("expected the session for b, got %v", m)
+	}
+}
@@ -0,0 +1,10 @@
+module github.com/laughlinez/flow
+
+go 1.18
+
+require (
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/golang/glog v1.0.0
+)
+
+require golang.org/x/sys v0.4.0 // indirect
@@ -5,12 +5,14 @@ import (
 )
 
 type config struct {
+	Copy    bool // deliver copies on all wires
 	Gadgets []struct {
 		Type, Name string
 	}
 	Wires []struct {
 		From, To string
 		Capacity int
+		Copy     bool
 	}
 	Feeds []struct {
 		Tag  string
@@ -27,11 +29,14 @@ func (c *Circuit) LoadJSON(data []byte) error {
 	var conf config
 	err := json.Unmarshal(data, &conf)
 	if err == nil {
+		if conf.Copy {
+			c.CopyMessages(true)
+		}
 		for _, g := range conf.Gadgets {
 			c.Add(g.Name, g.Type)
 		}
 		for _, w := range conf.Wires {
-			c.Connect(w.From, w.To, w.Capacity)
+			c.connect(wireDef{w.From, w.To, w.Capacity, w.Copy})
 		}
 		for _, f := range conf.Feeds {
 			if f.Tag != "" {
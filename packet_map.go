@@ -5,78 +5,363 @@
 package flow
 
 import (
-        "math"
-        "time"
-        "github.com/golang/glog"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
 )
 
 type PacketMap map[string]interface{}
 
+// FieldError is returned by the PacketMap accessors when a field is missing,
+// or cannot be converted to the requested type.
+type FieldError struct {
+	Path    string      // the field, as passed to the accessor
+	Type    string      // the requested type
+	Value   interface{} // the value found, if any
+	Missing bool        // true if there is no such field
+}
+
+func (e *FieldError) Error() string {
+	if e.Missing {
+		return fmt.Sprintf("field %s is missing", e.Path)
+	}
+	return fmt.Sprintf("field %s is not a %s: %T %v", e.Path, e.Type, e.Value, e.Value)
+}
+
+// Get a field, which can be a dotted path into nested maps, such as
+// "sensor.temp". A top-level field which contains dots itself takes precedence.
+func (pm PacketMap) Get(path string) (interface{}, bool) {
+	if x, ok := pm[path]; ok {
+		return x, true
+	}
+	var x interface{} = pm
+	for _, name := range strings.Split(path, ".") {
+		var m map[string]interface{}
+		switch t := x.(type) {
+		case PacketMap:
+			m = t
+		case map[string]interface{}:
+			m = t
+		default:
+			return nil, false
+		}
+		var ok bool
+		if x, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+	return x, true
+}
+
+// Look up a field and convert it, the conversion returns false if it fails.
+func (pm PacketMap) convert(path, typ string, conv func(interface{}) bool) error {
+	x, ok := pm.Get(path)
+	if !ok {
+		return &FieldError{Path: path, Type: typ, Missing: true}
+	}
+	if !conv(x) {
+		return &FieldError{Path: path, Type: typ, Value: x}
+	}
+	return nil
+}
+
+// Get a string, also accepts []byte and json.Number.
+func (pm PacketMap) GetString(path string) (r string, err error) {
+	err = pm.convert(path, "string", func(x interface{}) bool {
+		switch v := x.(type) {
+		case string:
+			r = v
+		case []byte:
+			r = string(v)
+		case json.Number:
+			r = v.String()
+		default:
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// Get an int64, also accepts other numbers (floats are truncated), json.Number,
+// and strings with a number in them.
+func (pm PacketMap) GetInt64(path string) (r int64, err error) {
+	err = pm.convert(path, "int64", func(x interface{}) bool {
+		var ok bool
+		r, ok = toInt64(x)
+		return ok
+	})
+	return
+}
+
+// Get an int, accepts the same values as GetInt64.
+func (pm PacketMap) GetInt(path string) (int, error) {
+	r, err := pm.GetInt64(path)
+	if err == nil && int64(int(r)) != r {
+		x, _ := pm.Get(path)
+		return 0, &FieldError{Path: path, Type: "int", Value: x}
+	}
+	return int(r), err
+}
+
+// Get a uint64, accepts the same values as GetInt64, as long as they are not
+// negative.
+func (pm PacketMap) GetUint(path string) (r uint64, err error) {
+	err = pm.convert(path, "uint", func(x interface{}) bool {
+		switch v := x.(type) {
+		case uint:
+			r = uint64(v)
+		case uint64:
+			r = v
+		case string:
+			n, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+			r = n
+			return err == nil
+		default:
+			n, ok := toInt64(x)
+			r = uint64(n)
+			return ok && n >= 0
+		}
+		return true
+	})
+	return
+}
+
+// Get a float64, also accepts other numbers, json.Number, and strings with a
+// number in them.
+func (pm PacketMap) GetFloat64(path string) (r float64, err error) {
+	err = pm.convert(path, "float64", func(x interface{}) bool {
+		var ok bool
+		r, ok = toFloat64(x)
+		return ok
+	})
+	return
+}
+
+// Get a bool, also accepts strings such as "true" or "0" (see strconv.ParseBool),
+// and numbers, which are true if not zero.
+func (pm PacketMap) GetBool(path string) (r bool, err error) {
+	err = pm.convert(path, "bool", func(x interface{}) bool {
+		switch v := x.(type) {
+		case bool:
+			r = v
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			r = b
+			return err == nil
+		default:
+			f, ok := toFloat64(x)
+			r = f != 0
+			return ok
+		}
+		return true
+	})
+	return
+}
+
+// Get a duration, also accepts strings such as "1m30s" (see time.ParseDuration),
+// and numbers, as seconds.
+func (pm PacketMap) GetDuration(path string) (r time.Duration, err error) {
+	err = pm.convert(path, "duration", func(x interface{}) bool {
+		switch v := x.(type) {
+		case time.Duration:
+			r = v
+		case string:
+			d, err := time.ParseDuration(strings.TrimSpace(v))
+			r = d
+			return err == nil
+		default:
+			f, ok := toFloat64(x)
+			r = time.Duration(f * float64(time.Second))
+			return ok
+		}
+		return true
+	})
+	return
+}
+
+// Get a time, also accepts strings in RFC 3339 format, and numbers, as seconds
+// since the Unix epoch.
+func (pm PacketMap) GetTime(path string) (r time.Time, err error) {
+	err = pm.convert(path, "time", func(x interface{}) bool {
+		switch v := x.(type) {
+		case time.Time:
+			r = v
+		case string:
+			t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(v))
+			r = t
+			return err == nil
+		default:
+			f, ok := toFloat64(x)
+			sec, frac := math.Modf(f)
+			r = time.Unix(int64(sec), int64(frac*1e9))
+			return ok
+		}
+		return true
+	})
+	return
+}
+
+// Get a byte slice, also accepts strings.
+func (pm PacketMap) GetBytes(path string) (r []byte, err error) {
+	err = pm.convert(path, "[]byte", func(x interface{}) bool {
+		switch v := x.(type) {
+		case []byte:
+			r = v
+		case string:
+			r = []byte(v)
+		default:
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// Get a nested map, as a PacketMap which shares its contents.
+func (pm PacketMap) GetMap(path string) (r PacketMap, err error) {
+	err = pm.convert(path, "map", func(x interface{}) bool {
+		switch v := x.(type) {
+		case PacketMap:
+			r = v
+		case map[string]interface{}:
+			r = PacketMap(v)
+		default:
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// Get a slice, slices of other types than []interface{} are copied into one.
+func (pm PacketMap) GetSlice(path string) (r []interface{}, err error) {
+	err = pm.convert(path, "slice", func(x interface{}) bool {
+		if v, ok := x.([]interface{}); ok {
+			r = v
+			return true
+		}
+		rv := reflect.ValueOf(x)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return false
+		}
+		r = make([]interface{}, rv.Len())
+		for i := range r {
+			r[i] = rv.Index(i).Interface()
+		}
+		return true
+	})
+	return
+}
+
+func toInt64(x interface{}) (int64, bool) {
+	switch v := x.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return int64(v), int64(v) >= 0
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), int64(v) >= 0
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, true
+		}
+		return toInt64(string(v))
+	case string:
+		s := strings.TrimSpace(v)
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, true
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return toInt64(f)
+		}
+		return 0, false
+	}
+	if f, ok := toFloat64(x); ok && !math.IsNaN(f) &&
+		f >= math.MinInt64 && f < math.MaxInt64 {
+		return int64(f), true
+	}
+	return 0, false
+}
+
+// like Number, but also for strings with a number in them
+func toFloat64(x interface{}) (float64, bool) {
+	if s, ok := x.(string); ok {
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		return f, err == nil
+	}
+	return Number(x)
+}
+
+// The following wrappers report conversion errors via glog, and return a zero
+// value. Use the Get... variants to tell missing and zero values apart.
+
 // Wrapper function to extract string value from PacketMap
-func (pm PacketMap) String(key string) (string) {
-        if v, ok := pm[key].(string); ok {
-                return v
-        } else {
-                glog.Errorf("%s is not a string in PacketMap{%+v}", key, pm)
-                return ""
-        }
+func (pm PacketMap) String(key string) string {
+	v, err := pm.GetString(key)
+	if err != nil {
+		glog.Errorf("%v in PacketMap{%+v}", err, pm)
+	}
+	return v
 }
 
 // Wrapper function to extract time value from PacketMap
-func (pm PacketMap) Time(key string) (time.Time) {
-        if v, ok := pm[key].(time.Time); ok {
-                return v
-        } else {
-                glog.Errorf("%s is not a time in PacketMap{%+v}", key, pm)
-                return time.Time{}
-        }
+func (pm PacketMap) Time(key string) time.Time {
+	v, err := pm.GetTime(key)
+	if err != nil {
+		glog.Errorf("%v in PacketMap{%+v}", err, pm)
+	}
+	return v
 }
 
 // Wrapper function to extract int value from PacketMap
-func (pm PacketMap) Int(key string) (int) {
-        switch v := pm[key].(type) {
-        case int:
-                return v
-        case float32:
-                return int(v)
-        case float64:
-                return int(v)
-        case byte:
-                return int(v)
-        default:
-                glog.Errorf("%s is not an int in PacketMap{%+v}", key, pm)
-                return 0
-        }
+func (pm PacketMap) Int(key string) int {
+	v, err := pm.GetInt(key)
+	if err != nil {
+		glog.Errorf("%v in PacketMap{%+v}", err, pm)
+	}
+	return v
 }
 
 // Wrapper function to extract float64 value from PacketMap
-func (pm PacketMap) Float64(key string) (float64) {
-        switch v := pm[key].(type) {
-        case int:
-                return float64(v)
-        case float32:
-                return float64(v)
-        case float64:
-                return float64(v)
-        case byte:
-                return float64(v)
-        default:
-                glog.Errorf("%s is not a float in PacketMap{%+v}", key, pm)
-                return math.NaN()
-        }
+func (pm PacketMap) Float64(key string) float64 {
+	v, err := pm.GetFloat64(key)
+	if err != nil {
+		glog.Errorf("%v in PacketMap{%+v}", err, pm)
+		return math.NaN()
+	}
+	return v
 }
 
 // Wrapper function to extract []byte value from PacketMap
-func (pm PacketMap) Bytes(key string) ([]byte) {
-        switch v := pm[key].(type) {
-        case []byte:
-                return v
-        case string:
-                return []byte(v)
-        default:
-                glog.Errorf("%s is not a float in PacketMap{%+v}", key, pm)
-                return nil
-        }
+func (pm PacketMap) Bytes(key string) []byte {
+	v, err := pm.GetBytes(key)
+	if err != nil {
+		glog.Errorf("%v in PacketMap{%+v}", err, pm)
+	}
+	return v
 }
 
 //===== PacketMapDispatcher =====
@@ -86,91 +371,298 @@ func init() {
 		c := NewCircuit()
 		c.AddCircuitry("head", &pmDispatchHead{})
 		c.AddCircuitry("tail", &pmDispatchTail{})
-		c.Connect("head.Feeds:", "tail.In", 0)  // keeps tail alive
+		c.Connect("head.Feeds:", "tail.In", 0) // keeps tail alive
 		c.Label("In", "head.In")
 		c.Label("Prefix", "head.Prefix")
 		c.Label("Field", "head.Field")
+		c.Label("Dest", "head.Dest")
+		c.Label("Default", "head.Default")
+		c.Label("Routes", "head.Routes")
+		c.Label("Evict", "head.Evict")
 		c.Label("Rej", "head.Rej")
+		c.Label("Stats", "head.Stats")
 		c.Label("Out", "tail.Out")
 		return c
 	}
 }
 
-// Dispatch to a gadget based on a field in incoming PacketMaps
+// Dispatch to a gadget based on fields in incoming PacketMaps.
+//
+// The routing key is taken from the field sent to the Field pin, which can be
+// a dotted path into nested maps, such as "meta.device". A list of fields
+// builds a key from all their values, joined with a "/". PacketMaps which lack
+// any of these fields are passed straight through to Out.
+//
+// The key is looked up in the routing table sent to the Routes pin (which can
+// be updated while running), a map of key patterns to gadget types, such as
+// {"rf12/*": "RF12demo", "433/oregon": "Oregon"}. An exact match wins, other
+// patterns are tried with the longest one first, see path.Match for their
+// syntax. Without a matching route, the gadget type is the Prefix pin value
+// plus the key. If that does not exist either, the gadget names sent to the
+// Default pin (a string or a list) are tried. Only when all this fails is the
+// key sent to Rej, and the PacketMap passed through.
+//
+// Each gadget type is created once, and shared by all keys routed to it. The
+// name of the gadget (without prefix) is stored in each dispatched PacketMap,
+// in the field sent to the Dest pin, "decoder" by default ("" to disable).
+//
+// Gadgets are kept around for re-use, a map such as {"idle": "10m", "max": 100}
+// sent to the Evict pin limits this, as with the Dispatcher.
 // Registers as "PacketMapDispatcher".
 type PacketMapDispatcher Circuit
 
 type pmDispatchHead struct {
 	Gadget
-	Prefix  Input         // Expects string with decoder gadget prefix
-	Field   Input         // Expects string with field to dispatch on
-	In      Input         // Expects PacketMaps with [field]:string
-	Rej     Output        // Outputs rejected gadget names
-        Feeds   map[string]Output  // Output leading to all the decoders
+	Prefix  Input             // Expects string with decoder gadget prefix
+	Field   Input             // Expects string or list with fields to dispatch on
+	Dest    Input             // Expects string with field to store the decoder in
+	Default Input             // Expects string or list with fallback gadgets
+	Routes  Input             // Expects maps of key patterns to gadget types
+	Evict   Input             // Expects map with "idle" and/or "max" entries
+	In      Input             // Expects PacketMaps with [field]:string
+	Rej     Output            // Outputs rejected routing keys
+	Stats   Output            // Outputs PacketMaps with live/evicted counts
+	Feeds   map[string]Output // Output leading to all the decoders
+
+	prefix   string
+	fields   []string
+	defaults []string
+	routes   map[string]string
+	patterns []string          // the non-literal keys in routes, longest first
+	resolved map[string]string // gadget type per key, "" if rejected
+	policy   *evictionPolicy
 }
 
 type pmDispatchTail struct {
-        Gadget
-	In      Input         // Expects PacketMaps coming back from decoders
-	Out     Output        // Produces final output
+	Gadget
+	In  Input  // Expects PacketMaps coming back from decoders
+	Out Output // Produces final output
 }
 
 func (g *pmDispatchTail) Run() {
-        for m := range g.In {
-                glog.V(2).Infof("Tail: %+v", m)
-                g.Out.Send(m)
-        }
-        glog.Warningln("Input of pmDispatchTail %s was closed", g.Name())
+	for m := range g.In {
+		glog.V(2).Infof("Tail: %+v", m)
+		g.Out.Send(m)
+	}
+	glog.Warningln("Input of pmDispatchTail %s was closed", g.Name())
 }
 
 // Dispatch incoming PacketMaps
 func (g *pmDispatchHead) Run() {
-	prefix := ""
 	if p, ok := <-g.Prefix; ok {
-		prefix = p.(string)
+		g.prefix = p.(string)
 	}
-
-	field := ""
 	if p, ok := <-g.Field; ok {
-		field = p.(string)
+		g.fields = stringList(p)
+	}
+	dest := "decoder"
+	if p, ok := <-g.Dest; ok {
+		dest = p.(string)
+	}
+	if p, ok := <-g.Default; ok {
+		g.defaults = stringList(p)
+	}
+	routes := g.Routes
+	if p, ok := <-routes; ok {
+		g.setRoutes(p)
+	} else {
+		routes = nil
 	}
 
-	for m := range g.In {
-                glog.V(4).Infof("In: %+v", m)
-                glog.V(6).Infof("Feeds: %+v", g.Feeds)
-                if v, ok := m.(PacketMap); ok {
-                        if gadget := v.String(field); gadget != "" {
-                                if _, ok := g.Feeds[gadget]; !ok {
-                                        g.addGadget(prefix, gadget)
-                                }
-                                if feed, ok := g.Feeds[gadget]; ok && feed != nil {
-                                        glog.V(1).Infof("Dispatch to %s", gadget)
-                                        glog.V(4).Infof("Feed: %+v", m)
-                                        v["decoder"] = gadget
-                                        feed.Send(m)
-                                        continue
-                                }
-                        }
-                }
-                glog.V(2).Infof("Out: %+v", m)
-                g.Feeds[""].Send(m)
-        }
-}
-
-func (g *pmDispatchHead) addGadget(prefix, key string) {
-        pm := prefix + key
-        if Registry[pm] == nil {
-                glog.Warningf("gadget %s not found for dispatch", pm)
-                g.Rej.Send(key) // report that no such gadget was found
-                g.Feeds[key] = nil
-        } else { // create, hook up, and launch the new gadget
-                glog.Infof("hooking up %s for dispatch", pm)
-                c := g.Owner()
-                c.Add(pm, pm)
-                c.Connect("head.Feeds:"+key, pm+".In", 0)
-                c.Connect(pm+".Out", "tail.In", 0)
-                c.RunGadget(pm)
-                //glog.V(4).Infoln(self+".Feeds:"+key, "->", pm+".In")
-                //glog.V(4).Infoln(pm+".Out", "->", dest)
-        }
+	g.policy = newEvictionPolicy()
+	if e, ok := <-g.Evict; ok {
+		g.policy.configure(e)
+	}
+	tick, stop := g.policy.ticker()
+	defer stop()
+
+	g.resolved = map[string]string{}
+	for {
+		var m Message
+		select {
+		case msg, ok := <-g.In:
+			if !ok {
+				return
+			}
+			m = msg
+		case p, ok := <-routes:
+			if !ok {
+				routes = nil
+			} else {
+				g.setRoutes(p)
+			}
+			continue
+		case now := <-tick:
+			g.evict(now, "", false)
+			continue
+		}
+
+		glog.V(4).Infof("In: %+v", m)
+		glog.V(6).Infof("Feeds: %+v", g.Feeds)
+		if v, ok := m.(PacketMap); ok {
+			if key, ok := g.keyOf(v); ok {
+				gadget := g.resolve(key)
+				if _, ok := g.Feeds[gadget]; !ok && gadget != "" {
+					g.addGadget(gadget)
+				}
+				if feed := g.Feeds[gadget]; feed != nil && gadget != "" {
+					if g.policy.active() {
+						g.policy.touch(gadget, time.Now())
+					}
+					glog.V(1).Infof("Dispatch %s to %s", key, gadget)
+					glog.V(4).Infof("Feed: %+v", m)
+					if dest != "" {
+						// don't touch the original, it may be in use elsewhere
+						v = v.clone()
+						v[dest] = strings.TrimPrefix(gadget, g.prefix)
+					}
+					feed.Send(v)
+					continue
+				}
+			}
+		}
+		glog.V(2).Infof("Out: %+v", m)
+		g.Feeds[""].Send(m)
+	}
+}
+
+// Accepts a single string, or a list of them.
+func stringList(m Message) []string {
+	switch v := m.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		list := []string{}
+		for _, s := range v {
+			list = append(list, fmt.Sprint(s))
+		}
+		return list
+	}
+	glog.Errorf("expected string or list, got %T", m)
+	return nil
+}
+
+// Replace the routing table, this also forgets all previous routing decisions.
+func (g *pmDispatchHead) setRoutes(m Message) {
+	g.routes = map[string]string{}
+	switch v := m.(type) {
+	case map[string]string:
+		for k, s := range v {
+			g.routes[k] = s
+		}
+	case map[string]interface{}:
+		for k, s := range v {
+			g.routes[k] = fmt.Sprint(s)
+		}
+	default:
+		glog.Errorf("dispatch: expected a routing table, got %T", m)
+	}
+
+	g.patterns = nil
+	for k := range g.routes {
+		if strings.ContainsAny(k, `*?[\`) {
+			g.patterns = append(g.patterns, k)
+		}
+	}
+	sort.Sort(byLength(g.patterns))
+	g.resolved = map[string]string{}
+}
+
+// longest first, then alphabetical
+type byLength []string
+
+func (a byLength) Len() int      { return len(a) }
+func (a byLength) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byLength) Less(i, j int) bool {
+	if len(a[i]) != len(a[j]) {
+		return len(a[i]) > len(a[j])
+	}
+	return a[i] < a[j]
+}
+
+// Build the routing key, returns false if any of the fields is missing.
+func (g *pmDispatchHead) keyOf(v PacketMap) (string, bool) {
+	if len(g.fields) == 0 {
+		return "", false
+	}
+	parts := make([]string, len(g.fields))
+	for i, f := range g.fields {
+		x, ok := v.Get(f)
+		if !ok || x == nil {
+			return "", false
+		}
+		parts[i] = fmt.Sprint(x)
+	}
+	key := strings.Join(parts, "/")
+	return key, key != ""
+}
+
+// Find the gadget type for a key, or "" if there is none. Rejected keys are
+// reported once, after that they are passed through silently.
+func (g *pmDispatchHead) resolve(key string) string {
+	if gadget, ok := g.resolved[key]; ok {
+		return gadget
+	}
+	gadget := g.routes[key]
+	for _, p := range g.patterns {
+		if gadget != "" {
+			break
+		}
+		if ok, _ := path.Match(p, key); ok {
+			gadget = g.routes[p]
+		}
+	}
+	if gadget == "" {
+		gadget = g.prefix + key
+	}
+	if !isGadgetName(gadget) {
+		gadget = ""
+		for _, d := range g.defaults {
+			if isGadgetName(d) {
+				gadget = d
+				break
+			}
+		}
+	}
+	if gadget == "" {
+		glog.Warningf("no gadget found to dispatch %s", key)
+		g.Rej.Send(key) // report that no such gadget was found
+	}
+	g.resolved[key] = gadget
+	return gadget
+}
+
+// True if this is a registered gadget which can also be used as a name and a
+// pin map key in the dispatcher's circuit.
+func isGadgetName(s string) bool {
+	return Registry[s] != nil && !strings.ContainsAny(s, ".:") &&
+		s != "head" && s != "tail"
+}
+
+func (g *pmDispatchHead) addGadget(gadget string) {
+	glog.Infof("hooking up %s for dispatch", gadget)
+	c := g.Owner()
+	c.Add(gadget, gadget)
+	c.Connect("head.Feeds:"+gadget, gadget+".In", 0)
+	c.Connect(gadget+".Out", "tail.In", 0)
+	c.RunGadget(gadget)
+	if g.policy.active() {
+		now := time.Now()
+		g.policy.touch(gadget, now)
+		g.evict(now, gadget, true)
+	}
+}
+
+// Evict idle and surplus decoders, other than the one in keep (if any).
+// Stats are sent out if anything changed, including a newly created decoder.
+func (g *pmDispatchHead) evict(now time.Time, keep string, created bool) {
+	victims := g.policy.victims(now, keep)
+	for _, gadget := range victims {
+		evictGadget(&g.Gadget, g.Feeds, gadget, gadget, nil)
+	}
+	if created || len(victims) > 0 {
+		g.Stats.Send(g.policy.stats())
+	}
 }
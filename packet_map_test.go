@@ -2,8 +2,10 @@ package flow
 
 import (
         "bytes"
+        "encoding/json"
         "math"
         "testing"
+        "time"
 )
 
 
@@ -57,3 +59,91 @@ func TestPacketMapBytes(t *testing.T) {
         }
 }
 
+var nested = PacketMap{"sensor": map[string]interface{}{"temp": json.Number("21.5"),
+	"id": "31", "on": "true", "every": "1m30s", "list": []int{1, 2}},
+	"a.b": 1, "neg": -3, "t": "2014-05-06T07:08:09Z", "secs": 2.5}
+
+func TestPacketMapGet(t *testing.T) {
+	if v, ok := nested.Get("sensor.id"); !ok || v != "31" {
+		t.Errorf("nested get failed: %v %v", v, ok)
+	}
+	if v, ok := nested.Get("a.b"); !ok || v != 1 {
+		t.Errorf("dotted field get failed: %v %v", v, ok)
+	}
+	if _, ok := nested.Get("sensor.id.x"); ok {
+		t.Error("expected a missing field")
+	}
+}
+
+func TestPacketMapErrors(t *testing.T) {
+	_, err := nested.GetInt("sensor.missing")
+	if e, ok := err.(*FieldError); !ok || !e.Missing {
+		t.Errorf("expected a missing field error, got: %v", err)
+	}
+	_, err = nested.GetBool("neg.x")
+	if e, ok := err.(*FieldError); !ok || !e.Missing {
+		t.Errorf("expected a missing field error, got: %v", err)
+	}
+	_, err = nested.GetUint("neg")
+	if e, ok := err.(*FieldError); !ok || e.Missing || e.Value != -3 {
+		t.Errorf("expected a conversion error, got: %v", err)
+	}
+	if _, err = nested.GetMap("t"); err == nil {
+		t.Error("expected an error for a string as map")
+	}
+	if v, err := nested.GetInt("a.b"); err != nil || v != 1 {
+		t.Errorf("expected 1, got: %v %v", v, err)
+	}
+}
+
+func TestPacketMapConversions(t *testing.T) {
+	if v, err := nested.GetFloat64("sensor.temp"); err != nil || v != 21.5 {
+		t.Errorf("json.Number float failed: %v %v", v, err)
+	}
+	if v, err := nested.GetInt64("sensor.temp"); err != nil || v != 21 {
+		t.Errorf("json.Number int failed: %v %v", v, err)
+	}
+	if v, err := nested.GetString("sensor.temp"); err != nil || v != "21.5" {
+		t.Errorf("json.Number string failed: %v %v", v, err)
+	}
+	if v, err := nested.GetUint("sensor.id"); err != nil || v != 31 {
+		t.Errorf("string uint failed: %v %v", v, err)
+	}
+	if v, err := nested.GetBool("sensor.on"); err != nil || !v {
+		t.Errorf("string bool failed: %v %v", v, err)
+	}
+	if v, err := nested.GetDuration("sensor.every"); err != nil || v != 90*time.Second {
+		t.Errorf("string duration failed: %v %v", v, err)
+	}
+	if v, err := nested.GetDuration("secs"); err != nil || v != 2500*time.Millisecond {
+		t.Errorf("number duration failed: %v %v", v, err)
+	}
+	if v, err := nested.GetTime("t"); err != nil || v.Unix() != 1399360089 {
+		t.Errorf("string time failed: %v %v", v, err)
+	}
+	if v, err := nested.GetSlice("sensor.list"); err != nil || len(v) != 2 || v[1] != 2 {
+		t.Errorf("slice failed: %v %v", v, err)
+	}
+	if v, err := nested.GetMap("sensor"); err != nil || v["id"] != "31" {
+		t.Errorf("map failed: %v %v", v, err)
+	}
+	if v := nested.Int("sensor.id"); v != 31 {
+		t.Errorf("wrapper failed: %v", v)
+	}
+}
+
+func TestPacketMapDecimalStrings(t *testing.T) {
+	m := PacketMap{"hex": "0x1f", "octal": "010", "bin": "0b11"}
+	if _, err := m.GetUint("hex"); err == nil {
+		t.Error("expected hex strings to be rejected")
+	}
+	if _, err := m.GetInt64("bin"); err == nil {
+		t.Error("expected binary strings to be rejected")
+	}
+	if v, err := m.GetInt("octal"); err != nil || v != 10 {
+		t.Errorf("expected a leading zero to be decimal, got: %v %v", v, err)
+	}
+	if v, err := m.GetUint("octal"); err != nil || v != 10 {
+		t.Errorf("expected a leading zero to be decimal, got: %v %v", v, err)
+	}
+}
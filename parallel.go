@@ -0,0 +1,220 @@
+package flow
+
+import (
+	"fmt"
+	"hash/fnv"
+	"runtime"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+func init() {
+	Registry["Parallel"] = func() Circuitry {
+		c := NewCircuit()
+		c.AddCircuitry("head", &parallelHead{})
+		c.AddCircuitry("tail", &parallelTail{})
+		c.Connect("head.Feeds:", "tail.In", 0) // keeps tail alive
+		c.Connect("head.Order", "tail.Order", 1)
+		c.Label("In", "head.In")
+		c.Label("Type", "head.Type")
+		c.Label("Count", "head.Count")
+		c.Label("Key", "head.Key")
+		c.Label("Seq", "head.Seq")
+		c.Label("Out", "tail.Out")
+		c.Label("Err", "tail.Err")
+		return c
+	}
+}
+
+// Parallel runs a number of copies of a gadget, to spread the work over them.
+// The gadget type is taken from the Type pin, the number of copies from the
+// Count pin (the number of CPUs by default). These gadgets must have an In and
+// an Out pin, their output is merged into a single Out pin.
+//
+// Messages are handed out round-robin. If a field name is sent to the Key pin,
+// PacketMaps are handed out based on a hash of that field instead, so that all
+// messages with the same key are processed in order, by the same gadget.
+//
+// If a field name is sent to the Seq pin, PacketMaps get a sequence number in
+// that field, and the output is put back in that order. For this to work, each
+// gadget must produce exactly one PacketMap per input, keeping the sequence
+// field intact. The field is removed again on the way out. Other messages pass
+// through without being re-ordered. If a message goes missing, the output moves
+// past it once maxPending messages are waiting, and an error is sent to the Err
+// pin. So are settings of the wrong type. Registers as "Parallel".
+type Parallel Circuit
+
+type parallelHead struct {
+	Gadget
+	In    Input
+	Type  Input
+	Count Input
+	Key   Input
+	Seq   Input
+	Feeds map[string]Output
+	Order Output // settings errors for the tail, then the field to order on
+}
+
+func (g *parallelHead) Run() {
+	typ := g.setting(g.Type, "type")
+	count := runtime.NumCPU()
+	if m, ok := <-g.Count; ok {
+		if n, ok := Int(m); ok {
+			count = n
+		} else {
+			g.Order.Send(g.Error(fmt.Errorf("parallel: bad count: %#v", m), m))
+		}
+	}
+	key := g.setting(g.Key, "key")
+	seq := g.setting(g.Seq, "seq")
+	g.Order.Send(seq)
+
+	if Registry[typ] == nil || count < 1 {
+		glog.Errorf("parallel: cannot start %d x %q", count, typ)
+		for m := range g.In {
+			g.Feeds[""].Send(m)
+		}
+		return
+	}
+
+	// create, hook up, and launch the workers
+	c := g.owner
+	workers := make([]Output, count)
+	for i := range workers {
+		name := fmt.Sprintf("w%d", i)
+		c.Add(name, typ)
+		c.Connect("head.Feeds:"+name, name+".In", 0)
+		c.Connect(name+".Out", "tail.In", 0)
+		c.RunGadget(name)
+		workers[i] = g.Feeds[name]
+	}
+
+	next, n := 0, 0
+	for m := range g.In {
+		w := -1
+		if v, ok := m.(PacketMap); ok {
+			if seq != "" {
+				v = v.clone() // don't touch the original
+				v[seq] = n
+				m = v
+				n++
+			}
+			if k, ok := v[key]; ok && key != "" {
+				h := fnv.New32a()
+				fmt.Fprint(h, k)
+				w = int(h.Sum32() % uint32(count))
+			}
+		}
+		if w < 0 {
+			w = next
+			next = (next + 1) % count
+		}
+		workers[w].Send(m)
+	}
+}
+
+// Read a string setting, anything else is reported to the tail and ignored.
+func (g *parallelHead) setting(in Input, name string) string {
+	m, ok := <-in
+	if !ok {
+		return ""
+	}
+	s, ok := m.(string)
+	if !ok {
+		g.Order.Send(g.Error(fmt.Errorf("parallel: bad %s: %T", name, m), m))
+	}
+	return s
+}
+
+// maximum number of out-of-order messages held back, waiting for a gap to fill
+const maxPending = 1000
+
+type parallelTail struct {
+	Gadget
+	In    Input
+	Order Input
+	Out   Output
+	Err   Output
+}
+
+func (g *parallelTail) Run() {
+	seq := ""
+	for m := range g.Order {
+		if s, ok := m.(string); ok {
+			seq = s
+			break
+		}
+		g.Err.Send(m)
+	}
+	if seq == "" {
+		for m := range g.In {
+			g.Out.Send(m)
+		}
+		return
+	}
+
+	next := 0
+	pending := map[int]Message{}
+	for m := range g.In {
+		n, ok := sequenceOf(m, seq)
+		if !ok {
+			g.Out.Send(m) // not sequenced
+			continue
+		}
+		if n < next {
+			g.emit(m, seq) // too late to put back in order
+			continue
+		}
+		pending[n] = m
+		if len(pending) > maxPending {
+			skip := lowest(pending)
+			err := fmt.Errorf("parallel: %s %d..%d missing", seq, next, skip-1)
+			g.Err.Send(g.Error(err, nil))
+			next = skip
+		}
+		for {
+			m, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			g.emit(m, seq)
+			next++
+		}
+	}
+
+	// whatever is left has gaps, send it out in order anyway
+	left := []int{}
+	for n := range pending {
+		left = append(left, n)
+	}
+	sort.Ints(left)
+	for _, n := range left {
+		g.emit(pending[n], seq)
+	}
+}
+
+// Send out a message without the sequence number which the head added to it.
+func (g *parallelTail) emit(m Message, seq string) {
+	delete(m.(PacketMap), seq)
+	g.Out.Send(m)
+}
+
+func sequenceOf(m Message, field string) (int, bool) {
+	if v, ok := m.(PacketMap); ok {
+		return Int(v[field])
+	}
+	return 0, false
+}
+
+func lowest(pending map[int]Message) int {
+	first := true
+	min := 0
+	for n := range pending {
+		if first || n < min {
+			first, min = false, n
+		}
+	}
+	return min
+}
@@ -0,0 +1,176 @@
+package flow_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/flowtest"
+	_ "github.com/laughlinez/flow/gadgets"
+)
+
+func init() {
+	flow.Registry["testJitter"] = func() flow.Circuitry { return new(jitter) }
+	flow.Registry["testDropFirst"] = func() flow.Circuitry { return new(dropFirst) }
+}
+
+// passes messages on after a delay which varies per message
+type jitter struct {
+	flow.Gadget
+	In  flow.Input
+	Out flow.Output
+}
+
+func (g *jitter) Run() {
+	for m := range g.In {
+		if v, ok := m.(flow.PacketMap); ok {
+			time.Sleep(time.Duration(v["i"].(int)%3) * time.Millisecond)
+		}
+		g.Out.Send(m)
+	}
+}
+
+// passes on all messages except the one with i == 0
+type dropFirst struct {
+	flow.Gadget
+	In  flow.Input
+	Out flow.Output
+}
+
+func (g *dropFirst) Run() {
+	for m := range g.In {
+		if v, ok := m.(flow.PacketMap); !ok || v["i"] != 0 {
+			g.Out.Send(m)
+		}
+	}
+}
+
+func ExampleParallel() {
+	g := flow.NewCircuit()
+	g.Add("p", "Parallel")
+	g.Add("print", "Printer")
+	g.Connect("p.Out", "print.In", 0)
+	g.Feed("p.Type", "Pipe")
+	g.Feed("p.Count", 1)
+	g.Feed("p.In", "abc")
+	g.Feed("p.In", 123)
+	g.Run()
+	// Output:
+	// abc
+	// 123
+}
+
+func runParallel(key, seq string) []flow.Message {
+	out := new(flowtest.Collector)
+	g := flow.NewCircuit()
+	g.Add("p", "Parallel")
+	g.AddCircuitry("out", out)
+	g.Connect("p.Out", "out.In", 0)
+	g.Feed("p.Type", "testJitter")
+	g.Feed("p.Count", 4.0) // as if from JSON
+	g.Feed("p.Key", key)
+	g.Feed("p.Seq", seq)
+	for i := 0; i < 60; i++ {
+		g.Feed("p.In", flow.PacketMap{"i": i, "k": string(rune('a' + i%5))})
+	}
+	g.Run()
+	return out.Msgs
+}
+
+func TestParallelKeyed(t *testing.T) {
+	msgs := runParallel("k", "")
+	if len(msgs) != 60 {
+		t.Fatalf("expected 60 messages, got %d", len(msgs))
+	}
+	last := map[string]int{}
+	for _, m := range msgs {
+		v := m.(flow.PacketMap)
+		k, i := v["k"].(string), v["i"].(int)
+		if prev, ok := last[k]; ok && i < prev {
+			t.Errorf("key %s out of order: %d after %d", k, i, prev)
+		}
+		last[k] = i
+	}
+}
+
+func TestParallelOrdered(t *testing.T) {
+	msgs := runParallel("", "seq")
+	if len(msgs) != 60 {
+		t.Fatalf("expected 60 messages, got %d", len(msgs))
+	}
+	for n, m := range msgs {
+		v := m.(flow.PacketMap)
+		if _, ok := v["seq"]; v["i"] != n || ok {
+			t.Errorf("message %d out of order: %v", n, v)
+		}
+	}
+}
+
+func TestParallelBadType(t *testing.T) {
+	out := new(flowtest.Collector)
+	g := flow.NewCircuit()
+	g.Add("p", "Parallel")
+	g.AddCircuitry("out", out)
+	g.Connect("p.Out", "out.In", 0)
+	g.Feed("p.Type", "NoSuchGadget")
+	g.Feed("p.In", "abc")
+	g.Run()
+	if len(out.Msgs) != 1 || out.Msgs[0] != "abc" {
+		t.Errorf("unexpected output: %v", out.Msgs)
+	}
+}
+
+func TestParallelBadSettings(t *testing.T) {
+	out := new(flowtest.Collector)
+	g := flow.NewCircuit()
+	g.Add("p", "Parallel")
+	g.AddCircuitry("out", out)
+	g.Connect("p.Out", "out.In", 0)
+	g.Feed("p.Type", "Pipe")
+	g.Feed("p.Count", "2")
+	g.Feed("p.Key", 1)
+	g.Feed("p.Seq", true)
+	g.Feed("p.In", "abc")
+	g.Run()
+	if len(out.Msgs) != 1 || out.Msgs[0] != "abc" {
+		t.Errorf("unexpected output: %v", out.Msgs)
+	}
+	errs := g.Errors()
+	if len(errs) != 3 {
+		t.Fatalf("expected three errors, got: %v", errs)
+	}
+	for i, s := range []string{"bad count", "bad key", "bad seq"} {
+		if !strings.Contains(errs[i].Error(), s) {
+			t.Errorf("expected %q, got: %v", s, errs[i])
+		}
+	}
+}
+
+func TestParallelOrderedGap(t *testing.T) {
+	// more messages than can be held back, waiting for the one which was lost
+	out := new(flowtest.Collector)
+	g := flow.NewCircuit()
+	g.Add("p", "Parallel")
+	g.AddCircuitry("out", out)
+	g.Connect("p.Out", "out.In", 0)
+	g.Feed("p.Type", "testDropFirst")
+	g.Feed("p.Count", 2)
+	g.Feed("p.Seq", "seq")
+	for i := 0; i < 1002; i++ {
+		g.Feed("p.In", flow.PacketMap{"i": i})
+	}
+	g.Run()
+	if len(out.Msgs) != 1001 {
+		t.Fatalf("expected 1001 messages, got %d", len(out.Msgs))
+	}
+	for n, m := range out.Msgs {
+		if v := m.(flow.PacketMap); v["i"] != n+1 {
+			t.Fatalf("message %d out of order: %v", n, v)
+		}
+	}
+	errs := g.Errors()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "seq 0..0 missing") {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
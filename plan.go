@@ -0,0 +1,69 @@
+package flow
+
+import (
+	"reflect"
+	"sync"
+)
+
+// A plan describes the pins of one gadget type. It is worked out once per type
+// and then cached, so that setting up thousands of gadgets of the same type
+// (as a dispatcher might) does not repeat the same reflection over and over.
+type plan struct {
+	pins    map[string]int // field index of each pin, by name
+	inputs  []int          // field indices of all Input pins
+	outputs []int          // field indices of all Output pins
+}
+
+var (
+	inputType     = reflect.TypeOf((*Input)(nil)).Elem()
+	outputType    = reflect.TypeOf((*Output)(nil)).Elem()
+	outputMapType = reflect.TypeOf((*map[string]Output)(nil)).Elem()
+	inputMapType  = reflect.TypeOf((*map[string]Input)(nil)).Elem()
+)
+
+// shared by all dangling pins: a closed input and an output which drops everything
+var (
+	nullInput Input  = closedInput()
+	sink      Output = &fakeSink{}
+)
+
+func closedInput() Input {
+	c := make(chan Message)
+	close(c)
+	return c
+}
+
+var plans = struct {
+	sync.RWMutex
+	m map[reflect.Type]*plan
+}{m: map[reflect.Type]*plan{}}
+
+// planOf returns the (cached) plan for a gadget struct type.
+func planOf(t reflect.Type) *plan {
+	plans.RLock()
+	p := plans.m[t]
+	plans.RUnlock()
+	if p != nil {
+		return p
+	}
+
+	p = &plan{pins: map[string]int{}}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		switch field.Type {
+		case inputType:
+			p.inputs = append(p.inputs, i)
+		case outputType:
+			p.outputs = append(p.outputs, i)
+		case outputMapType, inputMapType:
+		default:
+			continue
+		}
+		p.pins[field.Name] = i
+	}
+
+	plans.Lock()
+	plans.m[t] = p
+	plans.Unlock()
+	return p
+}
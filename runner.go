@@ -2,6 +2,9 @@ package flow
 
 import (
 	"reflect"
+	"strings"
+	"sync"
+	"unicode"
 
 	"github.com/golang/glog"
 )
@@ -26,34 +29,191 @@ func (g *transformer) Run() {
 	}
 }
 
-// TODO: work-in-progress
-
-// A runner turns a function with I/O channels into a gadget.
+// A runner turns a function with I/O channels into a gadget. The description
+// starts with header lines, up to the first empty line. "Input:" and "Output:"
+// headers name the pins, separated by spaces or commas. The inputs are passed
+// to the function as its first arguments, in the order listed. The outputs
+// map onto the remaining arguments, followed by the return values.
+//
+// Input arguments must be receivable channels, output arguments must be sendable
+// channels or Outputs, and return values must be receivable channels. Channels
+// can have any element type, messages which don't fit are logged and dropped.
+// Output arguments are closed when the function returns, the gadget keeps
+// running until all returned channels have been closed.
 func Runner(desc string, fun interface{}) Circuitry {
-	r := runner{desc: desc, fun: fun}
-	// r.ins = map[string]*Input{ "In": new(Input) }
-	return &r
+	r := &runner{
+		fun:  reflect.ValueOf(fun),
+		ins:  map[string]*Input{},
+		outs: map[string]*Output{},
+	}
+	for _, line := range strings.Split(desc, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) < 2 {
+			continue
+		}
+		names := strings.FieldsFunc(kv[1], func(c rune) bool {
+			return c == ',' || unicode.IsSpace(c)
+		})
+		switch strings.TrimSpace(kv[0]) {
+		case "Input":
+			for _, name := range names {
+				r.ins[name] = new(Input)
+			}
+			r.inNames = append(r.inNames, names...)
+		case "Output":
+			for _, name := range names {
+				r.outs[name] = new(Output)
+			}
+			r.outNames = append(r.outNames, names...)
+		}
+	}
+	r.check()
+	return r
 }
 
 type runner struct {
 	Gadget
 
-	desc string
-	fun  interface{}
-	ins  map[string]*Input
-	outs map[string]*Output
+	fun      reflect.Value
+	inNames  []string
+	outNames []string
+	ins      map[string]*Input
+	outs     map[string]*Output
+}
+
+// verify that the function matches the pins in its description
+func (g *runner) check() {
+	t := g.fun.Type()
+	if t.Kind() != reflect.Func {
+		glog.Fatalln("runner needs a function:", t)
+	}
+	ni, no := len(g.inNames), len(g.outNames)
+	if t.NumIn() < ni || t.NumIn()+t.NumOut() != ni+no {
+		glog.Fatalf("runner pins %v %v don't match: %s", g.inNames, g.outNames, t)
+	}
+	for i := 0; i < t.NumIn(); i++ {
+		p := t.In(i)
+		switch {
+		case i < ni && p.Kind() == reflect.Chan && p.ChanDir()&reflect.RecvDir != 0:
+		case i >= ni && p == outputType:
+		case i >= ni && p.Kind() == reflect.Chan && p.ChanDir()&reflect.SendDir != 0:
+		default:
+			glog.Fatalf("runner argument %d has the wrong type: %s", i, t)
+		}
+	}
+	for i := 0; i < t.NumOut(); i++ {
+		p := t.Out(i)
+		if p.Kind() != reflect.Chan || p.ChanDir()&reflect.RecvDir == 0 {
+			glog.Fatalf("runner result %d has the wrong type: %s", i, t)
+		}
+	}
 }
 
 func (g *runner) pinValue(pin string) reflect.Value {
-	println("lookupPin: " + pin)
-	v := reflect.ValueOf(g.ins[pinPart(pin)])
-	if !v.IsValid() {
-		glog.Fatalln("pin not defined:", pin)
+	name := pinPart(pin)
+	if p, ok := g.ins[name]; ok {
+		return reflect.ValueOf(p).Elem()
 	}
-	println(123)
-	return v.Elem()
+	if p, ok := g.outs[name]; ok {
+		return reflect.ValueOf(p).Elem()
+	}
+	glog.Fatalln("pin not defined:", pin)
+	return reflect.Value{}
 }
 
 func (g *runner) Run() {
-	// TODO: ...
+	t := g.fun.Type()
+	done := make(chan struct{})
+	var closers []reflect.Value
+	var wg sync.WaitGroup
+
+	args := make([]reflect.Value, t.NumIn())
+	for i, name := range g.inNames {
+		in := *g.ins[name]
+		if in == nil {
+			in = nullInput
+		}
+		c := makeChan(t.In(i).Elem())
+		go feedChan(in, c, done)
+		args[i] = c
+	}
+	outs := g.outputPins()
+	for i := len(g.inNames); i < t.NumIn(); i++ {
+		out := outs[0]
+		outs = outs[1:]
+		if t.In(i) == outputType {
+			args[i] = reflect.ValueOf(&out).Elem()
+			continue
+		}
+		c := makeChan(t.In(i).Elem())
+		wg.Add(1)
+		go drainChan(c, out, &wg)
+		closers = append(closers, c)
+		args[i] = c
+	}
+
+	for i, c := range g.fun.Call(args) {
+		wg.Add(1)
+		go drainChan(c, outs[i], &wg)
+	}
+	for _, c := range closers {
+		c.Close()
+	}
+	wg.Wait()
+	close(done) // stop feeding inputs no one is reading anymore
+}
+
+// the connected outputs in the order listed, with a sink for dangling ones
+func (g *runner) outputPins() []Output {
+	outs := make([]Output, len(g.outNames))
+	for i, name := range g.outNames {
+		outs[i] = *g.outs[name]
+		if outs[i] == nil {
+			outs[i] = sink
+		}
+	}
+	return outs
+}
+
+func makeChan(elem reflect.Type) reflect.Value {
+	return reflect.MakeChan(reflect.ChanOf(reflect.BothDir, elem), 0)
+}
+
+// pass messages from an input to a typed channel, until either one is done
+func feedChan(in Input, c reflect.Value, done chan struct{}) {
+	defer c.Close()
+	elem := c.Type().Elem()
+	for m := range in {
+		v := reflect.Zero(elem)
+		if m != nil {
+			v = reflect.ValueOf(m)
+			if !v.Type().AssignableTo(elem) {
+				glog.Errorf("runner: %T message dropped, expected %s", m, elem)
+				continue
+			}
+		}
+		chosen, _, _ := reflect.Select([]reflect.SelectCase{
+			{Dir: reflect.SelectSend, Chan: c, Send: v},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)},
+		})
+		if chosen == 1 {
+			return
+		}
+	}
+}
+
+// pass values from a typed channel to an output, until the channel is closed
+func drainChan(c reflect.Value, out Output, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		v, ok := c.Recv()
+		if !ok {
+			return
+		}
+		out.Send(v.Interface())
+	}
 }
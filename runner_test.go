@@ -0,0 +1,55 @@
+package flow_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/laughlinez/flow"
+	"github.com/laughlinez/flow/flowtest"
+)
+
+func TestRunnerPins(t *testing.T) {
+	// sums pairs of inputs to Sum, reports strings from B to Odd, and
+	// sends each sum to Log as well
+	fun := func(a, b <-chan int, sum chan<- int, log flow.Output) <-chan string {
+		odd := make(chan string, 10)
+		defer close(odd)
+		for x := range a {
+			y := <-b
+			sum <- x + y
+			log.Send(x + y)
+			if (x+y)%2 != 0 {
+				odd <- "odd"
+			}
+		}
+		return odd
+	}
+	desc := "Input: A, B\nOutput: Sum Log\nOutput: Odd"
+
+	g := flow.NewCircuit()
+	sum, log, odd := new(flowtest.Collector), new(flowtest.Collector), new(flowtest.Collector)
+	g.AddCircuitry("r", flow.Runner(desc, fun))
+	g.AddCircuitry("s", sum)
+	g.AddCircuitry("l", log)
+	g.AddCircuitry("o", odd)
+	g.Connect("r.Sum", "s.In", 0)
+	g.Connect("r.Log", "l.In", 0)
+	g.Connect("r.Odd", "o.In", 0)
+	g.Feed("r.A", 1)
+	g.Feed("r.A", 2)
+	g.Feed("r.B", "oops") // wrong type, dropped
+	g.Feed("r.B", 3)
+	g.Feed("r.B", 4)
+	g.Run()
+
+	want := []flow.Message{4, 6}
+	if !reflect.DeepEqual(sum.Msgs, want) {
+		t.Errorf("sum: expected %v, got %v", want, sum.Msgs)
+	}
+	if !reflect.DeepEqual(log.Msgs, want) {
+		t.Errorf("log: expected %v, got %v", want, log.Msgs)
+	}
+	if len(odd.Msgs) != 0 {
+		t.Errorf("odd: expected nothing, got %v", odd.Msgs)
+	}
+}
@@ -0,0 +1,296 @@
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+func init() {
+	Registry["Validate"] = func() Circuitry { return new(Validate) }
+}
+
+// A Schema describes the fields expected in a stream of PacketMaps. It can be
+// loaded from JSON, such as:
+//
+//	{"strict": true, "fields": {
+//		"temp":        {"type": "number", "required": true, "min": -40, "max": 85},
+//		"unit":        {"enum": ["C", "F"]},
+//		"meta.device": {"type": "string", "max": 20}}}
+//
+// Field names can be dotted paths into nested maps. A strict schema also
+// rejects top-level fields which are not mentioned.
+type Schema struct {
+	Fields map[string]FieldSpec `json:"fields"`
+	Strict bool                 `json:"strict"`
+}
+
+// A FieldSpec lists the constraints on one field, all of them are optional.
+// The type is one of: string, number, int, bool, time, duration, bytes, map,
+// or slice. Min and max limit numbers, and the length of strings, bytes, and
+// slices. Enum lists the values allowed, numbers of any type compare equal if
+// their values are the same.
+type FieldSpec struct {
+	Type     string        `json:"type"`
+	Required bool          `json:"required"`
+	Min      *float64      `json:"min"`
+	Max      *float64      `json:"max"`
+	Enum     []interface{} `json:"enum"`
+}
+
+// A Violation describes a problem with one field.
+type Violation struct {
+	Field   string
+	Problem string
+}
+
+func (v Violation) String() string {
+	return v.Field + ": " + v.Problem
+}
+
+// Invalid is sent out by the Validate gadget for each rejected PacketMap.
+type Invalid struct {
+	Map        PacketMap
+	Violations []Violation
+}
+
+func (e Invalid) Error() string {
+	list := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		list[i] = v.String()
+	}
+	return "invalid packet: " + strings.Join(list, ", ")
+}
+
+var schemaTypes = map[string]bool{"": true, "string": true, "number": true,
+	"int": true, "bool": true, "time": true, "duration": true, "bytes": true,
+	"map": true, "slice": true}
+
+// Load a schema from JSON, and check that it makes sense.
+func LoadSchema(data []byte) (*Schema, error) {
+	s := &Schema{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("schema: %v", err)
+	}
+	for name, f := range s.Fields {
+		if !schemaTypes[f.Type] {
+			return nil, fmt.Errorf("schema: unknown type %q for %s", f.Type, name)
+		}
+		if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+			return nil, fmt.Errorf("schema: min > max for %s", name)
+		}
+	}
+	return s, nil
+}
+
+// Check a PacketMap against the schema, returns all violations found, sorted
+// by field name.
+func (s *Schema) Validate(pm PacketMap) []Violation {
+	var list []Violation
+	report := func(field, format string, args ...interface{}) {
+		list = append(list, Violation{field, fmt.Sprintf(format, args...)})
+	}
+
+	for name, f := range s.Fields {
+		v, ok := pm.Get(name)
+		if !ok || v == nil {
+			if f.Required {
+				report(name, "missing")
+			}
+			continue
+		}
+		if !hasType(v, f.Type) {
+			report(name, "expected %s, got %T", f.Type, v)
+			continue
+		}
+		if n, ok := measure(v); ok {
+			if f.Min != nil && n < *f.Min {
+				report(name, "%v is below %v", v, *f.Min)
+			}
+			if f.Max != nil && n > *f.Max {
+				report(name, "%v is above %v", v, *f.Max)
+			}
+		}
+		if f.Enum != nil && !inEnum(v, f.Enum) {
+			report(name, "%v is not one of %v", v, f.Enum)
+		}
+	}
+
+	if s.Strict {
+		for k := range pm {
+			if !s.mentions(k) {
+				report(k, "unexpected field")
+			}
+		}
+	}
+
+	sort.Sort(byField(list))
+	return list
+}
+
+// true if the field, or a nested field below it, is part of the schema
+func (s *Schema) mentions(key string) bool {
+	if _, ok := s.Fields[key]; ok {
+		return true
+	}
+	for name := range s.Fields {
+		if strings.HasPrefix(name, key+".") {
+			return true
+		}
+	}
+	return false
+}
+
+type byField []Violation
+
+func (a byField) Len() int      { return len(a) }
+func (a byField) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byField) Less(i, j int) bool {
+	if a[i].Field != a[j].Field {
+		return a[i].Field < a[j].Field
+	}
+	return a[i].Problem < a[j].Problem
+}
+
+func hasType(v interface{}, typ string) bool {
+	switch typ {
+	case "":
+		return true
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := Number(v)
+		return ok
+	case "int":
+		f, ok := Number(v)
+		return ok && f == float64(int64(f))
+	case "bool":
+		_, ok := v.(bool)
+		return ok
+	case "time":
+		_, err := PacketMap{"": v}.GetTime("")
+		_, num := Number(v)
+		return err == nil && !num
+	case "duration":
+		_, err := PacketMap{"": v}.GetDuration("")
+		_, num := Number(v)
+		return err == nil && !num
+	case "bytes":
+		_, ok := v.([]byte)
+		return ok
+	case "map":
+		_, err := PacketMap{"": v}.GetMap("")
+		return err == nil
+	case "slice":
+		_, err := PacketMap{"": v}.GetSlice("")
+		_, bytes := v.([]byte)
+		return err == nil && !bytes
+	}
+	return false
+}
+
+// the value used for range checks, i.e. a number or a length
+func measure(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case string:
+		return float64(len(x)), true
+	case []byte:
+		return float64(len(x)), true
+	}
+	if f, ok := Number(v); ok {
+		return f, true
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice {
+		return float64(rv.Len()), true
+	}
+	return 0, false
+}
+
+func inEnum(v interface{}, enum []interface{}) bool {
+	f, num := Number(v)
+	for _, e := range enum {
+		if g, ok := Number(e); ok && num {
+			if f == g {
+				return true
+			}
+		} else if Equal(v, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate PacketMaps against a schema, which is taken from the Schema pin, as
+// a *Schema or as JSON. Conforming maps are sent to Out, others are sent to Rej
+// as an Invalid, listing all the problems. All other messages pass through.
+// If the schema cannot be loaded, all PacketMaps are rejected.
+// Registers as "Validate".
+type Validate struct {
+	Gadget
+	Schema Input
+	In     Input
+	Out    Output
+	Rej    Output
+}
+
+// Start validating.
+func (g *Validate) Run() {
+	var schema *Schema
+	var err error
+	if m, ok := <-g.Schema; ok {
+		schema, err = schemaOf(m)
+	} else {
+		err = fmt.Errorf("schema: none given")
+	}
+	if err != nil {
+		glog.Errorln(err)
+	}
+
+	for m := range g.In {
+		pm, ok := m.(PacketMap)
+		if v, isMap := m.(map[string]interface{}); isMap {
+			pm, ok = PacketMap(v), true
+		}
+		if !ok {
+			g.Out.Send(m)
+			continue
+		}
+		var problems []Violation
+		if schema == nil {
+			problems = []Violation{{"", "no valid schema"}}
+		} else {
+			problems = schema.Validate(pm)
+		}
+		if len(problems) > 0 {
+			g.Rej.Send(Invalid{pm, problems})
+		} else {
+			g.Out.Send(m)
+		}
+	}
+}
+
+// Accepts a schema, JSON text, or decoded JSON.
+func schemaOf(m Message) (*Schema, error) {
+	var data []byte
+	switch v := m.(type) {
+	case *Schema:
+		return v, nil
+	case Schema:
+		return &v, nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			return nil, fmt.Errorf("schema: %v", err)
+		}
+	}
+	return LoadSchema(data)
+}
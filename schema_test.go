@@ -0,0 +1,57 @@
+package flow_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/laughlinez/flow"
+)
+
+const testSchema = `{"strict": true, "fields": {
+	"temp": {"type": "number", "required": true, "min": -40, "max": 85},
+	"unit": {"enum": ["C", "F"]},
+	"node": {"type": "int", "enum": [1, 2, 3]},
+	"meta.device": {"type": "string", "max": 4}}}`
+
+func ExampleValidate() {
+	g := flow.NewCircuit()
+	g.Add("v", "Validate")
+	g.Add("p", "Printer")
+	g.Connect("v.Out", "p.In", 0)
+	g.Connect("v.Rej", "p.In", 0)
+	g.Feed("v.Schema", testSchema)
+	g.Feed("v.In", flow.PacketMap{"temp": 21.5, "unit": "C"})
+	g.Feed("v.In", flow.PacketMap{"temp": 99, "unit": "K", "x": 1})
+	g.Run()
+	// Output:
+	// map[temp:21.5 unit:C]
+	// invalid packet: temp: 99 is above 85, unit: K is not one of [C F], x: unexpected field
+}
+
+func TestSchema(t *testing.T) {
+	s, err := flow.LoadSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pm   flow.PacketMap
+		want string
+	}{
+		{flow.PacketMap{"temp": 0, "node": 2.0}, "[]"},
+		{flow.PacketMap{"temp": "hot"}, "[temp: expected number, got string]"},
+		{flow.PacketMap{"node": 1.5}, "[node: expected int, got float64 temp: missing]"},
+		{flow.PacketMap{"temp": -41, "node": uint8(4)},
+			"[node: 4 is not one of [1 2 3] temp: -41 is below -40]"},
+		{flow.PacketMap{"temp": 1, "meta": map[string]interface{}{"device": "rf12b"}},
+			"[meta.device: rf12b is above 4]"},
+	}
+	for _, test := range tests {
+		if got := fmt.Sprint(s.Validate(test.pm)); got != test.want {
+			t.Errorf("%v: got %s, want %s", test.pm, got, test.want)
+		}
+	}
+
+	if _, err := flow.LoadSchema([]byte(`{"fields": {"a": {"type": "float"}}}`)); err == nil {
+		t.Error("expected an error for an unknown type")
+	}
+}
@@ -0,0 +1,125 @@
+package flow
+
+import (
+	"sync"
+	"time"
+)
+
+// A TimeSource tells the time, and when some time has passed. Gadgets which
+// depend on time can use one, so that they can be tested without waiting for
+// real time to pass (see ManualTime).
+type TimeSource interface {
+	Now() time.Time
+	// a channel which receives the current time once d has passed
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemTime is the TimeSource which uses the real clock.
+var SystemTime TimeSource = systemTime{}
+
+type systemTime struct{}
+
+func (systemTime) Now() time.Time                         { return time.Now() }
+func (systemTime) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// ManualTime is a TimeSource for tests: time stands still, until it is moved
+// forward with Advance or Set.
+type ManualTime struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// Create a manual time source, starting at the given time.
+func NewManualTime(start time.Time) *ManualTime {
+	return &ManualTime{now: start}
+}
+
+func (t *ManualTime) Now() time.Time {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.now
+}
+
+// After returns a channel which fires once time has been moved past now + d,
+// or right away if d is not positive.
+func (t *ManualTime) After(d time.Duration) <-chan time.Time {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- t.now
+	} else {
+		t.waiters = append(t.waiters, waiter{t.now.Add(d), c})
+	}
+	return c
+}
+
+// Move time forward, firing all channels from After which are due.
+func (t *ManualTime) Advance(d time.Duration) {
+	t.Set(t.Now().Add(d))
+}
+
+// Move time to the given moment, firing all channels from After which are due.
+// Time never goes backwards, setting it to an earlier moment has no effect.
+func (t *ManualTime) Set(now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if now.Before(t.now) {
+		return
+	}
+	t.now = now
+	pending := t.waiters[:0]
+	for _, w := range t.waiters {
+		if now.Before(w.at) {
+			pending = append(pending, w)
+		} else {
+			w.c <- now
+		}
+	}
+	t.waiters = pending
+}
+
+// An Alarm goes off at a given time, as told by a TimeSource. It keeps a single
+// pending timer, so that it does not have to be re-created each time a gadget
+// goes through its select loop. Wait on C, which is nil while the alarm is off,
+// and call Clear once it has gone off.
+type Alarm struct {
+	C     <-chan time.Time
+	clock TimeSource
+	at    time.Time
+}
+
+// Create an alarm for the given time source, or the system time if it is nil.
+func NewAlarm(clock TimeSource) *Alarm {
+	if clock == nil {
+		clock = SystemTime
+	}
+	return &Alarm{clock: clock}
+}
+
+// Set the alarm to go off at the given time, a zero time turns it off.
+func (a *Alarm) Set(at time.Time) {
+	if at.IsZero() {
+		a.Clear()
+	} else if !at.Equal(a.at) {
+		a.at = at
+		a.C = a.clock.After(at.Sub(a.clock.Now()))
+	}
+}
+
+// Turn the alarm off.
+func (a *Alarm) Clear() {
+	a.at = time.Time{}
+	a.C = nil
+}
+
+// The time at which the alarm goes off, or zero if it is off.
+func (a *Alarm) At() time.Time {
+	return a.at
+}
@@ -0,0 +1,38 @@
+package flow_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/laughlinez/flow"
+)
+
+func TestManualTime(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := flow.NewManualTime(start)
+	a := clock.After(10 * time.Second)
+	b := clock.After(20 * time.Second)
+
+	clock.Advance(15 * time.Second)
+	select {
+	case now := <-a:
+		if !now.Equal(start.Add(15 * time.Second)) {
+			t.Errorf("unexpected time: %v", now)
+		}
+	default:
+		t.Error("a should have fired")
+	}
+	select {
+	case <-b:
+		t.Error("b should not have fired yet")
+	default:
+	}
+
+	clock.Set(start) // no effect, time does not go back
+	clock.Set(start.Add(time.Minute))
+	if !clock.Now().Equal(start.Add(time.Minute)) {
+		t.Errorf("unexpected time: %v", clock.Now())
+	}
+	<-b
+	<-clock.After(0)
+}
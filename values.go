@@ -0,0 +1,76 @@
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// Helpers to decode settings fed into gadgets. Values fed in from Go code and
+// values decoded from JSON look different (i.e. int vs. float64), these
+// helpers hide that difference so that every gadget treats them the same way.
+
+// Number returns the numeric value of a message, which can be any of Go's int,
+// uint, or float types, or a json.Number. Strings are not converted.
+func Number(m Message) (float64, bool) {
+	switch v := m.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64,
+		float32, float64:
+		return reflect.ValueOf(v).Convert(reflect.TypeOf(0.0)).Float(), true
+	}
+	return 0, false
+}
+
+// Int returns the value of a whole number, such as a count or a size. Floats
+// are accepted as long as they have no fractional part, since that is what
+// numbers decoded from JSON turn into.
+func Int(m Message) (int, bool) {
+	f, ok := Number(m)
+	if !ok || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, false
+	}
+	return int(f), true
+}
+
+// Equal reports whether two messages are the same, using ==. Messages which
+// can't be compared that way, such as maps and slices, are never equal.
+func Equal(a, b Message) (eq bool) {
+	defer func() { recover() }()
+	return a == b
+}
+
+// ParseDuration returns the duration in a message, which must be a string such
+// as "1.5s" (see time.ParseDuration). Gadgets which need a positive duration
+// have to check for that themselves.
+func ParseDuration(m Message) (time.Duration, error) {
+	if s, ok := m.(string); ok {
+		return time.ParseDuration(s)
+	}
+	return 0, fmt.Errorf("expected a duration, got %T", m)
+}
+
+// KeyOf returns a field of a PacketMap as string, for use as grouping key. The
+// field can be a dotted path into nested maps, as with PacketMap.Get. Other
+// messages, a missing field, and an empty field name all map to "".
+func KeyOf(m Message, field string) string {
+	if v, ok := m.(PacketMap); ok && field != "" {
+		if k, ok := v.Get(field); ok {
+			return fmt.Sprint(k)
+		}
+	}
+	return ""
+}
+
+// PassThrough sends all messages from in to out, until in is closed. This is
+// used by gadgets which can't make sense of their settings, to stay out of the
+// way of the rest of the circuit.
+func PassThrough(in Input, out Output) {
+	for m := range in {
+		out.Send(m)
+	}
+}
@@ -0,0 +1,76 @@
+package flow_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/laughlinez/flow"
+)
+
+func TestNumber(t *testing.T) {
+	for _, m := range []flow.Message{3, int64(3), uint8(3), float32(3), 3.0, json.Number("3")} {
+		if f, ok := flow.Number(m); !ok || f != 3 {
+			t.Errorf("Number(%#v) = %v, %v", m, f, ok)
+		}
+	}
+	for _, m := range []flow.Message{"3", nil, true, json.Number("x")} {
+		if _, ok := flow.Number(m); ok {
+			t.Errorf("Number(%#v) should fail", m)
+		}
+	}
+}
+
+func TestInt(t *testing.T) {
+	if n, ok := flow.Int(12.0); !ok || n != 12 {
+		t.Errorf("Int(12.0) = %v, %v", n, ok)
+	}
+	if n, ok := flow.Int(uint(7)); !ok || n != 7 {
+		t.Errorf("Int(uint(7)) = %v, %v", n, ok)
+	}
+	if _, ok := flow.Int(2.5); ok {
+		t.Error("Int(2.5) should fail")
+	}
+	if _, ok := flow.Int("12"); ok {
+		t.Error(`Int("12") should fail`)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	if !flow.Equal("abc", "abc") || flow.Equal(1, "1") {
+		t.Error("unexpected result for scalars")
+	}
+	if flow.Equal(flow.PacketMap{}, flow.PacketMap{}) {
+		t.Error("maps should never be equal")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	if d, err := flow.ParseDuration("1.5s"); err != nil || d != 1500*time.Millisecond {
+		t.Errorf("ParseDuration(1.5s) = %v, %v", d, err)
+	}
+	if d, err := flow.ParseDuration("0s"); err != nil || d != 0 {
+		t.Errorf("ParseDuration(0s) = %v, %v", d, err)
+	}
+	for _, m := range []flow.Message{"abc", 10, nil} {
+		if _, err := flow.ParseDuration(m); err == nil {
+			t.Errorf("ParseDuration(%#v) should fail", m)
+		}
+	}
+}
+
+func TestKeyOf(t *testing.T) {
+	m := flow.PacketMap{"node": 5, "hdr": map[string]interface{}{"id": "x"}}
+	if k := flow.KeyOf(m, "node"); k != "5" {
+		t.Errorf("expected 5, got %q", k)
+	}
+	if k := flow.KeyOf(m, "hdr.id"); k != "x" {
+		t.Errorf("expected x, got %q", k)
+	}
+	if k := flow.KeyOf(m, "missing"); k != "" {
+		t.Errorf("expected no key, got %q", k)
+	}
+	if k := flow.KeyOf("node", "node"); k != "" {
+		t.Errorf("expected no key, got %q", k)
+	}
+}